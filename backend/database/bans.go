@@ -0,0 +1,71 @@
+package database
+
+import (
+	"time"
+
+	"proxy-server/models"
+)
+
+const authBanColumns = `id, kind, value, reason, failures, created_at, expires_at`
+
+func scanAuthBan(row rowScanner) (*models.AuthBan, error) {
+	var ban models.AuthBan
+	err := row.Scan(&ban.ID, &ban.Kind, &ban.Value, &ban.Reason, &ban.Failures, &ban.CreatedAt, &ban.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+// GetActiveAuthBans returns the bans that have not expired by now.
+func (d *Database) GetActiveAuthBans(now time.Time) ([]models.AuthBan, error) {
+	rows, err := d.DB.Query(`
+		SELECT `+authBanColumns+`
+		FROM auth_bans
+		WHERE expires_at > $1
+		ORDER BY created_at DESC, id DESC
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := []models.AuthBan{}
+	for rows.Next() {
+		ban, err := scanAuthBan(rows)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, *ban)
+	}
+	return bans, rows.Err()
+}
+
+// SaveAuthBan records a ban, replacing an earlier one for the same IP or
+// username.
+func (d *Database) SaveAuthBan(kind, value, reason string, failures int, expiresAt time.Time) (*models.AuthBan, error) {
+	return scanAuthBan(d.DB.QueryRow(`
+		INSERT INTO auth_bans (kind, value, reason, failures, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (kind, value) DO UPDATE
+		SET reason = EXCLUDED.reason, failures = EXCLUDED.failures,
+		    created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+		RETURNING `+authBanColumns,
+		kind, value, reason, failures, expiresAt))
+}
+
+// DeleteAuthBan lifts a ban. It returns sql.ErrNoRows if there is none
+// with id.
+func (d *Database) DeleteAuthBan(id int) (*models.AuthBan, error) {
+	return scanAuthBan(d.DB.QueryRow(`
+		DELETE FROM auth_bans
+		WHERE id = $1
+		RETURNING `+authBanColumns,
+		id))
+}
+
+// DeleteExpiredAuthBans drops bans that ran out before now.
+func (d *Database) DeleteExpiredAuthBans(now time.Time) error {
+	_, err := d.DB.Exec(`DELETE FROM auth_bans WHERE expires_at <= $1`, now)
+	return err
+}
@@ -3,8 +3,11 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -12,6 +15,8 @@ import (
 
 	pq "github.com/lib/pq"
 	"proxy-server/models"
+	"proxy-server/rules"
+	"proxy-server/schedule"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -135,24 +140,138 @@ func (d *Database) execInitSQL(path string) error {
 	return nil
 }
 
+// userColumns lists the users table columns in the order expected by
+// userScanDest.
+const userColumns = `id, username, password_hash, email, comment, is_admin, is_active,
+		proxy_type, twofa_enabled, upstream_pool, quota_daily_bytes, quota_monthly_bytes,
+		quota_daily_requests, quota_monthly_requests, bandwidth_up, bandwidth_down,
+		bandwidth_burst, max_connections, requests_per_second, requests_per_minute,
+		mitm_enabled, http_cache, egress_addresses, egress_strategy, ` + userScheduleColumn + `,
+		created_at, updated_at`
+
+// userScheduleColumn selects a user's schedule as JSON, or NULL while they
+// inherit it from their groups.
+const userScheduleColumn = `CASE WHEN schedule_windows IS NULL THEN NULL ELSE json_build_object(
+		'time_zone', schedule_time_zone, 'windows', schedule_windows, 'holidays', schedule_holidays) END`
+
+// scheduleScanner scans userScheduleColumn into a nil or set schedule.
+type scheduleScanner struct {
+	dest **models.Schedule
+}
+
+func (s scheduleScanner) Scan(src interface{}) error {
+	*s.dest = nil
+	if src == nil {
+		return nil
+	}
+	data, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("unexpected schedule value %T", src)
+	}
+	var accessSchedule models.Schedule
+	if err := json.Unmarshal(data, &accessSchedule); err != nil {
+		return err
+	}
+	*s.dest = &accessSchedule
+	return nil
+}
+
+func userScanDest(user *models.User) []interface{} {
+	return []interface{}{
+		&user.ID, &user.Username, &user.PasswordHash, &user.Email, &user.Comment,
+		&user.IsAdmin, &user.IsActive, &user.ProxyType, &user.TwoFAEnabled,
+		&user.UpstreamPool, &user.QuotaDailyBytes, &user.QuotaMonthlyBytes,
+		&user.QuotaDailyRequests, &user.QuotaMonthlyRequests, &user.BandwidthUp,
+		&user.BandwidthDown, &user.BandwidthBurst, &user.MaxConnections, &user.RequestsPerSecond,
+		&user.RequestsPerMinute, &user.MITMEnabled, &user.HTTPCache, pq.Array(&user.EgressAddresses),
+		&user.EgressStrategy, scheduleScanner{&user.Schedule}, &user.CreatedAt, &user.UpdatedAt,
+	}
+}
+
+// CreateUser stores a new user together with its lists, host lists and
+// groups. A nil proxy type, quota or schedule is left NULL, to be inherited
+// from the user's groups. Admins get no lists.
 func (d *Database) CreateUser(user *models.UserCreate, passwordHash string) (*models.User, error) {
-	proxyType := user.ProxyType
-	if proxyType == "" {
-		proxyType = "default"
+	httpCache := user.HTTPCache == nil || *user.HTTPCache
+	egressAddresses := user.EgressAddresses
+	if egressAddresses == nil {
+		egressAddresses = []string{}
 	}
-	var newUser models.User
-	err := d.DB.QueryRow(`
-		INSERT INTO users (username, password_hash, email, comment, is_admin, proxy_type)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, username, email, comment, is_admin, is_active, proxy_type, twofa_enabled, created_at, updated_at
-	`, user.Username, passwordHash, user.Email, user.Comment, user.IsAdmin, proxyType).
-		Scan(&newUser.ID, &newUser.Username, &newUser.Email, &newUser.Comment,
-			&newUser.IsAdmin, &newUser.IsActive, &newUser.ProxyType, &newUser.TwoFAEnabled, &newUser.CreatedAt, &newUser.UpdatedAt)
+	egressStrategy := user.EgressStrategy
+	if egressStrategy == "" {
+		egressStrategy = EgressStrategyRoundRobin
+	}
+	scheduleArgs, err := scheduleColumnArgs(user.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	var lists []userListUpdate
+	if !user.IsAdmin {
+		lists = userCreateLists(user)
+	}
+	for i := range lists {
+		normalized, err := lists[i].normalize(lists[i].entries)
+		if err != nil {
+			return nil, err
+		}
+		lists[i].entries = normalized
+	}
+
+	var id int
+	err = d.withTx(func(tx *sql.Tx) error {
+		err := tx.QueryRow(`
+			INSERT INTO users (username, password_hash, email, comment, is_admin, proxy_type, upstream_pool,
+				quota_daily_bytes, quota_monthly_bytes, quota_daily_requests, quota_monthly_requests,
+				bandwidth_up, bandwidth_down, bandwidth_burst, max_connections, requests_per_second,
+				requests_per_minute, mitm_enabled, http_cache, egress_addresses, egress_strategy,
+				schedule_time_zone, schedule_windows, schedule_holidays)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21,
+				$22, $23, $24)
+			RETURNING id
+		`, user.Username, passwordHash, user.Email, user.Comment, user.IsAdmin, user.ProxyType, user.UpstreamPool,
+			user.QuotaDailyBytes, user.QuotaMonthlyBytes, user.QuotaDailyRequests, user.QuotaMonthlyRequests,
+			user.BandwidthUp, user.BandwidthDown, user.BandwidthBurst, user.MaxConnections,
+			user.RequestsPerSecond, user.RequestsPerMinute, user.MITMEnabled, httpCache,
+			pq.Array(egressAddresses), egressStrategy, scheduleArgs[0], scheduleArgs[1], scheduleArgs[2]).
+			Scan(&id)
+		if err != nil {
+			return err
+		}
+		if user.IsAdmin {
+			return nil
+		}
 
+		for _, list := range lists {
+			if err := replaceListIn(tx, list.table, "user_id", id, list.entries); err != nil {
+				return err
+			}
+		}
+		if err := replaceHostListRefsIn(tx, "user_host_lists", "user_id", id, HostListWhitelist, user.WhitelistLists); err != nil {
+			return err
+		}
+		if err := replaceHostListRefsIn(tx, "user_host_lists", "user_id", id, HostListBlacklist, user.BlacklistLists); err != nil {
+			return err
+		}
+		return replaceMembershipsIn(tx, "user_id", id, "group_id", user.GroupIDs)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &newUser, nil
+	return d.GetUserByID(id)
+}
+
+// userCreateLists collects the lists of a new user, in the order they are
+// written.
+func userCreateLists(user *models.UserCreate) []userListUpdate {
+	return []userListUpdate{
+		{"user_proxy_whitelist", user.Whitelist, sanitizeEntries},
+		{"user_proxy_blacklist", user.Blacklist, sanitizeEntries},
+		{"user_whitelist_exclusions", user.WhitelistExclusions, sanitizeEntries},
+		{"user_blacklist_exclusions", user.BlacklistExclusions, sanitizeEntries},
+		{"user_egress_exceptions", user.EgressExceptions, sanitizeEntries},
+		{"user_mitm_hosts", user.MITMHosts, sanitizeEntries},
+		{"user_client_allowlist", user.ClientAllowlist, normalizeClientEntries},
+	}
 }
 
 func (d *Database) GetUserByUsername(username string) (*models.User, error) {
@@ -166,13 +285,12 @@ func (d *Database) GetUserByUsernameCtx(ctx context.Context, username string) (*
 	}
 	var user models.User
 	err := d.DB.QueryRowContext(ctx, `
-		SELECT id, username, password_hash, email, comment, is_admin, is_active, proxy_type, twofa_enabled, created_at, updated_at
+		SELECT `+userColumns+`
 		FROM users
 		WHERE LOWER(username) = LOWER($1)
 		ORDER BY id
 		LIMIT 1
-	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email,
-		&user.Comment, &user.IsAdmin, &user.IsActive, &user.ProxyType, &user.TwoFAEnabled, &user.CreatedAt, &user.UpdatedAt)
+	`, username).Scan(userScanDest(&user)...)
 
 	if err != nil {
 		return nil, err
@@ -183,10 +301,9 @@ func (d *Database) GetUserByUsernameCtx(ctx context.Context, username string) (*
 func (d *Database) GetUserByID(id int) (*models.User, error) {
 	var user models.User
 	err := d.DB.QueryRow(`
-		SELECT id, username, password_hash, email, comment, is_admin, is_active, proxy_type, twofa_enabled, created_at, updated_at
+		SELECT `+userColumns+`
 		FROM users WHERE id = $1
-	`, id).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Email,
-		&user.Comment, &user.IsAdmin, &user.IsActive, &user.ProxyType, &user.TwoFAEnabled, &user.CreatedAt, &user.UpdatedAt)
+	`, id).Scan(userScanDest(&user)...)
 
 	if err != nil {
 		return nil, err
@@ -194,13 +311,26 @@ func (d *Database) GetUserByID(id int) (*models.User, error) {
 
 	user.Whitelist, _ = d.getProxyList("user_proxy_whitelist", user.ID)
 	user.Blacklist, _ = d.getProxyList("user_proxy_blacklist", user.ID)
+	user.EgressExceptions, _ = d.getProxyList("user_egress_exceptions", user.ID)
+	user.MITMHosts, _ = d.getProxyList("user_mitm_hosts", user.ID)
+	user.ClientAllowlist, _ = d.getProxyList("user_client_allowlist", user.ID)
+	user.WhitelistLists, _ = d.getHostListIDs("user_host_lists", "user_id", user.ID, HostListWhitelist)
+	user.BlacklistLists, _ = d.getHostListIDs("user_host_lists", "user_id", user.ID, HostListBlacklist)
+	user.WhitelistExclusions, _ = d.getProxyList("user_whitelist_exclusions", user.ID)
+	user.BlacklistExclusions, _ = d.getProxyList("user_blacklist_exclusions", user.ID)
+	user.GroupIDs, _ = d.getUserGroupIDs(user.ID)
+	if usage, err := d.GetQuotaUsage(user.ID); err == nil {
+		if quotas, err := d.effectiveQuotas("WHERE u.id = $1", user.ID); err == nil {
+			usage.Exceeded = ExceededQuotas(quotas[user.ID], *usage)
+		}
+		user.QuotaUsage = usage
+	}
 	return &user, nil
 }
 
 func (d *Database) GetAllUsers() ([]models.User, error) {
 	rows, err := d.DB.Query(`
-		SELECT u.id, u.username, u.email, u.comment, u.is_admin, u.is_active,
-		       u.proxy_type, u.twofa_enabled, u.created_at, u.updated_at,
+		SELECT ` + userColumns + `,
 		       COALESCE((
 		       	SELECT ARRAY_AGG(value ORDER BY id)
 		       	FROM user_proxy_whitelist
@@ -210,7 +340,47 @@ func (d *Database) GetAllUsers() ([]models.User, error) {
 		       	SELECT ARRAY_AGG(value ORDER BY id)
 		       	FROM user_proxy_blacklist
 		       	WHERE user_id = u.id
-		       ), ARRAY[]::text[]) AS blacklist
+		       ), ARRAY[]::text[]) AS blacklist,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(value ORDER BY id)
+		       	FROM user_egress_exceptions
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::text[]) AS egress_exceptions,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(value ORDER BY id)
+		       	FROM user_mitm_hosts
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::text[]) AS mitm_hosts,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(value ORDER BY id)
+		       	FROM user_client_allowlist
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::text[]) AS client_allowlist,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(value ORDER BY id)
+		       	FROM user_whitelist_exclusions
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::text[]) AS whitelist_exclusions,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(value ORDER BY id)
+		       	FROM user_blacklist_exclusions
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::text[]) AS blacklist_exclusions,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(list_id ORDER BY list_id)
+		       	FROM user_host_lists
+		       	WHERE user_id = u.id AND kind = 'whitelist'
+		       ), ARRAY[]::int[]) AS whitelist_lists,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(list_id ORDER BY list_id)
+		       	FROM user_host_lists
+		       	WHERE user_id = u.id AND kind = 'blacklist'
+		       ), ARRAY[]::int[]) AS blacklist_lists,
+		       COALESCE((
+		       	SELECT ARRAY_AGG(group_id ORDER BY group_id)
+		       	FROM user_group_members
+		       	WHERE user_id = u.id
+		       ), ARRAY[]::int[]) AS group_ids
 		FROM users u
 		ORDER BY u.created_at DESC
 	`)
@@ -224,20 +394,95 @@ func (d *Database) GetAllUsers() ([]models.User, error) {
 		var user models.User
 		var whitelist []string
 		var blacklist []string
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Comment,
-			&user.IsAdmin, &user.IsActive, &user.ProxyType, &user.TwoFAEnabled,
-			&user.CreatedAt, &user.UpdatedAt, pq.Array(&whitelist), pq.Array(&blacklist))
+		var egressExceptions []string
+		var mitmHosts []string
+		var clientAllowlist []string
+		var whitelistExclusions, blacklistExclusions []string
+		var whitelistLists, blacklistLists, groupIDs pq.Int64Array
+		dest := append(userScanDest(&user), pq.Array(&whitelist), pq.Array(&blacklist), pq.Array(&egressExceptions),
+			pq.Array(&mitmHosts), pq.Array(&clientAllowlist), pq.Array(&whitelistExclusions),
+			pq.Array(&blacklistExclusions), &whitelistLists, &blacklistLists, &groupIDs)
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, err
 		}
 		user.Whitelist = append([]string(nil), whitelist...)
 		user.Blacklist = append([]string(nil), blacklist...)
+		user.EgressExceptions = append([]string(nil), egressExceptions...)
+		user.MITMHosts = append([]string(nil), mitmHosts...)
+		user.ClientAllowlist = append([]string(nil), clientAllowlist...)
+		user.WhitelistExclusions = append([]string(nil), whitelistExclusions...)
+		user.BlacklistExclusions = append([]string(nil), blacklistExclusions...)
+		user.WhitelistLists = intsFromArray(whitelistLists)
+		user.BlacklistLists = intsFromArray(blacklistLists)
+		user.GroupIDs = intsFromArray(groupIDs)
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	usage, err := d.quotaUsageByUser()
+	if err != nil {
+		return nil, err
+	}
+	quotas, err := d.effectiveQuotas("")
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		u := usage[users[i].ID]
+		u.Exceeded = ExceededQuotas(quotas[users[i].ID], u)
+		users[i].QuotaUsage = &u
+	}
 	return users, nil
 }
 
+type userListUpdate struct {
+	table   string
+	entries []string
+	// normalize validates the entries and returns them as stored.
+	normalize func([]string) ([]string, error)
+}
+
+// userListUpdates collects the lists present in update, in the order they
+// are written.
+func userListUpdates(update *models.UserUpdate) []userListUpdate {
+	var lists []userListUpdate
+	if update.Whitelist != nil {
+		lists = append(lists, userListUpdate{"user_proxy_whitelist", *update.Whitelist, sanitizeEntries})
+	}
+	if update.Blacklist != nil {
+		lists = append(lists, userListUpdate{"user_proxy_blacklist", *update.Blacklist, sanitizeEntries})
+	}
+	if update.WhitelistExclusions != nil {
+		lists = append(lists, userListUpdate{"user_whitelist_exclusions", *update.WhitelistExclusions, sanitizeEntries})
+	}
+	if update.BlacklistExclusions != nil {
+		lists = append(lists, userListUpdate{"user_blacklist_exclusions", *update.BlacklistExclusions, sanitizeEntries})
+	}
+	if update.EgressExceptions != nil {
+		lists = append(lists, userListUpdate{"user_egress_exceptions", *update.EgressExceptions, sanitizeEntries})
+	}
+	if update.MITMHosts != nil {
+		lists = append(lists, userListUpdate{"user_mitm_hosts", *update.MITMHosts, sanitizeEntries})
+	}
+	if update.ClientAllowlist != nil {
+		lists = append(lists, userListUpdate{"user_client_allowlist", *update.ClientAllowlist, normalizeClientEntries})
+	}
+	return lists
+}
+
 func (d *Database) UpdateUser(id int, update *models.UserUpdate) error {
+	lists := userListUpdates(update)
+	for i := range lists {
+		normalized, err := lists[i].normalize(lists[i].entries)
+		if err != nil {
+			return err
+		}
+		lists[i].entries = normalized
+	}
+
 	query := "UPDATE users SET "
 	args := []interface{}{}
 	argCount := 1
@@ -262,41 +507,151 @@ func (d *Database) UpdateUser(id int, update *models.UserUpdate) error {
 		args = append(args, *update.IsActive)
 		argCount++
 	}
-	if update.ProxyType != nil {
+	if update.ProxyType.Set {
 		query += fmt.Sprintf("proxy_type = $%d, ", argCount)
-		args = append(args, *update.ProxyType)
+		args = append(args, update.ProxyType.Value)
+		argCount++
+	}
+	if update.UpstreamPool != nil {
+		query += fmt.Sprintf("upstream_pool = $%d, ", argCount)
+		args = append(args, *update.UpstreamPool)
+		argCount++
+	}
+	if update.MITMEnabled != nil {
+		query += fmt.Sprintf("mitm_enabled = $%d, ", argCount)
+		args = append(args, *update.MITMEnabled)
+		argCount++
+	}
+	if update.HTTPCache != nil {
+		query += fmt.Sprintf("http_cache = $%d, ", argCount)
+		args = append(args, *update.HTTPCache)
+		argCount++
+	}
+	if update.EgressAddresses != nil {
+		query += fmt.Sprintf("egress_addresses = $%d, ", argCount)
+		args = append(args, pq.Array(*update.EgressAddresses))
+		argCount++
+	}
+	if update.EgressStrategy != nil {
+		query += fmt.Sprintf("egress_strategy = $%d, ", argCount)
+		args = append(args, *update.EgressStrategy)
 		argCount++
 	}
+	if update.Schedule.Set {
+		scheduleArgs, err := scheduleColumnArgs(update.Schedule.Value)
+		if err != nil {
+			return err
+		}
+		query += fmt.Sprintf("schedule_time_zone = $%d, schedule_windows = $%d, schedule_holidays = $%d, ",
+			argCount, argCount+1, argCount+2)
+		args = append(args, scheduleArgs...)
+		argCount += 3
+	}
+	// A null quota is stored as NULL and inherited from the user's groups.
+	quotas := []struct {
+		column string
+		value  models.Nullable[int64]
+	}{
+		{"quota_daily_bytes", update.QuotaDailyBytes},
+		{"quota_monthly_bytes", update.QuotaMonthlyBytes},
+		{"quota_daily_requests", update.QuotaDailyRequests},
+		{"quota_monthly_requests", update.QuotaMonthlyRequests},
+	}
+	for _, quota := range quotas {
+		if quota.value.Set {
+			query += fmt.Sprintf("%s = $%d, ", quota.column, argCount)
+			args = append(args, quota.value.Value)
+			argCount++
+		}
+	}
+	limits := []struct {
+		column string
+		value  *int64
+	}{
+		{"bandwidth_up", update.BandwidthUp},
+		{"bandwidth_down", update.BandwidthDown},
+		{"bandwidth_burst", update.BandwidthBurst},
+	}
+	for _, limit := range limits {
+		if limit.value != nil {
+			query += fmt.Sprintf("%s = $%d, ", limit.column, argCount)
+			args = append(args, *limit.value)
+			argCount++
+		}
+	}
+	requestLimits := []struct {
+		column string
+		value  *int
+	}{
+		{"max_connections", update.MaxConnections},
+		{"requests_per_second", update.RequestsPerSecond},
+		{"requests_per_minute", update.RequestsPerMinute},
+	}
+	for _, limit := range requestLimits {
+		if limit.value != nil {
+			query += fmt.Sprintf("%s = $%d, ", limit.column, argCount)
+			args = append(args, *limit.value)
+			argCount++
+		}
+	}
 	if update.Password != nil {
 		query += fmt.Sprintf("password_hash = $%d, ", argCount)
 		args = append(args, *update.Password)
 		argCount++
 	}
 
-	if len(args) == 0 {
+	if len(args) == 0 && len(lists) == 0 && update.GroupIDs == nil &&
+		update.WhitelistLists == nil && update.BlacklistLists == nil {
 		return fmt.Errorf("no fields to update")
 	}
 
-	query = query[:len(query)-2]
-	query += fmt.Sprintf(" WHERE id = $%d", argCount)
-	args = append(args, id)
+	// The columns and lists change together or not at all, so that a failed
+	// update never leaves the user half edited.
+	return d.withTx(func(tx *sql.Tx) error {
+		if len(args) > 0 {
+			query = query[:len(query)-2]
+			query += fmt.Sprintf(" WHERE id = $%d", argCount)
+			args = append(args, id)
 
-	_, err := d.DB.Exec(query, args...)
-	if err != nil {
-		return err
-	}
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+		}
 
-	if update.Whitelist != nil {
-		if _, err := d.replaceProxyList("user_proxy_whitelist", id, *update.Whitelist); err != nil {
-			return err
+		for _, list := range lists {
+			if err := replaceListIn(tx, list.table, "user_id", id, list.entries); err != nil {
+				return err
+			}
 		}
-	}
-	if update.Blacklist != nil {
-		if _, err := d.replaceProxyList("user_proxy_blacklist", id, *update.Blacklist); err != nil {
-			return err
+		if update.WhitelistLists != nil {
+			if err := replaceHostListRefsIn(tx, "user_host_lists", "user_id", id, HostListWhitelist, *update.WhitelistLists); err != nil {
+				return err
+			}
 		}
+		if update.BlacklistLists != nil {
+			if err := replaceHostListRefsIn(tx, "user_host_lists", "user_id", id, HostListBlacklist, *update.BlacklistLists); err != nil {
+				return err
+			}
+		}
+		if update.GroupIDs != nil {
+			return replaceMembershipsIn(tx, "user_id", id, "group_id", *update.GroupIDs)
+		}
+		return nil
+	})
+}
+
+// scheduleColumnArgs returns the values of the schedule_time_zone,
+// schedule_windows and schedule_holidays columns for s: all NULL when s is
+// nil, so that the schedule is inherited from the user's groups.
+func scheduleColumnArgs(s *models.Schedule) ([]interface{}, error) {
+	if s == nil {
+		return []interface{}{nil, nil, nil}, nil
 	}
-	return nil
+	accessSchedule, err := schedule.Normalize(*s)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{accessSchedule.TimeZone, pq.Array(accessSchedule.Windows), pq.Array(accessSchedule.Holidays)}, nil
 }
 
 func (d *Database) DeleteUser(id int) error {
@@ -351,13 +706,23 @@ func (d *Database) UpdateProxySetting(key, value string) error {
 }
 
 func (d *Database) LogRequest(log *models.RequestLog) error {
+	createdAt := sql.NullTime{Time: log.CreatedAt, Valid: !log.CreatedAt.IsZero()}
 	_, err := d.DB.Exec(`
-		INSERT INTO request_logs (user_id, method, url, status_code, bytes_sent, bytes_received, duration_ms)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, log.UserID, log.Method, log.URL, log.StatusCode, log.BytesSent, log.BytesReceived, log.DurationMs)
+		INSERT INTO request_logs (user_id, method, url, status_code, bytes_sent, bytes_received, duration_ms, reason,
+			cache_status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), COALESCE($10, CURRENT_TIMESTAMP))
+	`, log.UserID, log.Method, log.URL, log.StatusCode, log.BytesSent, log.BytesReceived, log.DurationMs, log.Reason,
+		log.CacheStatus, createdAt)
 	return err
 }
 
+// IsConstraintError reports whether err is a PostgreSQL integrity
+// constraint violation, as opposed to a connection or server failure.
+func IsConstraintError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code.Class() == "23"
+}
+
 func (d *Database) UpdateTrafficStats(userID int, bytesSent, bytesReceived int64) error {
 	_, err := d.DB.Exec(`
 		INSERT INTO traffic_stats (user_id, bytes_sent, bytes_received, request_count, date)
@@ -371,6 +736,71 @@ func (d *Database) UpdateTrafficStats(userID int, bytesSent, bytesReceived int64
 	return err
 }
 
+// InsertRequestLogs writes a batch of request logs with COPY. Rows are
+// stored with their own CreatedAt.
+func (d *Database) InsertRequestLogs(logs []models.RequestLog) error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("request_logs",
+		"user_id", "method", "url", "status_code", "bytes_sent", "bytes_received", "duration_ms", "reason",
+		"cache_status", "created_at"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range logs {
+		if _, err := stmt.Exec(entry.UserID, entry.Method, entry.URL, entry.StatusCode, entry.BytesSent,
+			entry.BytesReceived, entry.DurationMs, nullIfEmpty(entry.Reason), nullIfEmpty(entry.CacheStatus),
+			entry.CreatedAt); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// AddTrafficStats adds pre-aggregated per-user, per-day deltas to
+// traffic_stats in a single statement.
+func (d *Database) AddTrafficStats(deltas []models.TrafficStats) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(deltas))
+	args := make([]interface{}, 0, len(deltas)*5)
+	for i, delta := range deltas {
+		n := i * 5
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d::date)", n+1, n+2, n+3, n+4, n+5))
+		args = append(args, delta.UserID, delta.BytesSent, delta.BytesReceived, delta.RequestCount, delta.Date.Format("2006-01-02"))
+	}
+	_, err := d.DB.Exec(`
+		INSERT INTO traffic_stats (user_id, bytes_sent, bytes_received, request_count, date)
+		VALUES `+strings.Join(values, ", ")+`
+		ON CONFLICT (user_id, date)
+		DO UPDATE SET
+			bytes_sent = traffic_stats.bytes_sent + EXCLUDED.bytes_sent,
+			bytes_received = traffic_stats.bytes_received + EXCLUDED.bytes_received,
+			request_count = traffic_stats.request_count + EXCLUDED.request_count
+	`, args...)
+	return err
+}
+
 func (d *Database) GetTrafficStats(limit int, startDate, endDate *time.Time) ([]models.TrafficStats, error) {
 	query := `
 		SELECT ts.id, ts.user_id, u.username, ts.bytes_sent, ts.bytes_received,
@@ -426,7 +856,8 @@ func (d *Database) GetTrafficStats(limit int, startDate, endDate *time.Time) ([]
 func (d *Database) GetRequestLogs(filters *models.LogFilterOptions) ([]models.RequestLog, error) {
 	baseQuery := `
 		SELECT rl.id, rl.user_id, COALESCE(u.username, 'unknown'), rl.method, rl.url,
-		       rl.status_code, rl.bytes_sent, rl.bytes_received, rl.duration_ms, rl.created_at
+		       rl.status_code, rl.bytes_sent, rl.bytes_received, rl.duration_ms, COALESCE(rl.reason, ''),
+		       COALESCE(rl.cache_status, ''), rl.created_at
 		FROM request_logs rl
 		LEFT JOIN users u ON rl.user_id = u.id
 	`
@@ -466,6 +897,11 @@ func (d *Database) GetRequestLogs(filters *models.LogFilterOptions) ([]models.Re
 			args = append(args, "%"+filters.URLContains+"%")
 			argPos++
 		}
+		if filters.CacheStatus != "" {
+			where = append(where, fmt.Sprintf("UPPER(rl.cache_status) = UPPER($%d)", argPos))
+			args = append(args, filters.CacheStatus)
+			argPos++
+		}
 		if filters.StatusCode != nil {
 			where = append(where, fmt.Sprintf("rl.status_code = $%d", argPos))
 			args = append(args, *filters.StatusCode)
@@ -549,7 +985,7 @@ func (d *Database) GetRequestLogs(filters *models.LogFilterOptions) ([]models.Re
 	for rows.Next() {
 		var log models.RequestLog
 		err := rows.Scan(&log.ID, &log.UserID, &log.Username, &log.Method, &log.URL,
-			&log.StatusCode, &log.BytesSent, &log.BytesReceived, &log.DurationMs, &log.CreatedAt)
+			&log.StatusCode, &log.BytesSent, &log.BytesReceived, &log.DurationMs, &log.Reason, &log.CacheStatus, &log.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -594,6 +1030,7 @@ func (d *Database) ensureProxySchema() error {
 		`ALTER TABLE users ADD COLUMN IF NOT EXISTS proxy_type VARCHAR(20) NOT NULL DEFAULT 'default'`,
 		`ALTER TABLE users ADD COLUMN IF NOT EXISTS twofa_secret TEXT`,
 		`ALTER TABLE users ADD COLUMN IF NOT EXISTS twofa_enabled BOOLEAN NOT NULL DEFAULT false`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS upstream_pool VARCHAR(255) NOT NULL DEFAULT ''`,
 		`CREATE TABLE IF NOT EXISTS user_proxy_whitelist (
 			id SERIAL PRIMARY KEY,
 			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
@@ -634,6 +1071,207 @@ func (d *Database) ensureProxySchema() error {
 			message TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`,
+		`CREATE TABLE IF NOT EXISTS upstream_proxies (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			type VARCHAR(10) NOT NULL DEFAULT 'http',
+			address TEXT NOT NULL,
+			username TEXT,
+			password TEXT,
+			pool VARCHAR(255) NOT NULL,
+			priority INTEGER DEFAULT 0,
+			is_active BOOLEAN DEFAULT TRUE,
+			healthy BOOLEAN DEFAULT TRUE,
+			last_checked_at TIMESTAMP NULL,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS upstream_rules (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			pattern TEXT NOT NULL,
+			pool VARCHAR(255) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_upstream_proxies_pool ON upstream_proxies(pool)`,
+		`CREATE INDEX IF NOT EXISTS idx_upstream_rules_user ON upstream_rules(user_id)`,
+		`ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS reason TEXT`,
+		`CREATE TABLE IF NOT EXISTS user_egress_exceptions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, value)
+		)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_daily_bytes BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_monthly_bytes BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_daily_requests BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_monthly_requests BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS bandwidth_up BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS bandwidth_down BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS bandwidth_burst BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS max_connections INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS requests_per_second INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS requests_per_minute INTEGER NOT NULL DEFAULT 0`,
+		`INSERT INTO proxy_settings (key, value, description) VALUES
+			('block_private_destinations', 'true', 'Block proxying to private, loopback and reserved addresses')
+			ON CONFLICT (key) DO NOTHING`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS mitm_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE TABLE IF NOT EXISTS user_mitm_hosts (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, value)
+		)`,
+		`CREATE TABLE IF NOT EXISTS mitm_ca (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			cert_pem TEXT NOT NULL,
+			key_encrypted TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`INSERT INTO proxy_settings (key, value, description) VALUES
+			('mitm_enabled', 'false', 'Allow TLS interception for users and destinations that opt in'),
+			('mitm_bypass', '', 'Comma-separated hosts never intercepted (e.g. certificate-pinned services)')
+			ON CONFLICT (key) DO NOTHING`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS http_cache BOOLEAN NOT NULL DEFAULT TRUE`,
+		`ALTER TABLE request_logs ADD COLUMN IF NOT EXISTS cache_status TEXT`,
+		`INSERT INTO proxy_settings (key, value, description) VALUES
+			('http_cache_enabled', 'false', 'Cache plain HTTP responses shared between users'),
+			('http_cache_max_mb', '1024', 'Maximum size of the HTTP response cache on disk in MB')
+			ON CONFLICT (key) DO NOTHING`,
+		`INSERT INTO proxy_settings (key, value, description) VALUES
+			('transport_dial_timeout_seconds', '10', 'Timeout for connecting to destinations of plain HTTP requests'),
+			('transport_tls_timeout_seconds', '10', 'TLS handshake timeout for forwarded https:// requests'),
+			('transport_idle_timeout_seconds', '90', 'How long idle upstream connections are kept for reuse'),
+			('transport_max_idle_per_host', '16', 'Idle upstream connections kept per destination'),
+			('transport_max_conns_per_host', '0', 'Maximum upstream connections per destination (0 = unlimited)'),
+			('transport_http2', 'true', 'Use HTTP/2 to destinations that support it')
+			ON CONFLICT (key) DO NOTHING`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS egress_addresses TEXT[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS egress_strategy VARCHAR(20) NOT NULL DEFAULT 'round_robin'`,
+		`CREATE TABLE IF NOT EXISTS proxy_tokens (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			hint VARCHAR(32) NOT NULL,
+			expires_at TIMESTAMP,
+			last_used_at TIMESTAMP,
+			last_used_ip VARCHAR(45),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_proxy_tokens_user ON proxy_tokens(user_id)`,
+		`CREATE TABLE IF NOT EXISTS auth_bans (
+			id SERIAL PRIMARY KEY,
+			kind VARCHAR(20) NOT NULL,
+			value TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			failures INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			UNIQUE(kind, value)
+		)`,
+		`INSERT INTO proxy_settings (key, value, description) VALUES
+			('auth_max_failures', '10', 'Failed logins per source IP within the window before a temporary ban (0 = never ban)'),
+			('auth_failure_window_seconds', '900', 'Window in which failed logins are counted'),
+			('auth_ban_minutes', '30', 'How long a banned username or source IP is refused'),
+			('auth_delay_after', '3', 'Failed logins after which failures are answered with growing delays (0 = no delay)')
+			ON CONFLICT (key) DO NOTHING`,
+		`CREATE TABLE IF NOT EXISTS user_client_allowlist (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, value)
+		)`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS schedule_time_zone VARCHAR(64) NOT NULL DEFAULT ''`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS schedule_windows TEXT[] NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS schedule_holidays TEXT[] NOT NULL DEFAULT '{}'`,
+		`CREATE TABLE IF NOT EXISTS user_groups (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			priority INTEGER NOT NULL DEFAULT 0,
+			proxy_type VARCHAR(20) NOT NULL DEFAULT 'default',
+			quota_daily_bytes BIGINT NOT NULL DEFAULT 0,
+			quota_monthly_bytes BIGINT NOT NULL DEFAULT 0,
+			quota_daily_requests BIGINT NOT NULL DEFAULT 0,
+			quota_monthly_requests BIGINT NOT NULL DEFAULT 0,
+			schedule_time_zone VARCHAR(64) NOT NULL DEFAULT '',
+			schedule_windows TEXT[] NOT NULL DEFAULT '{}',
+			schedule_holidays TEXT[] NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_group_members (
+			group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_group_members_user ON user_group_members(user_id)`,
+		`CREATE TABLE IF NOT EXISTS group_proxy_whitelist (
+			id SERIAL PRIMARY KEY,
+			group_id INTEGER REFERENCES user_groups(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(group_id, value)
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_proxy_blacklist (
+			id SERIAL PRIMARY KEY,
+			group_id INTEGER REFERENCES user_groups(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(group_id, value)
+		)`,
+		`CREATE TABLE IF NOT EXISTS host_lists (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(255) UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			format VARCHAR(20) NOT NULL DEFAULT 'auto',
+			refresh_minutes INTEGER NOT NULL DEFAULT 0,
+			revision INTEGER NOT NULL DEFAULT 0,
+			entry_count INTEGER NOT NULL DEFAULT 0,
+			skipped_count INTEGER NOT NULL DEFAULT 0,
+			checksum VARCHAR(64) NOT NULL DEFAULT '',
+			last_refreshed_at TIMESTAMP,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS host_list_entries (
+			list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+			value TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_host_list_entries_list ON host_list_entries(list_id)`,
+		`CREATE TABLE IF NOT EXISTS user_host_lists (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+			kind VARCHAR(20) NOT NULL,
+			PRIMARY KEY (user_id, kind, list_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_host_lists (
+			group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+			list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+			kind VARCHAR(20) NOT NULL,
+			PRIMARY KEY (group_id, kind, list_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_whitelist_exclusions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, value)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_blacklist_exclusions (
+			id SERIAL PRIMARY KEY,
+			user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+			value TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(user_id, value)
+		)`,
 	}
 
 	for _, stmt := range statements {
@@ -647,9 +1285,141 @@ func (d *Database) ensureProxySchema() error {
 	if _, err := d.DB.Exec(`CREATE INDEX IF NOT EXISTS idx_twofa_logs_ip ON twofa_logs(ip_address, created_at)`); err != nil {
 		return err
 	}
+	if err := d.migrateProxyListSyntax(); err != nil {
+		return err
+	}
+	return d.migrateUserOverrides()
+}
+
+// migrateUserOverrides makes the user settings groups can provide
+// nullable. Before, "default", zero and a schedule without windows meant
+// "inherit"; those values become NULL so that a user can now set them
+// explicitly. It is a no-op once the columns are nullable.
+func (d *Database) migrateUserOverrides() error {
+	var nullable string
+	err := d.DB.QueryRow(`
+		SELECT is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'quota_daily_bytes'
+	`).Scan(&nullable)
+	if err != nil {
+		return err
+	}
+	if nullable == "YES" {
+		return nil
+	}
+
+	return d.withTx(func(tx *sql.Tx) error {
+		statements := []string{
+			`ALTER TABLE users
+				ALTER COLUMN proxy_type DROP NOT NULL, ALTER COLUMN proxy_type DROP DEFAULT,
+				ALTER COLUMN quota_daily_bytes DROP NOT NULL, ALTER COLUMN quota_daily_bytes DROP DEFAULT,
+				ALTER COLUMN quota_monthly_bytes DROP NOT NULL, ALTER COLUMN quota_monthly_bytes DROP DEFAULT,
+				ALTER COLUMN quota_daily_requests DROP NOT NULL, ALTER COLUMN quota_daily_requests DROP DEFAULT,
+				ALTER COLUMN quota_monthly_requests DROP NOT NULL, ALTER COLUMN quota_monthly_requests DROP DEFAULT,
+				ALTER COLUMN schedule_time_zone DROP NOT NULL, ALTER COLUMN schedule_time_zone DROP DEFAULT,
+				ALTER COLUMN schedule_windows DROP NOT NULL, ALTER COLUMN schedule_windows DROP DEFAULT,
+				ALTER COLUMN schedule_holidays DROP NOT NULL, ALTER COLUMN schedule_holidays DROP DEFAULT`,
+			`UPDATE users SET proxy_type = NULL WHERE proxy_type = '' OR proxy_type = 'default'`,
+			`UPDATE users SET quota_daily_bytes = NULLIF(quota_daily_bytes, 0),
+				quota_monthly_bytes = NULLIF(quota_monthly_bytes, 0),
+				quota_daily_requests = NULLIF(quota_daily_requests, 0),
+				quota_monthly_requests = NULLIF(quota_monthly_requests, 0)`,
+			`UPDATE users SET schedule_time_zone = NULL, schedule_windows = NULL, schedule_holidays = NULL
+				WHERE cardinality(schedule_windows) = 0`,
+		}
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// proxyListSyntaxVersion marks list rows written in the rules package
+// syntax. Version 1 rows were matched as substrings.
+const proxyListSyntaxVersion = 2
+
+// migrateProxyListSyntax rewrites version 1 list entries using
+// rules.MigrateLegacy. It runs at startup and is a no-op once every row has
+// been converted.
+func (d *Database) migrateProxyListSyntax() error {
+	for _, table := range []string{"user_proxy_whitelist", "user_proxy_blacklist"} {
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS rule_version INTEGER NOT NULL DEFAULT 1", table),
+			fmt.Sprintf("ALTER TABLE %s ALTER COLUMN rule_version SET DEFAULT %d", table, proxyListSyntaxVersion),
+		}
+		for _, stmt := range statements {
+			if _, err := d.DB.Exec(stmt); err != nil {
+				return err
+			}
+		}
+
+		if err := d.migrateProxyListTable(table); err != nil {
+			return fmt.Errorf("migrate %s: %w", table, err)
+		}
+	}
 	return nil
 }
 
+func (d *Database) migrateProxyListTable(table string) error {
+	rows, err := d.DB.Query(fmt.Sprintf("SELECT id, user_id, value FROM %s WHERE rule_version < $1 ORDER BY id", table), proxyListSyntaxVersion)
+	if err != nil {
+		return err
+	}
+	type legacyEntry struct {
+		id     int
+		userID int
+		value  string
+	}
+	var legacy []legacyEntry
+	for rows.Next() {
+		var entry legacyEntry
+		if err := rows.Scan(&entry.id, &entry.userID, &entry.value); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, entry)
+	}
+	rows.Close()
+	if len(legacy) == 0 {
+		return nil
+	}
+
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, entry := range legacy {
+		converted := rules.MigrateLegacy(entry.value)
+
+		var duplicate bool
+		err := tx.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE user_id = $1 AND value = $2 AND id <> $3)", table),
+			entry.userID, converted, entry.id).Scan(&duplicate)
+		if err != nil {
+			return err
+		}
+
+		if converted == "" || duplicate {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = $1", table), entry.id)
+		} else {
+			_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET value = $1, rule_version = $2 WHERE id = $3", table),
+				converted, proxyListSyntaxVersion, entry.id)
+		}
+		if err != nil {
+			return err
+		}
+		if converted != entry.value {
+			log.Printf("Migrated %s entry for user %d: %q -> %q", table, entry.userID, entry.value, converted)
+		}
+	}
+
+	return tx.Commit()
+}
+
 func (d *Database) GetLogRetentionDays() (int, error) {
 	var value string
 	err := d.DB.QueryRow("SELECT value FROM proxy_settings WHERE key = $1", "log_retention_days").Scan(&value)
@@ -690,53 +1460,169 @@ func (d *Database) DeleteRequestLogsOlderThan(days int) (int64, error) {
 	return rows, nil
 }
 
-func sanitizeEntries(entries []string) []string {
+// ErrInvalidProxyEntry wraps validation failures for whitelist, blacklist,
+// routing and client allowlist entries so handlers can report them as bad
+// requests.
+var ErrInvalidProxyEntry = errors.New("invalid proxy list entry")
+
+func sanitizeEntries(entries []string) ([]string, error) {
 	seen := make(map[string]struct{})
 	var result []string
 	for _, entry := range entries {
-		normalized := strings.ToLower(strings.TrimSpace(entry))
-		if normalized == "" {
+		if strings.TrimSpace(entry) == "" {
 			continue
 		}
+		normalized, err := rules.Normalize(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", ErrInvalidProxyEntry, strings.TrimSpace(entry), err)
+		}
 		if _, exists := seen[normalized]; exists {
 			continue
 		}
 		seen[normalized] = struct{}{}
 		result = append(result, normalized)
 	}
-	return result
+	return result, nil
 }
 
-func (d *Database) replaceProxyList(table string, userID int, entries []string) ([]string, error) {
-	sanitized := sanitizeEntries(entries)
+// ValidateProxyEntries checks entries against the rule syntax without
+// touching the database.
+func ValidateProxyEntries(entries []string) error {
+	_, err := sanitizeEntries(entries)
+	return err
+}
 
-	tx, err := d.DB.Begin()
+// Egress strategies choose among a user's source addresses for each new
+// outgoing connection.
+const (
+	EgressStrategyRoundRobin = "round_robin"
+	EgressStrategyRandom     = "random"
+	EgressStrategySticky     = "sticky"
+)
+
+// ValidEgressStrategy reports whether strategy is one of the known
+// rotation strategies.
+func ValidEgressStrategy(strategy string) bool {
+	switch strategy {
+	case EgressStrategyRoundRobin, EgressStrategyRandom, EgressStrategySticky:
+		return true
+	}
+	return false
+}
+
+// NormalizeEgressAddresses parses source addresses for outgoing
+// connections, returning them in canonical form without duplicates.
+func NormalizeEgressAddresses(entries []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	result := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+			return nil, fmt.Errorf("invalid egress address %q", entry)
+		}
+		normalized := ip.String()
+		if _, exists := seen[normalized]; exists {
+			continue
+		}
+		seen[normalized] = struct{}{}
+		result = append(result, normalized)
+	}
+	return result, nil
+}
+
+// NormalizeClientAddresses parses the client addresses a user may connect
+// from: single IPs or CIDR ranges. Ranges are returned as their network
+// address, single IPs in canonical form, without duplicates.
+func NormalizeClientAddresses(entries []string) ([]string, error) {
+	seen := make(map[string]struct{})
+	result := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var normalized string
+		if strings.Contains(entry, "/") {
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client address %q", entry)
+			}
+			normalized = network.String()
+		} else {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid client address %q", entry)
+			}
+			normalized = ip.String()
+		}
+		if _, exists := seen[normalized]; exists {
+			continue
+		}
+		seen[normalized] = struct{}{}
+		result = append(result, normalized)
+	}
+	return result, nil
+}
+
+// normalizeClientEntries is NormalizeClientAddresses reporting failures as
+// ErrInvalidProxyEntry.
+func normalizeClientEntries(entries []string) ([]string, error) {
+	normalized, err := NormalizeClientAddresses(entries)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyEntry, err)
 	}
-	defer tx.Rollback()
+	return normalized, nil
+}
 
-	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = $1", table), userID); err != nil {
-		return nil, err
+// replaceList stores values as the list in table that belongs to the row
+// ownerColumn refers to.
+func (d *Database) replaceList(table, ownerColumn string, ownerID int, values []string) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return replaceListIn(tx, table, ownerColumn, ownerID, values)
+	})
+}
+
+func replaceListIn(tx *sql.Tx, table, ownerColumn string, ownerID int, values []string) error {
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = $1", table, ownerColumn), ownerID); err != nil {
+		return err
 	}
 
-	if len(sanitized) > 0 {
-		insertStmt := fmt.Sprintf("INSERT INTO %s (user_id, value) VALUES ($1, $2)", table)
-		for _, value := range sanitized {
-			if _, err := tx.Exec(insertStmt, userID, value); err != nil {
-				return nil, err
+	if len(values) > 0 {
+		insertStmt := fmt.Sprintf("INSERT INTO %s (%s, value) VALUES ($1, $2)", table, ownerColumn)
+		for _, value := range values {
+			if _, err := tx.Exec(insertStmt, ownerID, value); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return nil, err
+// withTx runs fn in a transaction that is committed if fn succeeds and
+// rolled back otherwise.
+func (d *Database) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
 	}
-	return sanitized, nil
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (d *Database) getProxyList(table string, userID int) ([]string, error) {
-	rows, err := d.DB.Query(fmt.Sprintf("SELECT value FROM %s WHERE user_id = $1 ORDER BY id", table), userID)
+	return d.getList(table, "user_id", userID)
+}
+
+func (d *Database) getList(table, ownerColumn string, ownerID int) ([]string, error) {
+	rows, err := d.DB.Query(fmt.Sprintf("SELECT value FROM %s WHERE %s = $1 ORDER BY id", table, ownerColumn), ownerID)
 	if err != nil {
 		return nil, err
 	}
@@ -753,35 +1639,84 @@ func (d *Database) getProxyList(table string, userID int) ([]string, error) {
 	return values, nil
 }
 
-func (d *Database) SetUserProxyLists(userID int, whitelist, blacklist []string) (wl []string, bl []string, err error) {
-	if wl, err = d.replaceProxyList("user_proxy_whitelist", userID, whitelist); err != nil {
-		return nil, nil, err
-	}
-	if bl, err = d.replaceProxyList("user_proxy_blacklist", userID, blacklist); err != nil {
-		return nil, nil, err
-	}
-	return wl, bl, nil
-}
-
 func (d *Database) GetUserProxySettings(userID int) (*models.UserProxySettings, error) {
 	settings := &models.UserProxySettings{}
-	err := d.DB.QueryRow("SELECT proxy_type FROM users WHERE id = $1", userID).Scan(&settings.ProxyType)
+	var own userOverrides
+	err := d.DB.QueryRow(`
+		SELECT proxy_type, upstream_pool, quota_daily_bytes, quota_monthly_bytes,
+		       quota_daily_requests, quota_monthly_requests, bandwidth_up, bandwidth_down, bandwidth_burst,
+		       max_connections, requests_per_second, requests_per_minute, mitm_enabled, http_cache,
+		       egress_addresses, egress_strategy, `+userScheduleColumn+`
+		FROM users WHERE id = $1
+	`, userID).Scan(&own.ProxyType, &settings.UpstreamPool,
+		&own.QuotaDailyBytes, &own.QuotaMonthlyBytes, &own.QuotaDailyRequests, &own.QuotaMonthlyRequests,
+		&settings.Bandwidth.BandwidthUp, &settings.Bandwidth.BandwidthDown, &settings.Bandwidth.BandwidthBurst,
+		&settings.Limits.MaxConnections, &settings.Limits.RequestsPerSecond, &settings.Limits.RequestsPerMinute,
+		&settings.MITMEnabled, &settings.HTTPCache, pq.Array(&settings.EgressAddresses), &settings.EgressStrategy,
+		scheduleScanner{&own.Schedule})
 	if err != nil {
 		return nil, err
 	}
 
-	var errWL, errBL error
+	var errWL, errBL, errEX, errMH, errCA, errWX, errBX error
 	settings.Whitelist, errWL = d.getProxyList("user_proxy_whitelist", userID)
 	settings.Blacklist, errBL = d.getProxyList("user_proxy_blacklist", userID)
-	if errWL != nil {
-		return nil, errWL
+	settings.EgressExceptions, errEX = d.getProxyList("user_egress_exceptions", userID)
+	settings.MITMHosts, errMH = d.getProxyList("user_mitm_hosts", userID)
+	settings.ClientAllowlist, errCA = d.getProxyList("user_client_allowlist", userID)
+	own.WhitelistExclusions, errWX = d.getProxyList("user_whitelist_exclusions", userID)
+	own.BlacklistExclusions, errBX = d.getProxyList("user_blacklist_exclusions", userID)
+	for _, err := range []error{errWL, errBL, errEX, errMH, errCA, errWX, errBX} {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups, err := d.getUserGroups(userID)
+	if err != nil {
+		return nil, err
+	}
+	applyGroupPolicies(settings, own, groups)
+
+	if settings.WhitelistLists, err = d.getEffectiveHostLists(userID, HostListWhitelist); err != nil {
+		return nil, err
+	}
+	if settings.BlacklistLists, err = d.getEffectiveHostLists(userID, HostListBlacklist); err != nil {
+		return nil, err
 	}
-	if errBL != nil {
-		return nil, errBL
+
+	settings.UpstreamRules, err = d.GetUpstreamRules(&userID)
+	if err != nil {
+		return nil, err
 	}
 	return settings, nil
 }
 
+// GetBandwidthLimits returns the bandwidth limits of every user that has
+// one configured.
+func (d *Database) GetBandwidthLimits() (map[int]models.BandwidthLimit, error) {
+	rows, err := d.DB.Query(`
+		SELECT id, bandwidth_up, bandwidth_down, bandwidth_burst
+		FROM users
+		WHERE bandwidth_up > 0 OR bandwidth_down > 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := make(map[int]models.BandwidthLimit)
+	for rows.Next() {
+		var id int
+		var limit models.BandwidthLimit
+		if err := rows.Scan(&id, &limit.BandwidthUp, &limit.BandwidthDown, &limit.BandwidthBurst); err != nil {
+			return nil, err
+		}
+		limits[id] = limit
+	}
+	return limits, rows.Err()
+}
+
 func (d *Database) LogAdminAction(userID *int, action, details, ip string) {
 	var dbUserID sql.NullInt64
 	if userID != nil {
@@ -0,0 +1,444 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"proxy-server/models"
+	"proxy-server/schedule"
+)
+
+const groupColumns = `id, name, description, priority, proxy_type, quota_daily_bytes, quota_monthly_bytes,
+		quota_daily_requests, quota_monthly_requests, schedule_time_zone, schedule_windows, schedule_holidays,
+		created_at, updated_at`
+
+func scanGroup(row rowScanner) (*models.Group, error) {
+	var group models.Group
+	err := row.Scan(&group.ID, &group.Name, &group.Description, &group.Priority, &group.ProxyType,
+		&group.QuotaDailyBytes, &group.QuotaMonthlyBytes, &group.QuotaDailyRequests, &group.QuotaMonthlyRequests,
+		&group.Schedule.TimeZone, pq.Array(&group.Schedule.Windows), pq.Array(&group.Schedule.Holidays),
+		&group.CreatedAt, &group.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// loadGroupLists fills in the lists and members of group.
+func (d *Database) loadGroupLists(group *models.Group) error {
+	var err error
+	if group.Whitelist, err = d.getList("group_proxy_whitelist", "group_id", group.ID); err != nil {
+		return err
+	}
+	if group.Blacklist, err = d.getList("group_proxy_blacklist", "group_id", group.ID); err != nil {
+		return err
+	}
+	if group.WhitelistLists, err = d.getHostListIDs("group_host_lists", "group_id", group.ID, HostListWhitelist); err != nil {
+		return err
+	}
+	if group.BlacklistLists, err = d.getHostListIDs("group_host_lists", "group_id", group.ID, HostListBlacklist); err != nil {
+		return err
+	}
+	group.MemberIDs, err = d.intList("SELECT user_id FROM user_group_members WHERE group_id = $1 ORDER BY user_id", group.ID)
+	return err
+}
+
+// queryGroups runs a query selecting groupColumns and loads each group's
+// lists and members.
+func (d *Database) queryGroups(query string, args ...interface{}) ([]models.Group, error) {
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	groups := []models.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, *group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		if err := d.loadGroupLists(&groups[i]); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// GetGroups returns every group in precedence order: highest priority
+// first.
+func (d *Database) GetGroups() ([]models.Group, error) {
+	return d.queryGroups(`
+		SELECT ` + groupColumns + `
+		FROM user_groups
+		ORDER BY priority DESC, id
+	`)
+}
+
+func (d *Database) GetGroup(id int) (*models.Group, error) {
+	group, err := scanGroup(d.DB.QueryRow(`
+		SELECT `+groupColumns+`
+		FROM user_groups
+		WHERE id = $1
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.loadGroupLists(group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// getUserGroups returns the groups a user belongs to in precedence order.
+func (d *Database) getUserGroups(userID int) ([]models.Group, error) {
+	return d.queryGroups(`
+		SELECT `+groupColumns+`
+		FROM user_groups
+		WHERE id IN (SELECT group_id FROM user_group_members WHERE user_id = $1)
+		ORDER BY priority DESC, id
+	`, userID)
+}
+
+func (d *Database) CreateGroup(create *models.GroupCreate) (*models.Group, error) {
+	whitelist, err := sanitizeEntries(create.Whitelist)
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err := sanitizeEntries(create.Blacklist)
+	if err != nil {
+		return nil, err
+	}
+	accessSchedule, err := schedule.Normalize(create.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := scanGroup(d.DB.QueryRow(`
+		INSERT INTO user_groups (name, description, priority, proxy_type, quota_daily_bytes, quota_monthly_bytes,
+			quota_daily_requests, quota_monthly_requests, schedule_time_zone, schedule_windows, schedule_holidays)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING `+groupColumns,
+		create.Name, create.Description, create.Priority, create.ProxyType, create.QuotaDailyBytes,
+		create.QuotaMonthlyBytes, create.QuotaDailyRequests, create.QuotaMonthlyRequests, accessSchedule.TimeZone,
+		pq.Array(accessSchedule.Windows), pq.Array(accessSchedule.Holidays)))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.replaceList("group_proxy_whitelist", "group_id", group.ID, whitelist); err != nil {
+		return nil, err
+	}
+	if err := d.replaceList("group_proxy_blacklist", "group_id", group.ID, blacklist); err != nil {
+		return nil, err
+	}
+	if err := d.SetGroupHostLists(group.ID, HostListWhitelist, create.WhitelistLists); err != nil {
+		return nil, err
+	}
+	if err := d.SetGroupHostLists(group.ID, HostListBlacklist, create.BlacklistLists); err != nil {
+		return nil, err
+	}
+	if err := d.SetGroupMembers(group.ID, create.MemberIDs); err != nil {
+		return nil, err
+	}
+	return d.GetGroup(group.ID)
+}
+
+func (d *Database) UpdateGroup(id int, update *models.GroupUpdate) error {
+	type listUpdate struct {
+		table   string
+		entries []string
+	}
+	var lists []listUpdate
+	if update.Whitelist != nil {
+		lists = append(lists, listUpdate{"group_proxy_whitelist", *update.Whitelist})
+	}
+	if update.Blacklist != nil {
+		lists = append(lists, listUpdate{"group_proxy_blacklist", *update.Blacklist})
+	}
+	for i := range lists {
+		sanitized, err := sanitizeEntries(lists[i].entries)
+		if err != nil {
+			return err
+		}
+		lists[i].entries = sanitized
+	}
+
+	query := "UPDATE user_groups SET "
+	args := []interface{}{}
+	argCount := 1
+
+	add := func(column string, value interface{}) {
+		query += fmt.Sprintf("%s = $%d, ", column, argCount)
+		args = append(args, value)
+		argCount++
+	}
+
+	if update.Name != nil {
+		add("name", *update.Name)
+	}
+	if update.Description != nil {
+		add("description", *update.Description)
+	}
+	if update.Priority != nil {
+		add("priority", *update.Priority)
+	}
+	if update.ProxyType != nil {
+		add("proxy_type", *update.ProxyType)
+	}
+	if update.Schedule != nil {
+		accessSchedule, err := schedule.Normalize(*update.Schedule)
+		if err != nil {
+			return err
+		}
+		add("schedule_time_zone", accessSchedule.TimeZone)
+		add("schedule_windows", pq.Array(accessSchedule.Windows))
+		add("schedule_holidays", pq.Array(accessSchedule.Holidays))
+	}
+	limits := []struct {
+		column string
+		value  *int64
+	}{
+		{"quota_daily_bytes", update.QuotaDailyBytes},
+		{"quota_monthly_bytes", update.QuotaMonthlyBytes},
+		{"quota_daily_requests", update.QuotaDailyRequests},
+		{"quota_monthly_requests", update.QuotaMonthlyRequests},
+	}
+	for _, limit := range limits {
+		if limit.value != nil {
+			add(limit.column, *limit.value)
+		}
+	}
+
+	if len(args) == 0 && len(lists) == 0 && update.MemberIDs == nil &&
+		update.WhitelistLists == nil && update.BlacklistLists == nil {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query += fmt.Sprintf("updated_at = CURRENT_TIMESTAMP WHERE id = $%d", argCount)
+	args = append(args, id)
+	if _, err := d.DB.Exec(query, args...); err != nil {
+		return err
+	}
+
+	for _, list := range lists {
+		if err := d.replaceList(list.table, "group_id", id, list.entries); err != nil {
+			return err
+		}
+	}
+	if update.WhitelistLists != nil {
+		if err := d.SetGroupHostLists(id, HostListWhitelist, *update.WhitelistLists); err != nil {
+			return err
+		}
+	}
+	if update.BlacklistLists != nil {
+		if err := d.SetGroupHostLists(id, HostListBlacklist, *update.BlacklistLists); err != nil {
+			return err
+		}
+	}
+	if update.MemberIDs != nil {
+		return d.SetGroupMembers(id, *update.MemberIDs)
+	}
+	return nil
+}
+
+func (d *Database) DeleteGroup(id int) error {
+	_, err := d.DB.Exec("DELETE FROM user_groups WHERE id = $1", id)
+	return err
+}
+
+// SetGroupMembers replaces the members of a group.
+func (d *Database) SetGroupMembers(groupID int, userIDs []int) error {
+	return d.replaceMemberships("group_id", groupID, "user_id", userIDs)
+}
+
+func (d *Database) getUserGroupIDs(userID int) ([]int, error) {
+	return d.intList("SELECT group_id FROM user_group_members WHERE user_id = $1 ORDER BY group_id", userID)
+}
+
+// replaceMemberships rewrites the user_group_members rows of one side of
+// the relation.
+func (d *Database) replaceMemberships(ownerColumn string, ownerID int, otherColumn string, otherIDs []int) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return replaceMembershipsIn(tx, ownerColumn, ownerID, otherColumn, otherIDs)
+	})
+}
+
+func replaceMembershipsIn(tx *sql.Tx, ownerColumn string, ownerID int, otherColumn string, otherIDs []int) error {
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM user_group_members WHERE %s = $1", ownerColumn), ownerID); err != nil {
+		return err
+	}
+	insertStmt := fmt.Sprintf("INSERT INTO user_group_members (%s, %s) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		ownerColumn, otherColumn)
+	for _, otherID := range otherIDs {
+		if _, err := tx.Exec(insertStmt, ownerID, otherID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MissingUserIDs returns those of ids that are not users.
+func (d *Database) MissingUserIDs(ids []int) ([]int, error) {
+	return d.missingIDs("users", ids)
+}
+
+// MissingGroupIDs returns those of ids that are not groups.
+func (d *Database) MissingGroupIDs(ids []int) ([]int, error) {
+	return d.missingIDs("user_groups", ids)
+}
+
+func (d *Database) missingIDs(table string, ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	wanted := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		wanted[i] = int64(id)
+	}
+	existing, err := d.intList(fmt.Sprintf("SELECT id FROM %s WHERE id = ANY($1)", table), wanted)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int]struct{}, len(existing))
+	for _, id := range existing {
+		found[id] = struct{}{}
+	}
+	var missing []int
+	for _, id := range ids {
+		if _, ok := found[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+func intsFromArray(values pq.Int64Array) []int {
+	ints := make([]int, len(values))
+	for i, v := range values {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+func (d *Database) intList(query string, args ...interface{}) ([]int, error) {
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []int{}
+	for rows.Next() {
+		var value int
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// userOverrides are the settings a user may leave to their groups. Nil
+// values are inherited.
+type userOverrides struct {
+	ProxyType *string
+	Schedule  *models.Schedule
+	models.QuotaOverride
+	models.GroupExclusions
+}
+
+// applyGroupPolicies merges the policies of a user's groups, given highest
+// priority first, into the user's own settings: lists are combined, less
+// the entries the user excludes, and the proxy type, each quota and the
+// schedule come from the user when set there, even to "default" or zero,
+// and otherwise from the first group that sets them.
+func applyGroupPolicies(settings *models.UserProxySettings, own userOverrides, groups []models.Group) {
+	settings.ProxyType = "default"
+	if own.ProxyType != nil {
+		settings.ProxyType = *own.ProxyType
+	} else {
+		for _, group := range groups {
+			if group.ProxyType != "" && group.ProxyType != "default" {
+				settings.ProxyType = group.ProxyType
+				break
+			}
+		}
+	}
+
+	settings.Schedule = models.Schedule{}
+	if own.Schedule != nil {
+		settings.Schedule = *own.Schedule
+	} else {
+		for _, group := range groups {
+			if len(group.Schedule.Windows) > 0 {
+				settings.Schedule = group.Schedule
+				break
+			}
+		}
+	}
+
+	inherit := func(own *int64, limit func(models.Group) int64) int64 {
+		if own != nil {
+			return *own
+		}
+		for _, group := range groups {
+			if value := limit(group); value > 0 {
+				return value
+			}
+		}
+		return 0
+	}
+	settings.Quota.QuotaDailyBytes = inherit(own.QuotaDailyBytes,
+		func(g models.Group) int64 { return g.QuotaDailyBytes })
+	settings.Quota.QuotaMonthlyBytes = inherit(own.QuotaMonthlyBytes,
+		func(g models.Group) int64 { return g.QuotaMonthlyBytes })
+	settings.Quota.QuotaDailyRequests = inherit(own.QuotaDailyRequests,
+		func(g models.Group) int64 { return g.QuotaDailyRequests })
+	settings.Quota.QuotaMonthlyRequests = inherit(own.QuotaMonthlyRequests,
+		func(g models.Group) int64 { return g.QuotaMonthlyRequests })
+
+	for _, group := range groups {
+		settings.Whitelist = appendMissing(settings.Whitelist, group.Whitelist, own.WhitelistExclusions)
+		settings.Blacklist = appendMissing(settings.Blacklist, group.Blacklist, own.BlacklistExclusions)
+	}
+}
+
+// appendMissing adds the entries not yet in list, nor in excluded.
+func appendMissing(list, entries, excluded []string) []string {
+	seen := make(map[string]struct{}, len(list)+len(excluded))
+	for _, entry := range list {
+		seen[entry] = struct{}{}
+	}
+	for _, entry := range excluded {
+		seen[entry] = struct{}{}
+	}
+	for _, entry := range entries {
+		if _, ok := seen[entry]; !ok {
+			seen[entry] = struct{}{}
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// effectiveQuota is the SQL for a user's limit in column: their own unless
+// it is NULL, otherwise that of their highest-priority group that sets it.
+func effectiveQuota(column string) string {
+	return fmt.Sprintf(`COALESCE(u.%[1]s, (
+			SELECT g.%[1]s
+			FROM user_groups g
+			JOIN user_group_members m ON m.group_id = g.id
+			WHERE m.user_id = u.id AND g.%[1]s > 0
+			ORDER BY g.priority DESC, g.id
+			LIMIT 1
+		), 0)`, column)
+}
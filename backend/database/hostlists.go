@@ -0,0 +1,338 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/lib/pq"
+	"proxy-server/models"
+)
+
+// Kinds of host list references.
+const (
+	HostListWhitelist = "whitelist"
+	HostListBlacklist = "blacklist"
+)
+
+const hostListColumns = `id, name, description, source, format, refresh_minutes, revision, entry_count,
+		skipped_count, last_refreshed_at, last_error, created_at, updated_at`
+
+func scanHostList(row rowScanner) (*models.HostList, error) {
+	var list models.HostList
+	var lastRefreshed sql.NullTime
+	err := row.Scan(&list.ID, &list.Name, &list.Description, &list.Source, &list.Format, &list.RefreshMinutes,
+		&list.Revision, &list.EntryCount, &list.SkippedCount, &lastRefreshed, &list.LastError,
+		&list.CreatedAt, &list.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastRefreshed.Valid {
+		list.LastRefreshedAt = &lastRefreshed.Time
+	}
+	return &list, nil
+}
+
+func (d *Database) queryHostLists(query string, args ...interface{}) ([]models.HostList, error) {
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lists := []models.HostList{}
+	for rows.Next() {
+		list, err := scanHostList(rows)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, *list)
+	}
+	return lists, rows.Err()
+}
+
+// GetHostLists returns every host list without its entries.
+func (d *Database) GetHostLists() ([]models.HostList, error) {
+	return d.queryHostLists(`
+		SELECT ` + hostListColumns + `
+		FROM host_lists
+		ORDER BY name
+	`)
+}
+
+// GetHostList returns a host list. Entries are included for lists
+// maintained through the API; imported lists can be far too large.
+func (d *Database) GetHostList(id int) (*models.HostList, error) {
+	list, err := scanHostList(d.DB.QueryRow(`
+		SELECT `+hostListColumns+`
+		FROM host_lists
+		WHERE id = $1
+	`, id))
+	if err != nil {
+		return nil, err
+	}
+	if list.Source == "" {
+		if list.Entries, err = d.GetHostListEntries(id); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// GetHostListEntries returns the entries of a host list.
+func (d *Database) GetHostListEntries(id int) ([]string, error) {
+	rows, err := d.DB.Query("SELECT value FROM host_list_entries WHERE list_id = $1 ORDER BY value", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []string{}
+	for rows.Next() {
+		var entry string
+		if err := rows.Scan(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// CreateHostList stores a new list. Entries of lists without a source are
+// validated; those of imported lists are stored as parsed, with skipped
+// recording how many source lines could not be used.
+func (d *Database) CreateHostList(create *models.HostListCreate, skipped int) (*models.HostList, error) {
+	entries := create.Entries
+	if create.Source == "" {
+		var err error
+		if entries, err = sanitizeEntries(create.Entries); err != nil {
+			return nil, err
+		}
+	}
+
+	list, err := scanHostList(d.DB.QueryRow(`
+		INSERT INTO host_lists (name, description, source, format, refresh_minutes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+hostListColumns,
+		create.Name, create.Description, create.Source, create.Format, create.RefreshMinutes))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.ReplaceHostListEntries(list.ID, entries, skipped); err != nil {
+		return nil, err
+	}
+	return d.GetHostList(list.ID)
+}
+
+// UpdateHostList changes the settings of a list and, when given, replaces
+// its entries.
+func (d *Database) UpdateHostList(id int, update *models.HostListUpdate) error {
+	var entries []string
+	if update.Entries != nil {
+		var err error
+		if entries, err = sanitizeEntries(*update.Entries); err != nil {
+			return err
+		}
+	}
+
+	query := "UPDATE host_lists SET "
+	args := []interface{}{}
+	argCount := 1
+
+	add := func(column string, value interface{}) {
+		query += fmt.Sprintf("%s = $%d, ", column, argCount)
+		args = append(args, value)
+		argCount++
+	}
+
+	if update.Name != nil {
+		add("name", *update.Name)
+	}
+	if update.Description != nil {
+		add("description", *update.Description)
+	}
+	if update.Source != nil {
+		add("source", *update.Source)
+	}
+	if update.Format != nil {
+		add("format", *update.Format)
+	}
+	if update.RefreshMinutes != nil {
+		add("refresh_minutes", *update.RefreshMinutes)
+	}
+
+	if len(args) == 0 && update.Entries == nil {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query += fmt.Sprintf("updated_at = CURRENT_TIMESTAMP WHERE id = $%d", argCount)
+	args = append(args, id)
+	if _, err := d.DB.Exec(query, args...); err != nil {
+		return err
+	}
+
+	if update.Entries != nil {
+		_, err := d.ReplaceHostListEntries(id, entries, 0)
+		return err
+	}
+	return nil
+}
+
+func (d *Database) DeleteHostList(id int) error {
+	_, err := d.DB.Exec("DELETE FROM host_lists WHERE id = $1", id)
+	return err
+}
+
+// ReplaceHostListEntries stores the entries of a list and marks it as
+// refreshed. The revision is only bumped, and the rows only rewritten, when
+// the entries differ from those stored; it reports whether they did.
+func (d *Database) ReplaceHostListEntries(id int, entries []string, skipped int) (bool, error) {
+	sum := sha256.New()
+	for _, entry := range entries {
+		sum.Write([]byte(entry))
+		sum.Write([]byte{'\n'})
+	}
+	checksum := hex.EncodeToString(sum.Sum(nil))
+
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow("SELECT checksum FROM host_lists WHERE id = $1 FOR UPDATE", id).Scan(&current); err != nil {
+		return false, err
+	}
+	changed := current != checksum
+	if changed {
+		if _, err := tx.Exec("DELETE FROM host_list_entries WHERE list_id = $1", id); err != nil {
+			return false, err
+		}
+		// COPY keeps imports of hundreds of thousands of entries fast.
+		stmt, err := tx.Prepare(pq.CopyIn("host_list_entries", "list_id", "value"))
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			if _, err := stmt.Exec(id, entry); err != nil {
+				stmt.Close()
+				return false, err
+			}
+		}
+		if _, err := stmt.Exec(); err != nil {
+			stmt.Close()
+			return false, err
+		}
+		if err := stmt.Close(); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`
+			UPDATE host_lists
+			SET revision = revision + 1, entry_count = $2, checksum = $3
+			WHERE id = $1
+		`, id, len(entries), checksum); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(`
+		UPDATE host_lists
+		SET skipped_count = $2, last_error = '', last_refreshed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, skipped); err != nil {
+		return false, err
+	}
+	return changed, tx.Commit()
+}
+
+// RecordHostListError notes a failed refresh. The list keeps its entries
+// and is retried after its refresh interval.
+func (d *Database) RecordHostListError(id int, message string) error {
+	_, err := d.DB.Exec(`
+		UPDATE host_lists
+		SET last_error = $2, last_refreshed_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, id, message)
+	return err
+}
+
+// GetDueHostLists returns the imported lists whose refresh interval has
+// passed.
+func (d *Database) GetDueHostLists() ([]models.HostList, error) {
+	return d.queryHostLists(`
+		SELECT ` + hostListColumns + `
+		FROM host_lists
+		WHERE source <> '' AND refresh_minutes > 0
+		  AND (last_refreshed_at IS NULL
+		       OR last_refreshed_at <= CURRENT_TIMESTAMP - refresh_minutes * INTERVAL '1 minute')
+		ORDER BY id
+	`)
+}
+
+// MissingHostListIDs returns those of ids that are not host lists.
+func (d *Database) MissingHostListIDs(ids []int) ([]int, error) {
+	return d.missingIDs("host_lists", ids)
+}
+
+// SetGroupHostLists replaces the host lists of one kind a group references.
+func (d *Database) SetGroupHostLists(groupID int, kind string, listIDs []int) error {
+	return d.replaceHostListRefs("group_host_lists", "group_id", groupID, kind, listIDs)
+}
+
+func (d *Database) replaceHostListRefs(table, ownerColumn string, ownerID int, kind string, listIDs []int) error {
+	return d.withTx(func(tx *sql.Tx) error {
+		return replaceHostListRefsIn(tx, table, ownerColumn, ownerID, kind, listIDs)
+	})
+}
+
+func replaceHostListRefsIn(tx *sql.Tx, table, ownerColumn string, ownerID int, kind string, listIDs []int) error {
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND kind = $2", table, ownerColumn), ownerID, kind); err != nil {
+		return err
+	}
+	insertStmt := fmt.Sprintf("INSERT INTO %s (%s, kind, list_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		table, ownerColumn)
+	for _, listID := range listIDs {
+		if _, err := tx.Exec(insertStmt, ownerID, kind, listID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) getHostListIDs(table, ownerColumn string, ownerID int, kind string) ([]int, error) {
+	return d.intList(fmt.Sprintf("SELECT list_id FROM %s WHERE %s = $1 AND kind = $2 ORDER BY list_id", table, ownerColumn),
+		ownerID, kind)
+}
+
+// getEffectiveHostLists returns the host lists of one kind that apply to a
+// user, directly or through their groups.
+func (d *Database) getEffectiveHostLists(userID int, kind string) ([]models.HostListRef, error) {
+	rows, err := d.DB.Query(`
+		SELECT id, revision
+		FROM host_lists
+		WHERE id IN (
+			SELECT list_id FROM user_host_lists WHERE user_id = $1 AND kind = $2
+			UNION
+			SELECT g.list_id
+			FROM group_host_lists g
+			JOIN user_group_members m ON m.group_id = g.group_id
+			WHERE m.user_id = $1 AND g.kind = $2
+		)
+		ORDER BY id
+	`, userID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []models.HostListRef
+	for rows.Next() {
+		var ref models.HostListRef
+		if err := rows.Scan(&ref.ID, &ref.Revision); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
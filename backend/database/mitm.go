@@ -0,0 +1,22 @@
+package database
+
+// GetMITMCA returns the stored interception CA certificate and its
+// encrypted private key, or sql.ErrNoRows if none has been created yet.
+func (d *Database) GetMITMCA() (certPEM, keyEncrypted string, err error) {
+	err = d.DB.QueryRow(`SELECT cert_pem, key_encrypted FROM mitm_ca WHERE id = 1`).Scan(&certPEM, &keyEncrypted)
+	return certPEM, keyEncrypted, err
+}
+
+// SaveMITMCA stores a newly generated CA unless another instance stored
+// one first, and returns whichever CA is kept.
+func (d *Database) SaveMITMCA(certPEM, keyEncrypted string) (string, string, error) {
+	_, err := d.DB.Exec(`
+		INSERT INTO mitm_ca (id, cert_pem, key_encrypted)
+		VALUES (1, $1, $2)
+		ON CONFLICT (id) DO NOTHING
+	`, certPEM, keyEncrypted)
+	if err != nil {
+		return "", "", err
+	}
+	return d.GetMITMCA()
+}
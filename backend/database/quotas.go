@@ -0,0 +1,158 @@
+package database
+
+import (
+	"proxy-server/models"
+)
+
+// Quota names reported in QuotaUsage.Exceeded and request log reasons.
+const (
+	QuotaDailyBytes      = "daily_bytes"
+	QuotaMonthlyBytes    = "monthly_bytes"
+	QuotaDailyRequests   = "daily_requests"
+	QuotaMonthlyRequests = "monthly_requests"
+)
+
+// quotaUsageColumns aggregates traffic_stats rows of the current calendar
+// month, splitting out today's share. Callers filter with
+// quotaUsageMonthFilter.
+const quotaUsageColumns = `
+	COALESCE(SUM(bytes_sent + bytes_received) FILTER (WHERE date = CURRENT_DATE), 0),
+	COALESCE(SUM(bytes_sent + bytes_received), 0),
+	COALESCE(SUM(request_count) FILTER (WHERE date = CURRENT_DATE), 0),
+	COALESCE(SUM(request_count), 0)`
+
+const quotaUsageMonthFilter = `date >= date_trunc('month', CURRENT_DATE)::date`
+
+// ExceededQuotas lists the limits in quota that usage has reached. A limit
+// of zero is unlimited.
+func ExceededQuotas(quota models.UserQuota, usage models.QuotaUsage) []string {
+	var exceeded []string
+	check := func(name string, limit, used int64) {
+		if limit > 0 && used >= limit {
+			exceeded = append(exceeded, name)
+		}
+	}
+	check(QuotaDailyBytes, quota.QuotaDailyBytes, usage.DailyBytes)
+	check(QuotaMonthlyBytes, quota.QuotaMonthlyBytes, usage.MonthlyBytes)
+	check(QuotaDailyRequests, quota.QuotaDailyRequests, usage.DailyRequests)
+	check(QuotaMonthlyRequests, quota.QuotaMonthlyRequests, usage.MonthlyRequests)
+	return exceeded
+}
+
+// HasQuota reports whether any limit is set.
+func HasQuota(quota models.UserQuota) bool {
+	return quota.QuotaDailyBytes > 0 || quota.QuotaMonthlyBytes > 0 ||
+		quota.QuotaDailyRequests > 0 || quota.QuotaMonthlyRequests > 0
+}
+
+func (d *Database) GetQuotaUsage(userID int) (*models.QuotaUsage, error) {
+	var usage models.QuotaUsage
+	err := d.DB.QueryRow(`
+		SELECT `+quotaUsageColumns+`
+		FROM traffic_stats
+		WHERE user_id = $1 AND `+quotaUsageMonthFilter,
+		userID).Scan(&usage.DailyBytes, &usage.MonthlyBytes, &usage.DailyRequests, &usage.MonthlyRequests)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (d *Database) quotaUsageByUser() (map[int]models.QuotaUsage, error) {
+	rows, err := d.DB.Query(`
+		SELECT user_id, ` + quotaUsageColumns + `
+		FROM traffic_stats
+		WHERE ` + quotaUsageMonthFilter + `
+		GROUP BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int]models.QuotaUsage)
+	for rows.Next() {
+		var userID int
+		var u models.QuotaUsage
+		if err := rows.Scan(&userID, &u.DailyBytes, &u.MonthlyBytes, &u.DailyRequests, &u.MonthlyRequests); err != nil {
+			return nil, err
+		}
+		usage[userID] = u
+	}
+	return usage, rows.Err()
+}
+
+// GetQuotaStatuses returns limits and current usage for every user that
+// has at least one quota configured, directly or through a group.
+func (d *Database) GetQuotaStatuses() ([]models.QuotaStatus, error) {
+	rows, err := d.DB.Query(`
+		SELECT id, username, quota_daily_bytes, quota_monthly_bytes,
+		       quota_daily_requests, quota_monthly_requests
+		FROM (
+			SELECT u.id, u.username,
+			       ` + effectiveQuota("quota_daily_bytes") + ` AS quota_daily_bytes,
+			       ` + effectiveQuota("quota_monthly_bytes") + ` AS quota_monthly_bytes,
+			       ` + effectiveQuota("quota_daily_requests") + ` AS quota_daily_requests,
+			       ` + effectiveQuota("quota_monthly_requests") + ` AS quota_monthly_requests
+			FROM users u
+		) q
+		WHERE quota_daily_bytes > 0 OR quota_monthly_bytes > 0
+		   OR quota_daily_requests > 0 OR quota_monthly_requests > 0
+		ORDER BY username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statuses []models.QuotaStatus
+	for rows.Next() {
+		var status models.QuotaStatus
+		if err := rows.Scan(&status.UserID, &status.Username, &status.QuotaDailyBytes, &status.QuotaMonthlyBytes,
+			&status.QuotaDailyRequests, &status.QuotaMonthlyRequests); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	usage, err := d.quotaUsageByUser()
+	if err != nil {
+		return nil, err
+	}
+	for i := range statuses {
+		statuses[i].Usage = usage[statuses[i].UserID]
+		statuses[i].Usage.Exceeded = ExceededQuotas(statuses[i].UserQuota, statuses[i].Usage)
+	}
+	return statuses, nil
+}
+
+// effectiveQuotas returns the limits that apply to the users matched by
+// filter, a WHERE clause on users u, keyed by user id.
+func (d *Database) effectiveQuotas(filter string, args ...interface{}) (map[int]models.UserQuota, error) {
+	rows, err := d.DB.Query(`
+		SELECT u.id,
+		       `+effectiveQuota("quota_daily_bytes")+`,
+		       `+effectiveQuota("quota_monthly_bytes")+`,
+		       `+effectiveQuota("quota_daily_requests")+`,
+		       `+effectiveQuota("quota_monthly_requests")+`
+		FROM users u
+		`+filter, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := make(map[int]models.UserQuota)
+	for rows.Next() {
+		var userID int
+		var quota models.UserQuota
+		if err := rows.Scan(&userID, &quota.QuotaDailyBytes, &quota.QuotaMonthlyBytes,
+			&quota.QuotaDailyRequests, &quota.QuotaMonthlyRequests); err != nil {
+			return nil, err
+		}
+		quotas[userID] = quota
+	}
+	return quotas, rows.Err()
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"proxy-server/models"
+)
+
+const proxyTokenColumns = `id, user_id, name, hint, expires_at, last_used_at, COALESCE(last_used_ip, ''), created_at`
+
+func scanProxyToken(row rowScanner) (*models.ProxyToken, error) {
+	var token models.ProxyToken
+	var expiresAt, lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Name, &token.Hint, &expiresAt, &lastUsedAt,
+		&token.LastUsedIP, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		token.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return &token, nil
+}
+
+// GetProxyTokens returns the proxy tokens of a user, newest first.
+func (d *Database) GetProxyTokens(userID int) ([]models.ProxyToken, error) {
+	rows, err := d.DB.Query(`
+		SELECT `+proxyTokenColumns+`
+		FROM proxy_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.ProxyToken{}
+	for rows.Next() {
+		token, err := scanProxyToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *token)
+	}
+	return tokens, rows.Err()
+}
+
+// GetProxyTokenByHash looks up a token for authentication.
+func (d *Database) GetProxyTokenByHash(hash string) (*models.ProxyToken, error) {
+	return scanProxyToken(d.DB.QueryRow(`
+		SELECT `+proxyTokenColumns+`
+		FROM proxy_tokens
+		WHERE token_hash = $1
+	`, hash))
+}
+
+func (d *Database) CreateProxyToken(userID int, create *models.ProxyTokenCreate, hash, hint string) (*models.ProxyToken, error) {
+	return scanProxyToken(d.DB.QueryRow(`
+		INSERT INTO proxy_tokens (user_id, name, token_hash, hint, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+proxyTokenColumns,
+		userID, create.Name, hash, hint, create.ExpiresAt))
+}
+
+// DeleteProxyToken revokes a token of a user. It returns sql.ErrNoRows if
+// the user has no such token.
+func (d *Database) DeleteProxyToken(userID, id int) (*models.ProxyToken, error) {
+	return scanProxyToken(d.DB.QueryRow(`
+		DELETE FROM proxy_tokens
+		WHERE id = $1 AND user_id = $2
+		RETURNING `+proxyTokenColumns,
+		id, userID))
+}
+
+// TouchProxyToken records when and from where a token was last used.
+func (d *Database) TouchProxyToken(id int, ip string, at time.Time) error {
+	_, err := d.DB.Exec(`
+		UPDATE proxy_tokens SET last_used_at = $1, last_used_ip = $2
+		WHERE id = $3
+	`, at, ip, id)
+	return err
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"proxy-server/models"
+)
+
+const upstreamColumns = `id, name, type, address, COALESCE(username, ''), COALESCE(password, ''),
+		pool, priority, is_active, healthy, last_checked_at, COALESCE(last_error, ''), created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUpstreamProxy(row rowScanner) (*models.UpstreamProxy, error) {
+	var upstream models.UpstreamProxy
+	var lastChecked sql.NullTime
+	err := row.Scan(&upstream.ID, &upstream.Name, &upstream.Type, &upstream.Address, &upstream.Username,
+		&upstream.Password, &upstream.Pool, &upstream.Priority, &upstream.IsActive, &upstream.Healthy,
+		&lastChecked, &upstream.LastError, &upstream.CreatedAt, &upstream.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastChecked.Valid {
+		upstream.LastCheckedAt = &lastChecked.Time
+	}
+	upstream.HasPassword = upstream.Password != ""
+	return &upstream, nil
+}
+
+// GetUpstreamProxies returns every configured upstream ordered by pool and
+// priority. Passwords are returned in their stored (encrypted) form.
+func (d *Database) GetUpstreamProxies() ([]models.UpstreamProxy, error) {
+	rows, err := d.DB.Query(`
+		SELECT ` + upstreamColumns + `
+		FROM upstream_proxies
+		ORDER BY pool, priority, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var upstreams []models.UpstreamProxy
+	for rows.Next() {
+		upstream, err := scanUpstreamProxy(rows)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, *upstream)
+	}
+	return upstreams, rows.Err()
+}
+
+func (d *Database) GetUpstreamProxy(id int) (*models.UpstreamProxy, error) {
+	return scanUpstreamProxy(d.DB.QueryRow(`
+		SELECT `+upstreamColumns+`
+		FROM upstream_proxies
+		WHERE id = $1
+	`, id))
+}
+
+func (d *Database) CreateUpstreamProxy(upstream *models.UpstreamProxyCreate, encryptedPassword string) (*models.UpstreamProxy, error) {
+	return scanUpstreamProxy(d.DB.QueryRow(`
+		INSERT INTO upstream_proxies (name, type, address, username, password, pool, priority)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+upstreamColumns,
+		upstream.Name, upstream.Type, upstream.Address, upstream.Username, encryptedPassword,
+		upstream.Pool, upstream.Priority))
+}
+
+func (d *Database) UpdateUpstreamProxy(id int, update *models.UpstreamProxyUpdate) error {
+	query := "UPDATE upstream_proxies SET "
+	args := []interface{}{}
+	argCount := 1
+
+	add := func(column string, value interface{}) {
+		query += fmt.Sprintf("%s = $%d, ", column, argCount)
+		args = append(args, value)
+		argCount++
+	}
+
+	if update.Name != nil {
+		add("name", *update.Name)
+	}
+	if update.Type != nil {
+		add("type", *update.Type)
+	}
+	if update.Address != nil {
+		add("address", *update.Address)
+	}
+	if update.Username != nil {
+		add("username", *update.Username)
+	}
+	if update.Password != nil {
+		add("password", *update.Password)
+	}
+	if update.Pool != nil {
+		add("pool", *update.Pool)
+	}
+	if update.Priority != nil {
+		add("priority", *update.Priority)
+	}
+	if update.IsActive != nil {
+		add("is_active", *update.IsActive)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	query += fmt.Sprintf("updated_at = CURRENT_TIMESTAMP WHERE id = $%d", argCount)
+	args = append(args, id)
+
+	_, err := d.DB.Exec(query, args...)
+	return err
+}
+
+func (d *Database) DeleteUpstreamProxy(id int) error {
+	_, err := d.DB.Exec("DELETE FROM upstream_proxies WHERE id = $1", id)
+	return err
+}
+
+func (d *Database) UpdateUpstreamHealth(id int, healthy bool, lastError string) error {
+	_, err := d.DB.Exec(`
+		UPDATE upstream_proxies
+		SET healthy = $1, last_error = $2, last_checked_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, healthy, lastError, id)
+	return err
+}
+
+// GetUpstreamRules returns destination rules. When userID is nil all rules
+// are returned; otherwise the user's own rules followed by global rules.
+func (d *Database) GetUpstreamRules(userID *int) ([]models.UpstreamRule, error) {
+	query := `
+		SELECT r.id, r.user_id, COALESCE(u.username, ''), r.pattern, r.pool, r.created_at
+		FROM upstream_rules r
+		LEFT JOIN users u ON r.user_id = u.id
+	`
+	args := []interface{}{}
+	if userID != nil {
+		query += " WHERE r.user_id = $1 OR r.user_id IS NULL ORDER BY r.user_id IS NULL, r.id"
+		args = append(args, *userID)
+	} else {
+		query += " ORDER BY r.user_id NULLS FIRST, r.id"
+	}
+
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []models.UpstreamRule
+	for rows.Next() {
+		var rule models.UpstreamRule
+		if err := rows.Scan(&rule.ID, &rule.UserID, &rule.Username, &rule.Pattern, &rule.Pool, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (d *Database) CreateUpstreamRule(rule *models.UpstreamRule) (*models.UpstreamRule, error) {
+	created := *rule
+	err := d.DB.QueryRow(`
+		INSERT INTO upstream_rules (user_id, pattern, pool)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, rule.UserID, rule.Pattern, rule.Pool).Scan(&created.ID, &created.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (d *Database) DeleteUpstreamRule(id int) error {
+	_, err := d.DB.Exec("DELETE FROM upstream_rules WHERE id = $1", id)
+	return err
+}
@@ -0,0 +1,310 @@
+// Package guard protects the proxy and admin logins against password
+// guessing: failed attempts are counted per source IP, further attempts
+// from it are refused for a growing delay, and it is banned for a while
+// past a threshold. Nothing is counted per username, so failing logins
+// under someone else's name cannot lock the owner of the account out.
+package guard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+)
+
+// KindIP is the kind of key failures are counted and bans are kept under.
+const KindIP = "ip"
+
+const (
+	// refreshInterval is how often settings and bans are re-read, so bans
+	// lifted or added elsewhere take effect.
+	refreshInterval = 30 * time.Second
+	baseDelay       = 500 * time.Millisecond
+	maxDelay        = 5 * time.Second
+	// maxTracked bounds the failures kept per key when bans are disabled.
+	maxTracked = 1000
+)
+
+// config is read from the auth_* proxy settings.
+type config struct {
+	maxFailures int
+	window      time.Duration
+	banDuration time.Duration
+	delayAfter  int
+}
+
+func defaultConfig() config {
+	return config{
+		maxFailures: 10,
+		window:      15 * time.Minute,
+		banDuration: 30 * time.Minute,
+		delayAfter:  3,
+	}
+}
+
+// BannedError is returned for logins from a banned source IP.
+type BannedError struct {
+	Kind  string
+	Until time.Time
+}
+
+func (e *BannedError) Error() string {
+	return fmt.Sprintf("%s banned until %s after too many failed logins", e.Kind, e.Until.Format(time.RFC3339))
+}
+
+// ThrottledError is returned for logins attempted before the delay that
+// follows a failed attempt has passed.
+type ThrottledError struct {
+	Kind  string
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%s throttled until %s after failed logins", e.Kind, e.Until.Format(time.RFC3339))
+}
+
+// RetryAfter reports how long a login refused with err should wait, for
+// errors returned by Check.
+func RetryAfter(err error) (time.Duration, bool) {
+	var banned *BannedError
+	if errors.As(err, &banned) {
+		return time.Until(banned.Until), true
+	}
+	var throttled *ThrottledError
+	if errors.As(err, &throttled) {
+		return time.Until(throttled.Until), true
+	}
+	return 0, false
+}
+
+type banKey struct {
+	kind  string
+	value string
+}
+
+// LoginGuard is shared by every login path of the process.
+type LoginGuard struct {
+	db *database.Database
+
+	mu       sync.Mutex
+	config   config
+	failures map[banKey][]time.Time
+	// retryAt holds when a key that just failed may try again.
+	retryAt map[banKey]time.Time
+	bans    map[banKey]models.AuthBan
+}
+
+func New(db *database.Database) *LoginGuard {
+	g := &LoginGuard{
+		db:       db,
+		config:   defaultConfig(),
+		failures: make(map[banKey][]time.Time),
+		retryAt:  make(map[banKey]time.Time),
+		bans:     make(map[banKey]models.AuthBan),
+	}
+	g.refresh()
+	return g
+}
+
+// Run keeps settings and bans in sync with the database until ctx is
+// cancelled.
+func (g *LoginGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *LoginGuard) refresh() {
+	next := defaultConfig()
+	if rows, err := g.db.GetProxySettings(); err != nil {
+		log.Printf("Failed to load login protection settings: %v", err)
+	} else {
+		for _, row := range rows {
+			n, err := strconv.Atoi(strings.TrimSpace(row.Value))
+			if err != nil || n < 0 {
+				continue
+			}
+			switch row.Key {
+			case "auth_max_failures":
+				next.maxFailures = n
+			case "auth_failure_window_seconds":
+				if n > 0 {
+					next.window = time.Duration(n) * time.Second
+				}
+			case "auth_ban_minutes":
+				if n > 0 {
+					next.banDuration = time.Duration(n) * time.Minute
+				}
+			case "auth_delay_after":
+				next.delayAfter = n
+			}
+		}
+	}
+
+	now := time.Now()
+	if err := g.db.DeleteExpiredAuthBans(now); err != nil {
+		log.Printf("Failed to remove expired login bans: %v", err)
+	}
+	bans, err := g.db.GetActiveAuthBans(now)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.config = next
+	for key, times := range g.failures {
+		if recent := pruneFailures(times, now.Add(-next.window)); len(recent) > 0 {
+			g.failures[key] = recent
+		} else {
+			delete(g.failures, key)
+		}
+	}
+	for key, at := range g.retryAt {
+		if !now.Before(at) {
+			delete(g.retryAt, key)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to load login bans: %v", err)
+		return
+	}
+	g.bans = make(map[banKey]models.AuthBan, len(bans))
+	for _, ban := range bans {
+		g.bans[banKey{ban.Kind, ban.Value}] = ban
+	}
+}
+
+// Check refuses a login attempt while the source IP is banned or waits
+// out the delay after a failed attempt. Refused attempts are answered at
+// once and not counted. A valid login does not reset the failures of its
+// IP, so it cannot interrupt a guessing run from the same address.
+func (g *LoginGuard) Check(ip string) error {
+	if ip == "" {
+		return nil
+	}
+	now := time.Now()
+	key := banKey{KindIP, ip}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ban, ok := g.bans[key]; ok {
+		if now.Before(ban.ExpiresAt) {
+			return &BannedError{Kind: key.kind, Until: ban.ExpiresAt}
+		}
+		delete(g.bans, key)
+	}
+	if at, ok := g.retryAt[key]; ok {
+		if now.Before(at) {
+			return &ThrottledError{Kind: key.kind, Until: at}
+		}
+		delete(g.retryAt, key)
+	}
+	return nil
+}
+
+// Failed records a failed login from ip through source (e.g. "proxy").
+// Past auth_delay_after failures the IP must wait before its next attempt;
+// crossing the threshold bans it and is written to the audit log.
+func (g *LoginGuard) Failed(ip, source string) {
+	if ip == "" {
+		return
+	}
+	now := time.Now()
+	key := banKey{KindIP, ip}
+
+	g.mu.Lock()
+	cfg := g.config
+	times := append(pruneFailures(g.failures[key], now.Add(-cfg.window)), now)
+	if len(times) > maxTracked {
+		times = times[len(times)-maxTracked:]
+	}
+	g.failures[key] = times
+	if delay := delayFor(len(times), cfg.delayAfter); delay > 0 {
+		g.retryAt[key] = now.Add(delay)
+	}
+	banned := false
+	if cfg.maxFailures > 0 && len(times) >= cfg.maxFailures {
+		if _, ok := g.bans[key]; !ok {
+			g.bans[key] = models.AuthBan{Kind: key.kind, Value: key.value, ExpiresAt: now.Add(cfg.banDuration)}
+			banned = true
+		}
+		delete(g.failures, key)
+	}
+	g.mu.Unlock()
+
+	if banned {
+		g.ban(key, len(times), source, ip, now.Add(cfg.banDuration))
+	}
+}
+
+// Bans lists the active bans.
+func (g *LoginGuard) Bans() ([]models.AuthBan, error) {
+	return g.db.GetActiveAuthBans(time.Now())
+}
+
+// Lift removes a ban and the failures that led to it.
+func (g *LoginGuard) Lift(id int) (*models.AuthBan, error) {
+	ban, err := g.db.DeleteAuthBan(id)
+	if err != nil {
+		return nil, err
+	}
+	key := banKey{ban.Kind, ban.Value}
+	g.mu.Lock()
+	delete(g.bans, key)
+	delete(g.failures, key)
+	delete(g.retryAt, key)
+	g.mu.Unlock()
+	return ban, nil
+}
+
+func (g *LoginGuard) ban(key banKey, failures int, source, ip string, until time.Time) {
+	reason := fmt.Sprintf("%d failed %s logins", failures, source)
+	saved, err := g.db.SaveAuthBan(key.kind, key.value, reason, failures, until)
+	if err != nil {
+		log.Printf("Failed to store login ban for %s %s: %v", key.kind, key.value, err)
+	} else {
+		g.mu.Lock()
+		g.bans[key] = *saved
+		g.mu.Unlock()
+	}
+
+	log.Printf("Banned %s %s until %s: %s", key.kind, key.value, until.Format(time.RFC3339), reason)
+	details := fmt.Sprintf("Banned %s %s until %s after %s", key.kind, key.value, until.Format(time.RFC3339), reason)
+	g.db.LogAdminAction(nil, "AUTH_BAN", details, ip)
+}
+
+func pruneFailures(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// delayFor doubles from baseDelay with every failure past delayAfter, up
+// to maxDelay.
+func delayFor(failures, delayAfter int) time.Duration {
+	if delayAfter == 0 || failures <= delayAfter {
+		return 0
+	}
+	delay := baseDelay
+	for i := delayAfter + 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
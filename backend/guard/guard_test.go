@@ -0,0 +1,142 @@
+package guard
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"proxy-server/models"
+)
+
+// newTestGuard returns a guard that never reaches the database: bans are
+// disabled so Failed does not store one.
+func newTestGuard(delayAfter int) *LoginGuard {
+	return &LoginGuard{
+		config:   config{maxFailures: 0, window: time.Minute, banDuration: time.Minute, delayAfter: delayAfter},
+		failures: make(map[banKey][]time.Time),
+		retryAt:  make(map[banKey]time.Time),
+		bans:     make(map[banKey]models.AuthBan),
+	}
+}
+
+func TestDelayFor(t *testing.T) {
+	tests := []struct {
+		failures   int
+		delayAfter int
+		want       time.Duration
+	}{
+		{1, 0, 0},
+		{50, 0, 0},
+		{0, 3, 0},
+		{3, 3, 0},
+		{4, 3, baseDelay},
+		{5, 3, 2 * baseDelay},
+		{6, 3, 4 * baseDelay},
+		{7, 3, 8 * baseDelay},
+		{8, 3, maxDelay},
+		{100, 3, maxDelay},
+		{2, 1, baseDelay},
+	}
+	for _, tt := range tests {
+		if got := delayFor(tt.failures, tt.delayAfter); got != tt.want {
+			t.Errorf("delayFor(%d, %d) = %v, want %v", tt.failures, tt.delayAfter, got, tt.want)
+		}
+	}
+}
+
+func TestPruneFailures(t *testing.T) {
+	now := time.Now()
+	times := []time.Time{now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-time.Minute), now}
+
+	tests := []struct {
+		cutoff time.Time
+		want   int
+	}{
+		{now.Add(-time.Hour), 4},
+		{now.Add(-2 * time.Minute), 2},
+		{now.Add(-90 * time.Second), 2},
+		{now, 0},
+	}
+	for _, tt := range tests {
+		if got := pruneFailures(times, tt.cutoff); len(got) != tt.want {
+			t.Errorf("pruneFailures(cutoff %v ago) kept %d, want %d", now.Sub(tt.cutoff), len(got), tt.want)
+		}
+	}
+}
+
+func TestFailedThrottlesOnlyItsIP(t *testing.T) {
+	g := newTestGuard(2)
+
+	tests := []struct {
+		ip        string
+		throttled bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.1", false},
+		{"192.0.2.1", true},
+		{"198.51.100.9", false},
+		{"2001:db8::1", false},
+	}
+	for i, tt := range tests {
+		g.Failed(tt.ip, "proxy")
+		err := g.Check(tt.ip)
+		var throttled *ThrottledError
+		if got := errors.As(err, &throttled); got != tt.throttled {
+			t.Errorf("failure %d: Check(%s) = %v, want throttled %v", i+1, tt.ip, err, tt.throttled)
+		}
+	}
+
+	// Usernames play no part, so every other address may still log in.
+	for _, ip := range []string{"198.51.100.9", "203.0.113.4", ""} {
+		if err := g.Check(ip); err != nil {
+			t.Errorf("Check(%q) = %v, want nil", ip, err)
+		}
+	}
+	if _, ok := RetryAfter(g.Check("192.0.2.1")); !ok {
+		t.Errorf("RetryAfter of a throttled login reported no delay")
+	}
+}
+
+func TestFailedIgnoresEmptyIP(t *testing.T) {
+	g := newTestGuard(1)
+	for i := 0; i < 5; i++ {
+		g.Failed("", "admin")
+	}
+	if len(g.failures) != 0 || len(g.retryAt) != 0 {
+		t.Errorf("Failed with no IP recorded %d failures and %d delays, want none", len(g.failures), len(g.retryAt))
+	}
+}
+
+func TestCheckBans(t *testing.T) {
+	now := time.Now()
+	g := newTestGuard(0)
+	g.bans[banKey{KindIP, "192.0.2.1"}] = models.AuthBan{Kind: KindIP, Value: "192.0.2.1", ExpiresAt: now.Add(time.Hour)}
+	g.bans[banKey{KindIP, "192.0.2.2"}] = models.AuthBan{Kind: KindIP, Value: "192.0.2.2", ExpiresAt: now.Add(-time.Second)}
+	g.retryAt[banKey{KindIP, "192.0.2.3"}] = now.Add(-time.Second)
+
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"192.0.2.3", false},
+		{"192.0.2.4", false},
+	}
+	for _, tt := range tests {
+		err := g.Check(tt.ip)
+		var banned *BannedError
+		if got := errors.As(err, &banned); got != tt.banned {
+			t.Errorf("Check(%s) = %v, want banned %v", tt.ip, err, tt.banned)
+		}
+		if !tt.banned && err != nil {
+			t.Errorf("Check(%s) = %v, want nil", tt.ip, err)
+		}
+	}
+	if _, ok := g.bans[banKey{KindIP, "192.0.2.2"}]; ok {
+		t.Errorf("Check kept an expired ban")
+	}
+	if _, ok := g.retryAt[banKey{KindIP, "192.0.2.3"}]; ok {
+		t.Errorf("Check kept an elapsed delay")
+	}
+}
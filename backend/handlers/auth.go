@@ -3,13 +3,16 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"proxy-server/database"
+	"proxy-server/guard"
 	"proxy-server/models"
 	"proxy-server/utils"
 )
@@ -17,11 +20,12 @@ import (
 const handlerTimeout = 5 * time.Second
 
 type AuthHandler struct {
-	db *database.Database
+	db    *database.Database
+	guard *guard.LoginGuard
 }
 
-func NewAuthHandler(db *database.Database) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *database.Database, loginGuard *guard.LoginGuard) *AuthHandler {
+	return &AuthHandler{db: db, guard: loginGuard}
 }
 
 func (h *AuthHandler) CheckInit(w http.ResponseWriter, r *http.Request) {
@@ -102,30 +106,49 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := getRequestIP(r)
+	if err := h.guard.Check(ip); err != nil {
+		reason := "throttled"
+		var banned *guard.BannedError
+		if errors.As(err, &banned) {
+			reason = "banned"
+		}
+		if wait, ok := guard.RetryAfter(err); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		}
+		h.logAuditEvent(nil, "LOGIN_FAIL", fmt.Sprintf("username=%s reason=%s", strings.TrimSpace(req.Username), reason), r)
+		respondWithError(w, http.StatusTooManyRequests, "Too many failed login attempts. Try again later.")
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), handlerTimeout)
 	defer cancel()
 
 	user, err := h.db.GetUserByUsernameCtx(ctx, req.Username)
 	if err != nil {
 		h.logAuditEvent(nil, "LOGIN_FAIL", fmt.Sprintf("username=%s reason=user_not_found", strings.TrimSpace(req.Username)), r)
+		h.loginFailed(ip)
 		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
 	if !user.IsActive {
 		h.logAuditEvent(&user.ID, "LOGIN_FAIL", fmt.Sprintf("username=%s reason=inactive", user.Username), r)
+		h.loginFailed(ip)
 		respondWithError(w, http.StatusUnauthorized, "User account is inactive")
 		return
 	}
 
 	if !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
 		h.logAuditEvent(&user.ID, "LOGIN_FAIL", fmt.Sprintf("username=%s reason=invalid_password", user.Username), r)
+		h.loginFailed(ip)
 		respondWithError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 
 	if !user.IsAdmin {
 		h.logAuditEvent(&user.ID, "LOGIN_FAIL", fmt.Sprintf("username=%s reason=not_admin", user.Username), r)
+		h.loginFailed(ip)
 		respondWithError(w, http.StatusUnauthorized, "Admin access required")
 		return
 	}
@@ -162,6 +185,12 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, response)
 }
 
+// loginFailed counts a failed admin login. The response is not held back;
+// the login guard refuses the next attempts until their delay has passed.
+func (h *AuthHandler) loginFailed(ip string) {
+	h.guard.Failed(ip, "admin")
+}
+
 func (h *AuthHandler) logAuditEvent(userID *int, action, details string, r *http.Request) {
 	h.db.LogAdminAction(userID, action, details, getRequestIP(r))
 }
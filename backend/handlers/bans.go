@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/guard"
+	"proxy-server/middleware"
+	"proxy-server/models"
+)
+
+// BansHandler lists and lifts the bans placed after repeated failed logins.
+type BansHandler struct {
+	db    *database.Database
+	guard *guard.LoginGuard
+}
+
+func NewBansHandler(db *database.Database, loginGuard *guard.LoginGuard) *BansHandler {
+	return &BansHandler{db: db, guard: loginGuard}
+}
+
+func (h *BansHandler) GetBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := h.guard.Bans()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to load bans")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, bans)
+}
+
+func (h *BansHandler) DeleteBan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ban ID")
+		return
+	}
+
+	ban, err := h.guard.Lift(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Ban not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to lift ban")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Lifted ban of %s %s (id=%d, until %s)", ban.Kind, ban.Value, ban.ID, ban.ExpiresAt.Format(time.RFC3339))
+		h.db.LogAdminAction(&actor.ID, "AUTH_BAN_LIFT", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Ban lifted"})
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/middleware"
+	"proxy-server/models"
+)
+
+type ConnectionsHandler struct {
+	db    *database.Database
+	proxy ProxyControl
+}
+
+func NewConnectionsHandler(db *database.Database, proxy ProxyControl) *ConnectionsHandler {
+	return &ConnectionsHandler{db: db, proxy: proxy}
+}
+
+// GetConnections lists open proxy connections, optionally only those of
+// the user given by user_id.
+func (h *ConnectionsHandler) GetConnections(w http.ResponseWriter, r *http.Request) {
+	userID := 0
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+			return
+		}
+		userID = id
+	}
+
+	conns := make([]models.ActiveConnection, 0)
+	for _, conn := range h.proxy.ActiveConnections() {
+		if userID == 0 || conn.UserID == userID {
+			conns = append(conns, conn)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, conns)
+}
+
+func (h *ConnectionsHandler) TerminateConnection(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid connection ID")
+		return
+	}
+
+	var target *models.ActiveConnection
+	for _, conn := range h.proxy.ActiveConnections() {
+		if conn.ID == id {
+			target = &conn
+			break
+		}
+	}
+	if target == nil || !h.proxy.TerminateConnection(id) {
+		respondWithError(w, http.StatusNotFound, "Connection not found")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Terminated connection %d of %s (id=%d) %s %s from %s", target.ID, target.Username, target.UserID, target.Method, target.Target, target.ClientIP)
+		h.db.LogAdminAction(&actor.ID, "CONNECTION_TERMINATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Connection terminated"})
+}
+
+// TerminateUserConnections closes every open connection of a user.
+func (h *ConnectionsHandler) TerminateUserConnections(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	closed := h.proxy.TerminateUserConnections(id)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Terminated %d connections of user id=%d", closed, id)
+		h.db.LogAdminAction(&actor.ID, "USER_CONNECTIONS_TERMINATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"terminated": closed,
+		"message":    fmt.Sprintf("Terminated %d connections", closed),
+	})
+}
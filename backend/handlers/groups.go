@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/middleware"
+	"proxy-server/models"
+	"proxy-server/schedule"
+)
+
+type GroupsHandler struct {
+	db    *database.Database
+	proxy ProxyControl
+}
+
+func NewGroupsHandler(db *database.Database, proxy ProxyControl) *GroupsHandler {
+	return &GroupsHandler{db: db, proxy: proxy}
+}
+
+func (h *GroupsHandler) GetGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.db.GetGroups()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch groups")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+func (h *GroupsHandler) GetGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	group, err := h.db.GetGroup(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, group)
+}
+
+func (h *GroupsHandler) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req models.GroupCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Group name is required")
+		return
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	req.ProxyType = normalizeProxyType(req.ProxyType)
+
+	accessSchedule, err := schedule.Normalize(req.Schedule)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("schedule: %v", err))
+		return
+	}
+	req.Schedule = accessSchedule
+
+	if err := validateProxyLists(req.Whitelist, req.Blacklist); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hasNegative(&req.QuotaDailyBytes, &req.QuotaMonthlyBytes, &req.QuotaDailyRequests, &req.QuotaMonthlyRequests) {
+		respondWithError(w, http.StatusBadRequest, "Quotas must be zero (unlimited) or positive")
+		return
+	}
+	if msg := h.validateMembers(req.MemberIDs); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if msg := validateHostListRefs(h.db, req.WhitelistLists, req.BlacklistLists); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	group, err := h.db.CreateGroup(&req)
+	if err != nil {
+		if database.IsConstraintError(err) {
+			respondWithError(w, http.StatusConflict, "Group name already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to create group")
+		return
+	}
+	h.invalidateMembers(group.MemberIDs)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Created group %s (id=%d) state=%s", group.Name, group.ID, formatAuditJSON(buildGroupAuditSnapshot(group)))
+		h.db.LogAdminAction(&actor.ID, "GROUP_CREATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusCreated, group)
+}
+
+func (h *GroupsHandler) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	original, err := h.db.GetGroup(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	var req models.GroupUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			respondWithError(w, http.StatusBadRequest, "Group name is required")
+			return
+		}
+		req.Name = &name
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		req.Description = &description
+	}
+	if req.ProxyType != nil {
+		normalized := normalizeProxyType(*req.ProxyType)
+		req.ProxyType = &normalized
+	}
+
+	if req.Schedule != nil {
+		accessSchedule, err := schedule.Normalize(*req.Schedule)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("schedule: %v", err))
+			return
+		}
+		req.Schedule = &accessSchedule
+	}
+
+	if hasNegative(req.QuotaDailyBytes, req.QuotaMonthlyBytes, req.QuotaDailyRequests, req.QuotaMonthlyRequests) {
+		respondWithError(w, http.StatusBadRequest, "Quotas must be zero (unlimited) or positive")
+		return
+	}
+	if req.MemberIDs != nil {
+		if msg := h.validateMembers(*req.MemberIDs); msg != "" {
+			respondWithError(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	if msg := validateHostListRefs(h.db, derefInts(req.WhitelistLists), derefInts(req.BlacklistLists)); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if err := h.db.UpdateGroup(id, &req); err != nil {
+		if errors.Is(err, database.ErrInvalidProxyEntry) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if database.IsConstraintError(err) {
+			respondWithError(w, http.StatusConflict, "Group name already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to update group")
+		return
+	}
+
+	group, err := h.db.GetGroup(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch updated group")
+		return
+	}
+	// Members that left the group lose its policy as well.
+	h.invalidateMembers(original.MemberIDs)
+	h.invalidateMembers(group.MemberIDs)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		payload := map[string]interface{}{
+			"before": buildGroupAuditSnapshot(original),
+			"after":  buildGroupAuditSnapshot(group),
+		}
+		details := fmt.Sprintf("Updated group %s (id=%d) diff=%s", group.Name, group.ID, formatAuditJSON(payload))
+		h.db.LogAdminAction(&actor.ID, "GROUP_UPDATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, group)
+}
+
+func (h *GroupsHandler) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+
+	group, err := h.db.GetGroup(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+
+	if err := h.db.DeleteGroup(id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete group")
+		return
+	}
+	h.invalidateMembers(group.MemberIDs)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Deleted group %s (id=%d) previous_state=%s", group.Name, group.ID, formatAuditJSON(buildGroupAuditSnapshot(group)))
+		h.db.LogAdminAction(&actor.ID, "GROUP_DELETE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Group deleted successfully"})
+}
+
+// validateMembers returns an error message when memberIDs names a user
+// that does not exist.
+func (h *GroupsHandler) validateMembers(memberIDs []int) string {
+	missing, err := h.db.MissingUserIDs(memberIDs)
+	if err != nil {
+		return "Failed to check group members"
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("member_ids: unknown user %d", missing[0])
+	}
+	return ""
+}
+
+func (h *GroupsHandler) invalidateMembers(memberIDs []int) {
+	for _, id := range memberIDs {
+		h.proxy.InvalidateUser(id)
+	}
+}
+
+func buildGroupAuditSnapshot(group *models.Group) map[string]interface{} {
+	if group == nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"name":            group.Name,
+		"description":     group.Description,
+		"priority":        group.Priority,
+		"proxy_type":      group.ProxyType,
+		"whitelist":       group.Whitelist,
+		"blacklist":       group.Blacklist,
+		"whitelist_lists": group.WhitelistLists,
+		"blacklist_lists": group.BlacklistLists,
+		"schedule":        group.Schedule,
+		"quota":           group.UserQuota,
+		"members":         group.MemberIDs,
+		"created_at":      group.CreatedAt,
+		"updated_at":      group.UpdatedAt,
+	}
+}
@@ -2,21 +2,15 @@ package handlers
 
 import (
 	"encoding/json"
-	"net"
 	"net/http"
-	"strings"
+
+	"proxy-server/middleware"
 )
 
+// getRequestIP returns the client address used for login protection and
+// the audit log.
 func getRequestIP(r *http.Request) string {
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		parts := strings.Split(forwarded, ",")
-		return strings.TrimSpace(parts[0])
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
+	return middleware.GetClientIP(r)
 }
 
 func formatAuditJSON(payload interface{}) string {
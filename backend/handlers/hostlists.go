@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/hostlist"
+	"proxy-server/middleware"
+	"proxy-server/models"
+)
+
+type HostListsHandler struct {
+	db        *database.Database
+	proxy     ProxyControl
+	fetcher   *hostlist.Fetcher
+	refresher *hostlist.Refresher
+}
+
+func NewHostListsHandler(db *database.Database, proxy ProxyControl, fetcher *hostlist.Fetcher, refresher *hostlist.Refresher) *HostListsHandler {
+	return &HostListsHandler{db: db, proxy: proxy, fetcher: fetcher, refresher: refresher}
+}
+
+func (h *HostListsHandler) GetHostLists(w http.ResponseWriter, r *http.Request) {
+	lists, err := h.db.GetHostLists()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch host lists")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, lists)
+}
+
+func (h *HostListsHandler) GetHostList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid host list ID")
+		return
+	}
+
+	list, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Host list not found")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+func (h *HostListsHandler) CreateHostList(w http.ResponseWriter, r *http.Request) {
+	var req models.HostListCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+	req.Source = strings.TrimSpace(req.Source)
+	req.Format = normalizeHostListFormat(req.Format)
+	if req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Host list name is required")
+		return
+	}
+	if msg := h.validateHostList(req.Source, req.Format, req.RefreshMinutes, req.Entries != nil); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	skipped := 0
+	if req.Source != "" {
+		entries, n, err := h.fetcher.Load(r.Context(), req.Source, req.Format)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("source: %v", err))
+			return
+		}
+		req.Entries, skipped = entries, n
+	}
+
+	list, err := h.db.CreateHostList(&req, skipped)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidProxyEntry) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if database.IsConstraintError(err) {
+			respondWithError(w, http.StatusConflict, "Host list name already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to create host list")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Created host list %s (id=%d) state=%s", list.Name, list.ID, formatAuditJSON(buildHostListAuditSnapshot(list)))
+		h.db.LogAdminAction(&actor.ID, "HOST_LIST_CREATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusCreated, list)
+}
+
+func (h *HostListsHandler) UpdateHostList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid host list ID")
+		return
+	}
+
+	original, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Host list not found")
+		return
+	}
+
+	var req models.HostListUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	source, format, refresh := original.Source, original.Format, original.RefreshMinutes
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			respondWithError(w, http.StatusBadRequest, "Host list name is required")
+			return
+		}
+		req.Name = &name
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		req.Description = &description
+	}
+	if req.Source != nil {
+		source = strings.TrimSpace(*req.Source)
+		req.Source = &source
+	}
+	if req.Format != nil {
+		format = normalizeHostListFormat(*req.Format)
+		req.Format = &format
+	}
+	if req.RefreshMinutes != nil {
+		refresh = *req.RefreshMinutes
+	}
+	if msg := h.validateHostList(source, format, refresh, req.Entries != nil); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	// A new source or format is read before anything is saved, so a list
+	// never points at a source that cannot be imported.
+	var entries []string
+	skipped := 0
+	reimport := source != "" && (source != original.Source || format != original.Format)
+	if reimport {
+		if entries, skipped, err = h.fetcher.Load(r.Context(), source, format); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("source: %v", err))
+			return
+		}
+	}
+
+	if err := h.db.UpdateHostList(id, &req); err != nil {
+		if errors.Is(err, database.ErrInvalidProxyEntry) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if database.IsConstraintError(err) {
+			respondWithError(w, http.StatusConflict, "Host list name already exists")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Failed to update host list")
+		return
+	}
+	if reimport {
+		if _, err := h.db.ReplaceHostListEntries(id, entries, skipped); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to store host list entries")
+			return
+		}
+	}
+	h.proxy.InvalidateAll()
+
+	list, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch updated host list")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		payload := map[string]interface{}{
+			"before": buildHostListAuditSnapshot(original),
+			"after":  buildHostListAuditSnapshot(list),
+		}
+		details := fmt.Sprintf("Updated host list %s (id=%d) diff=%s", list.Name, list.ID, formatAuditJSON(payload))
+		h.db.LogAdminAction(&actor.ID, "HOST_LIST_UPDATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+func (h *HostListsHandler) DeleteHostList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid host list ID")
+		return
+	}
+
+	list, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Host list not found")
+		return
+	}
+
+	if err := h.db.DeleteHostList(id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete host list")
+		return
+	}
+	h.proxy.InvalidateAll()
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Deleted host list %s (id=%d) previous_state=%s", list.Name, list.ID, formatAuditJSON(buildHostListAuditSnapshot(list)))
+		h.db.LogAdminAction(&actor.ID, "HOST_LIST_DELETE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Host list deleted successfully"})
+}
+
+// RefreshHostList re-imports a list from its source without waiting for
+// its refresh interval.
+func (h *HostListsHandler) RefreshHostList(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid host list ID")
+		return
+	}
+
+	list, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Host list not found")
+		return
+	}
+	if list.Source == "" {
+		respondWithError(w, http.StatusBadRequest, "Host list has no source to refresh from")
+		return
+	}
+
+	if err := h.refresher.Refresh(r.Context(), list); err != nil {
+		respondWithError(w, http.StatusBadGateway, fmt.Sprintf("Failed to refresh host list: %v", err))
+		return
+	}
+
+	refreshed, err := h.db.GetHostList(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch refreshed host list")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Refreshed host list %s (id=%d) revision=%d entries=%d", refreshed.Name, refreshed.ID, refreshed.Revision, refreshed.EntryCount)
+		h.db.LogAdminAction(&actor.ID, "HOST_LIST_REFRESH", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, refreshed)
+}
+
+func normalizeHostListFormat(value string) string {
+	if v := strings.ToLower(strings.TrimSpace(value)); v != "" {
+		return v
+	}
+	return hostlist.FormatAuto
+}
+
+func (h *HostListsHandler) validateHostList(source, format string, refreshMinutes int, hasEntries bool) string {
+	if !hostlist.ValidFormat(format) {
+		return fmt.Sprintf("Unknown format %q (use auto, hosts, domains or adblock)", format)
+	}
+	if refreshMinutes < 0 {
+		return "refresh_minutes must be zero (manual) or positive"
+	}
+	if source == "" {
+		if refreshMinutes > 0 {
+			return "refresh_minutes requires a source"
+		}
+		return ""
+	}
+	if err := h.fetcher.ValidateSource(source); err != nil {
+		return fmt.Sprintf("source: %v", err)
+	}
+	if hasEntries {
+		return "entries cannot be set on a list imported from a source"
+	}
+	return ""
+}
+
+// validateHostListRefs returns an error message when a user or group names
+// a host list that does not exist.
+func validateHostListRefs(db *database.Database, whitelistLists, blacklistLists []int) string {
+	for _, refs := range []struct {
+		field string
+		ids   []int
+	}{
+		{"whitelist_lists", whitelistLists},
+		{"blacklist_lists", blacklistLists},
+	} {
+		missing, err := db.MissingHostListIDs(refs.ids)
+		if err != nil {
+			return "Failed to check host lists"
+		}
+		if len(missing) > 0 {
+			return fmt.Sprintf("%s: unknown host list %d", refs.field, missing[0])
+		}
+	}
+	return ""
+}
+
+func buildHostListAuditSnapshot(list *models.HostList) map[string]interface{} {
+	if list == nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"name":            list.Name,
+		"description":     list.Description,
+		"source":          list.Source,
+		"format":          list.Format,
+		"refresh_minutes": list.RefreshMinutes,
+		"revision":        list.Revision,
+		"entry_count":     list.EntryCount,
+		"entries":         list.Entries,
+		"created_at":      list.CreatedAt,
+		"updated_at":      list.UpdatedAt,
+	}
+}
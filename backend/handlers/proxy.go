@@ -0,0 +1,17 @@
+package handlers
+
+import "proxy-server/models"
+
+// ProxyControl is the part of the running proxy the admin API acts on.
+// Handlers call it after changes that must reach the proxy immediately.
+type ProxyControl interface {
+	InvalidateUser(userID int)
+	InvalidateAll()
+	CacheStats() models.CacheStats
+	CACertificate() ([]byte, error)
+	HTTPCacheStats() models.HTTPCacheStats
+	PurgeHTTPCache(url, host string) int
+	ActiveConnections() []models.ActiveConnection
+	TerminateConnection(id uint64) bool
+	TerminateUserConnections(userID int) int
+}
@@ -13,15 +13,17 @@ import (
 	"github.com/xuri/excelize/v2"
 
 	"proxy-server/database"
+	"proxy-server/middleware"
 	"proxy-server/models"
 )
 
 type StatsHandler struct {
-	db *database.Database
+	db    *database.Database
+	proxy ProxyControl
 }
 
-func NewStatsHandler(db *database.Database) *StatsHandler {
-	return &StatsHandler{db: db}
+func NewStatsHandler(db *database.Database, proxy ProxyControl) *StatsHandler {
+	return &StatsHandler{db: db, proxy: proxy}
 }
 
 func (h *StatsHandler) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
@@ -57,6 +59,66 @@ func (h *StatsHandler) GetTrafficStats(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, stats)
 }
 
+func (h *StatsHandler) GetQuotaStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, err := h.db.GetQuotaStatuses()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch quota status")
+		return
+	}
+	if statuses == nil {
+		statuses = []models.QuotaStatus{}
+	}
+
+	respondWithJSON(w, http.StatusOK, statuses)
+}
+
+func (h *StatsHandler) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, h.proxy.CacheStats())
+}
+
+func (h *StatsHandler) GetHTTPCacheStats(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, h.proxy.HTTPCacheStats())
+}
+
+type purgeHTTPCacheRequest struct {
+	URL  string `json:"url"`
+	Host string `json:"host"`
+	All  bool   `json:"all"`
+}
+
+// PurgeHTTPCache removes cached responses for a URL, for every URL of a
+// host, or everything when all is set.
+func (h *StatsHandler) PurgeHTTPCache(w http.ResponseWriter, r *http.Request) {
+	var req purgeHTTPCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	req.Host = strings.TrimSpace(req.Host)
+	if req.URL == "" && req.Host == "" && !req.All {
+		respondWithError(w, http.StatusBadRequest, "Specify url, host or all")
+		return
+	}
+	if req.URL != "" && req.Host != "" {
+		respondWithError(w, http.StatusBadRequest, "Specify either url or host, not both")
+		return
+	}
+
+	removed := h.proxy.PurgeHTTPCache(req.URL, req.Host)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Purged %d cached responses url=%q host=%q all=%t", removed, req.URL, req.Host, req.All)
+		h.db.LogAdminAction(&actor.ID, "HTTP_CACHE_PURGE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"removed": removed,
+		"message": fmt.Sprintf("Removed %d cached responses", removed),
+	})
+}
+
 func (h *StatsHandler) GetRequestLogs(w http.ResponseWriter, r *http.Request) {
 	filters, err := parseLogFiltersFromRequest(r)
 	if err != nil {
@@ -127,6 +189,7 @@ func parseLogFiltersFromRequest(r *http.Request) (*models.LogFilterOptions, erro
 	filters := &models.LogFilterOptions{
 		Method:      q.Get("method"),
 		URLContains: q.Get("url"),
+		CacheStatus: q.Get("cache_status"),
 		SortBy:      q.Get("sort_by"),
 		SortOrder:   q.Get("sort_order"),
 		Limit:       parseLimit(q.Get("limit"), 100),
@@ -2,16 +2,24 @@ package handlers
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"time"
+
+	"proxy-server/models"
 )
 
-type SystemHandler struct{}
+type SystemHandler struct {
+	proxy ProxyControl
+}
 
-func NewSystemHandler() *SystemHandler {
-	return &SystemHandler{}
+func NewSystemHandler(proxy ProxyControl) *SystemHandler {
+	return &SystemHandler{proxy: proxy}
 }
 
+// GetPublicIP reports the server's public address as seen from outside,
+// together with the local addresses users can be given as egress
+// addresses.
 func (h *SystemHandler) GetPublicIP(w http.ResponseWriter, r *http.Request) {
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Get("https://api.ipify.org?format=json")
@@ -34,5 +42,66 @@ func (h *SystemHandler) GetPublicIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"ip": payload.IP})
+	addresses, err := localEgressAddresses()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to list local addresses")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"ip":               payload.IP,
+		"egress_addresses": addresses,
+	})
+}
+
+// localEgressAddresses lists the addresses of the interfaces that are up,
+// which users can be assigned as egress addresses. Loopback and link-local
+// addresses are left out.
+func localEgressAddresses() ([]models.EgressAddress, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []models.EgressAddress{}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			family := "ipv6"
+			if ipNet.IP.To4() != nil {
+				family = "ipv4"
+			}
+			addresses = append(addresses, models.EgressAddress{
+				Address:   ipNet.IP.String(),
+				Family:    family,
+				Interface: iface.Name,
+			})
+		}
+	}
+	return addresses, nil
+}
+
+// GetMITMCA serves the TLS interception CA certificate for installation
+// on client devices.
+func (h *SystemHandler) GetMITMCA(w http.ResponseWriter, r *http.Request) {
+	cert, err := h.proxy.CACertificate()
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, "TLS interception CA is not available")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="progzy-ca.crt"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(cert)
 }
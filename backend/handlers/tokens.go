@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/middleware"
+	"proxy-server/models"
+	"proxy-server/utils"
+)
+
+const maxTokenNameLength = 255
+
+// TokensHandler manages the proxy API tokens of users.
+type TokensHandler struct {
+	db    *database.Database
+	proxy ProxyControl
+}
+
+func NewTokensHandler(db *database.Database, proxy ProxyControl) *TokensHandler {
+	return &TokensHandler{db: db, proxy: proxy}
+}
+
+func (h *TokensHandler) GetTokens(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if _, err := h.db.GetUserByID(userID); err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	tokens, err := h.db.GetProxyTokens(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch tokens")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+// CreateToken issues a proxy token for a user. The token is part of this
+// response only; afterwards just its hint is shown.
+func (h *TokensHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if user.IsAdmin {
+		respondWithError(w, http.StatusBadRequest, "Admin accounts cannot use the proxy")
+		return
+	}
+
+	var req models.ProxyTokenCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTokenNameLength {
+		respondWithError(w, http.StatusBadRequest, "Token name is required (up to 255 characters)")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	token, hint, err := utils.GenerateProxyToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	created, err := h.db.CreateProxyToken(userID, &req, utils.HashProxyToken(token), hint)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create token")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Created proxy token %q (id=%d, %s) for %s (id=%d) expires=%s",
+			created.Name, created.ID, created.Hint, user.Username, user.ID, formatTokenExpiry(created.ExpiresAt))
+		h.db.LogAdminAction(&actor.ID, "PROXY_TOKEN_CREATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusCreated, models.ProxyTokenCreated{ProxyToken: *created, Token: token})
+}
+
+// DeleteToken revokes a token. Logins with it are refused from the next
+// request on.
+func (h *TokensHandler) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	tokenID, err := strconv.Atoi(vars["tokenId"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	deleted, err := h.db.DeleteProxyToken(userID, tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		respondWithError(w, http.StatusNotFound, "Token not found")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
+	h.proxy.InvalidateUser(userID)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Revoked proxy token %q (id=%d, %s) of user id=%d", deleted.Name, deleted.ID, deleted.Hint, userID)
+		h.db.LogAdminAction(&actor.ID, "PROXY_TOKEN_REVOKE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Token revoked"})
+}
+
+func formatTokenExpiry(expiresAt *time.Time) string {
+	if expiresAt == nil {
+		return "never"
+	}
+	return expiresAt.Format(time.RFC3339)
+}
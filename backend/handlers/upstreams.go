@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"proxy-server/database"
+	"proxy-server/middleware"
+	"proxy-server/models"
+	"proxy-server/rules"
+	"proxy-server/utils"
+)
+
+type UpstreamsHandler struct {
+	db    *database.Database
+	proxy ProxyControl
+}
+
+var allowedUpstreamTypes = map[string]struct{}{
+	"http":   {},
+	"socks5": {},
+}
+
+func NewUpstreamsHandler(db *database.Database, proxy ProxyControl) *UpstreamsHandler {
+	return &UpstreamsHandler{db: db, proxy: proxy}
+}
+
+func (h *UpstreamsHandler) GetUpstreams(w http.ResponseWriter, r *http.Request) {
+	upstreams, err := h.db.GetUpstreamProxies()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch upstream proxies")
+		return
+	}
+	if upstreams == nil {
+		upstreams = []models.UpstreamProxy{}
+	}
+
+	respondWithJSON(w, http.StatusOK, upstreams)
+}
+
+func (h *UpstreamsHandler) CreateUpstream(w http.ResponseWriter, r *http.Request) {
+	var req models.UpstreamProxyCreate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	req.Type = strings.ToLower(strings.TrimSpace(req.Type))
+	req.Address = strings.TrimSpace(req.Address)
+	req.Pool = strings.TrimSpace(req.Pool)
+	if req.Type == "" {
+		req.Type = "http"
+	}
+	if req.Pool == "" {
+		req.Pool = req.Name
+	}
+
+	if msg := validateUpstream(req.Name, req.Type, req.Address, req.Pool); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	encrypted := ""
+	if req.Password != "" {
+		var err error
+		encrypted, err = utils.EncryptSecret(req.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to secure upstream password")
+			return
+		}
+	}
+
+	upstream, err := h.db.CreateUpstreamProxy(&req, encrypted)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upstream proxy")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Created upstream %s (id=%d) state=%s", upstream.Name, upstream.ID, formatAuditJSON(buildUpstreamAuditSnapshot(upstream)))
+		h.db.LogAdminAction(&actor.ID, "UPSTREAM_CREATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusCreated, upstream)
+}
+
+func (h *UpstreamsHandler) UpdateUpstream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upstream ID")
+		return
+	}
+
+	original, err := h.db.GetUpstreamProxy(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upstream proxy not found")
+		return
+	}
+
+	var req models.UpstreamProxyUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	name, typ, address, pool := original.Name, original.Type, original.Address, original.Pool
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		req.Name = &name
+	}
+	if req.Type != nil {
+		typ = strings.ToLower(strings.TrimSpace(*req.Type))
+		req.Type = &typ
+	}
+	if req.Address != nil {
+		address = strings.TrimSpace(*req.Address)
+		req.Address = &address
+	}
+	if req.Pool != nil {
+		pool = strings.TrimSpace(*req.Pool)
+		req.Pool = &pool
+	}
+	if msg := validateUpstream(name, typ, address, pool); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if req.Password != nil && *req.Password != "" {
+		encrypted, err := utils.EncryptSecret(*req.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to secure upstream password")
+			return
+		}
+		req.Password = &encrypted
+	}
+
+	if err := h.db.UpdateUpstreamProxy(id, &req); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to update upstream proxy")
+		return
+	}
+
+	upstream, err := h.db.GetUpstreamProxy(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch updated upstream proxy")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		payload := map[string]interface{}{
+			"before":           buildUpstreamAuditSnapshot(original),
+			"after":            buildUpstreamAuditSnapshot(upstream),
+			"password_changed": req.Password != nil,
+		}
+		details := fmt.Sprintf("Updated upstream %s (id=%d) diff=%s", upstream.Name, upstream.ID, formatAuditJSON(payload))
+		h.db.LogAdminAction(&actor.ID, "UPSTREAM_UPDATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, upstream)
+}
+
+func (h *UpstreamsHandler) DeleteUpstream(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upstream ID")
+		return
+	}
+
+	upstream, err := h.db.GetUpstreamProxy(id)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Upstream proxy not found")
+		return
+	}
+
+	if err := h.db.DeleteUpstreamProxy(id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete upstream proxy")
+		return
+	}
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Deleted upstream %s (id=%d) previous_state=%s", upstream.Name, upstream.ID, formatAuditJSON(buildUpstreamAuditSnapshot(upstream)))
+		h.db.LogAdminAction(&actor.ID, "UPSTREAM_DELETE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Upstream proxy deleted successfully"})
+}
+
+func (h *UpstreamsHandler) GetRules(w http.ResponseWriter, r *http.Request) {
+	upstreamRules, err := h.db.GetUpstreamRules(nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch upstream rules")
+		return
+	}
+	if upstreamRules == nil {
+		upstreamRules = []models.UpstreamRule{}
+	}
+
+	respondWithJSON(w, http.StatusOK, upstreamRules)
+}
+
+func (h *UpstreamsHandler) CreateRule(w http.ResponseWriter, r *http.Request) {
+	var req models.UpstreamRule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Pool = strings.TrimSpace(req.Pool)
+	if strings.TrimSpace(req.Pattern) == "" || req.Pool == "" {
+		respondWithError(w, http.StatusBadRequest, "Pattern and pool are required")
+		return
+	}
+	pattern, err := rules.Normalize(req.Pattern)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid pattern: %v", err))
+		return
+	}
+	req.Pattern = pattern
+	if req.UserID != nil {
+		if _, err := h.db.GetUserByID(*req.UserID); err != nil {
+			respondWithError(w, http.StatusBadRequest, "User not found")
+			return
+		}
+	}
+
+	rule, err := h.db.CreateUpstreamRule(&req)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create upstream rule")
+		return
+	}
+	h.invalidateRuleOwner(rule.UserID)
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		details := fmt.Sprintf("Created upstream rule id=%d state=%s", rule.ID, formatAuditJSON(rule))
+		h.db.LogAdminAction(&actor.ID, "UPSTREAM_RULE_CREATE", details, getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusCreated, rule)
+}
+
+func (h *UpstreamsHandler) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid rule ID")
+		return
+	}
+
+	if err := h.db.DeleteUpstreamRule(id); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete upstream rule")
+		return
+	}
+	h.proxy.InvalidateAll()
+
+	if actor := middleware.GetUserFromContext(r); actor != nil {
+		h.db.LogAdminAction(&actor.ID, "UPSTREAM_RULE_DELETE", fmt.Sprintf("Deleted upstream rule id=%d", id), getRequestIP(r))
+	}
+
+	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "Upstream rule deleted successfully"})
+}
+
+// invalidateRuleOwner refreshes cached policies affected by a rule: one
+// user's for a personal rule, everyone's for a global one.
+func (h *UpstreamsHandler) invalidateRuleOwner(userID *int) {
+	if userID != nil {
+		h.proxy.InvalidateUser(*userID)
+		return
+	}
+	h.proxy.InvalidateAll()
+}
+
+func validateUpstream(name, typ, address, pool string) string {
+	if name == "" {
+		return "Name is required"
+	}
+	if _, ok := allowedUpstreamTypes[typ]; !ok {
+		return "Type must be http or socks5"
+	}
+	if _, port, err := net.SplitHostPort(address); err != nil || port == "" {
+		return "Address must be in host:port format"
+	}
+	if pool == "" {
+		return "Pool is required"
+	}
+	if strings.EqualFold(pool, "direct") {
+		return "Pool name \"direct\" is reserved"
+	}
+	return ""
+}
+
+func buildUpstreamAuditSnapshot(upstream *models.UpstreamProxy) map[string]interface{} {
+	if upstream == nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"name":      upstream.Name,
+		"type":      upstream.Type,
+		"address":   upstream.Address,
+		"username":  upstream.Username,
+		"pool":      upstream.Pool,
+		"priority":  upstream.Priority,
+		"is_active": upstream.IsActive,
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -11,11 +12,13 @@ import (
 	"proxy-server/database"
 	"proxy-server/middleware"
 	"proxy-server/models"
+	"proxy-server/schedule"
 	"proxy-server/utils"
 )
 
 type UsersHandler struct {
-	db *database.Database
+	db    *database.Database
+	proxy ProxyControl
 }
 
 const minPasswordLength = 6
@@ -34,8 +37,18 @@ func normalizeProxyType(value string) string {
 	return "default"
 }
 
-func NewUsersHandler(db *database.Database) *UsersHandler {
-	return &UsersHandler{db: db}
+// normalizeEgressStrategy maps unknown strategies to round robin, as
+// normalizeProxyType does for proxy types.
+func normalizeEgressStrategy(value string) string {
+	v := strings.ToLower(strings.TrimSpace(value))
+	if database.ValidEgressStrategy(v) {
+		return v
+	}
+	return database.EgressStrategyRoundRobin
+}
+
+func NewUsersHandler(db *database.Database, proxy ProxyControl) *UsersHandler {
+	return &UsersHandler{db: db, proxy: proxy}
 }
 
 func (h *UsersHandler) GetAllUsers(w http.ResponseWriter, r *http.Request) {
@@ -81,7 +94,68 @@ func (h *UsersHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	req.ProxyType = normalizeProxyType(req.ProxyType)
+	if req.ProxyType != nil {
+		proxyType := normalizeProxyType(*req.ProxyType)
+		req.ProxyType = &proxyType
+	}
+	req.UpstreamPool = strings.TrimSpace(req.UpstreamPool)
+	req.EgressStrategy = normalizeEgressStrategy(req.EgressStrategy)
+	egressAddresses, err := database.NormalizeEgressAddresses(req.EgressAddresses)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("egress_addresses: %v", err))
+		return
+	}
+	req.EgressAddresses = egressAddresses
+
+	if req.Schedule != nil {
+		accessSchedule, err := schedule.Normalize(*req.Schedule)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("schedule: %v", err))
+			return
+		}
+		req.Schedule = &accessSchedule
+	}
+
+	if err := validateProxyLists(req.Whitelist, req.Blacklist); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateGroupExclusions(req.WhitelistExclusions, req.BlacklistExclusions); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hasNegative(req.QuotaDailyBytes, req.QuotaMonthlyBytes, req.QuotaDailyRequests, req.QuotaMonthlyRequests) {
+		respondWithError(w, http.StatusBadRequest, "Quotas must be zero (unlimited) or positive")
+		return
+	}
+	if hasNegative(&req.BandwidthUp, &req.BandwidthDown, &req.BandwidthBurst) {
+		respondWithError(w, http.StatusBadRequest, "Bandwidth limits must be zero (unlimited) or positive")
+		return
+	}
+	if hasNegativeInt(&req.MaxConnections, &req.RequestsPerSecond, &req.RequestsPerMinute) {
+		respondWithError(w, http.StatusBadRequest, "Connection and rate limits must be zero (unlimited) or positive")
+		return
+	}
+	if err := database.ValidateProxyEntries(req.EgressExceptions); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("egress_exceptions: %v", err))
+		return
+	}
+	if err := database.ValidateProxyEntries(req.MITMHosts); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("mitm_hosts: %v", err))
+		return
+	}
+	if _, err := database.NormalizeClientAddresses(req.ClientAllowlist); err != nil {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("client_allowlist: %v", err))
+		return
+	}
+	if msg := h.validateGroups(req.GroupIDs); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if msg := validateHostListRefs(h.db, req.WhitelistLists, req.BlacklistLists); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
 
 	hashedPassword, err := utils.HashPassword(req.Password)
 	if err != nil {
@@ -91,26 +165,12 @@ func (h *UsersHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 
 	user, err := h.db.CreateUser(&req, hashedPassword)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create user")
-		return
-	}
-
-	if !user.IsAdmin && (req.Whitelist != nil || req.Blacklist != nil) {
-		whitelist := req.Whitelist
-		blacklist := req.Blacklist
-		if whitelist == nil {
-			whitelist = []string{}
-		}
-		if blacklist == nil {
-			blacklist = []string{}
-		}
-		wl, bl, err := h.db.SetUserProxyLists(user.ID, whitelist, blacklist)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Failed to save proxy lists")
+		if errors.Is(err, database.ErrInvalidProxyEntry) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
 			return
 		}
-		user.Whitelist = wl
-		user.Blacklist = bl
+		respondWithError(w, http.StatusInternalServerError, "Failed to create user")
+		return
 	}
 
 	if actor := middleware.GetUserFromContext(r); actor != nil {
@@ -154,15 +214,82 @@ func (h *UsersHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		req.Password = &hashedPassword
 	}
 
-	if req.ProxyType != nil {
-		normalized := normalizeProxyType(*req.ProxyType)
-		req.ProxyType = &normalized
+	if req.ProxyType.Value != nil {
+		normalized := normalizeProxyType(*req.ProxyType.Value)
+		req.ProxyType.Value = &normalized
+	}
+
+	if req.UpstreamPool != nil {
+		pool := strings.TrimSpace(*req.UpstreamPool)
+		req.UpstreamPool = &pool
+	}
+
+	if req.EgressStrategy != nil {
+		strategy := normalizeEgressStrategy(*req.EgressStrategy)
+		req.EgressStrategy = &strategy
+	}
+
+	if req.EgressAddresses != nil {
+		addresses, err := database.NormalizeEgressAddresses(*req.EgressAddresses)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("egress_addresses: %v", err))
+			return
+		}
+		req.EgressAddresses = &addresses
+	}
+
+	if req.Schedule.Value != nil {
+		accessSchedule, err := schedule.Normalize(*req.Schedule.Value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("schedule: %v", err))
+			return
+		}
+		req.Schedule.Value = &accessSchedule
+	}
+
+	if req.ClientAllowlist != nil {
+		allowlist, err := database.NormalizeClientAddresses(*req.ClientAllowlist)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("client_allowlist: %v", err))
+			return
+		}
+		req.ClientAllowlist = &allowlist
+	}
+
+	if req.GroupIDs != nil {
+		if msg := h.validateGroups(*req.GroupIDs); msg != "" {
+			respondWithError(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	if msg := validateHostListRefs(h.db, derefInts(req.WhitelistLists), derefInts(req.BlacklistLists)); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	if hasNegative(req.QuotaDailyBytes.Value, req.QuotaMonthlyBytes.Value, req.QuotaDailyRequests.Value,
+		req.QuotaMonthlyRequests.Value) {
+		respondWithError(w, http.StatusBadRequest, "Quotas must be zero (unlimited) or positive")
+		return
+	}
+	if hasNegative(req.BandwidthUp, req.BandwidthDown, req.BandwidthBurst) {
+		respondWithError(w, http.StatusBadRequest, "Bandwidth limits must be zero (unlimited) or positive")
+		return
+	}
+	if hasNegativeInt(req.MaxConnections, req.RequestsPerSecond, req.RequestsPerMinute) {
+		respondWithError(w, http.StatusBadRequest, "Connection and rate limits must be zero (unlimited) or positive")
+		return
 	}
 
 	if err := h.db.UpdateUser(id, &req); err != nil {
+		if errors.Is(err, database.ErrInvalidProxyEntry) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Failed to update user")
 		return
 	}
+	h.proxy.InvalidateUser(id)
 
 	user, err := h.db.GetUserByID(id)
 	if err != nil {
@@ -201,6 +328,7 @@ func (h *UsersHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Failed to delete user")
 		return
 	}
+	h.proxy.InvalidateUser(id)
 
 	if actor := middleware.GetUserFromContext(r); actor != nil {
 		details := fmt.Sprintf("Deleted user %s (id=%d) previous_state=%s", user.Username, user.ID, formatAuditJSON(buildUserAuditSnapshot(user)))
@@ -210,21 +338,102 @@ func (h *UsersHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, models.SuccessResponse{Message: "User deleted successfully"})
 }
 
+// validateGroups returns an error message when groupIDs names a group that
+// does not exist.
+func (h *UsersHandler) validateGroups(groupIDs []int) string {
+	missing, err := h.db.MissingGroupIDs(groupIDs)
+	if err != nil {
+		return "Failed to check groups"
+	}
+	if len(missing) > 0 {
+		return fmt.Sprintf("group_ids: unknown group %d", missing[0])
+	}
+	return ""
+}
+
+// derefInts returns the list an update sets, or nil when it leaves it
+// unchanged.
+func derefInts(values *[]int) []int {
+	if values == nil {
+		return nil
+	}
+	return *values
+}
+
+func validateProxyLists(whitelist, blacklist []string) error {
+	if err := database.ValidateProxyEntries(whitelist); err != nil {
+		return fmt.Errorf("whitelist: %v", err)
+	}
+	if err := database.ValidateProxyEntries(blacklist); err != nil {
+		return fmt.Errorf("blacklist: %v", err)
+	}
+	return nil
+}
+
+// validateGroupExclusions checks the group entries a user excludes, which
+// use the whitelist and blacklist syntax.
+func validateGroupExclusions(whitelist, blacklist []string) error {
+	if err := database.ValidateProxyEntries(whitelist); err != nil {
+		return fmt.Errorf("whitelist_exclusions: %v", err)
+	}
+	if err := database.ValidateProxyEntries(blacklist); err != nil {
+		return fmt.Errorf("blacklist_exclusions: %v", err)
+	}
+	return nil
+}
+
+// hasNegative reports whether any of the given limits is negative. Nil
+// values are fields left unchanged by an update or inherited from groups.
+func hasNegative(values ...*int64) bool {
+	for _, v := range values {
+		if v != nil && *v < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNegativeInt(values ...*int) bool {
+	for _, v := range values {
+		if v != nil && *v < 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func buildUserAuditSnapshot(user *models.User) map[string]interface{} {
 	if user == nil {
 		return map[string]interface{}{}
 	}
 	return map[string]interface{}{
-		"username":   user.Username,
-		"email":      user.Email,
-		"comment":    user.Comment,
-		"is_admin":   user.IsAdmin,
-		"is_active":  user.IsActive,
-		"proxy_type": user.ProxyType,
-		"twofa":      user.TwoFAEnabled,
-		"whitelist":  user.Whitelist,
-		"blacklist":  user.Blacklist,
-		"created_at": user.CreatedAt,
-		"updated_at": user.UpdatedAt,
+		"username":         user.Username,
+		"email":            user.Email,
+		"comment":          user.Comment,
+		"is_admin":         user.IsAdmin,
+		"is_active":        user.IsActive,
+		"proxy_type":       user.ProxyType,
+		"upstream":         user.UpstreamPool,
+		"twofa":            user.TwoFAEnabled,
+		"whitelist":        user.Whitelist,
+		"blacklist":        user.Blacklist,
+		"whitelist_excl":   user.WhitelistExclusions,
+		"blacklist_excl":   user.BlacklistExclusions,
+		"whitelist_lists":  user.WhitelistLists,
+		"blacklist_lists":  user.BlacklistLists,
+		"egress":           user.EgressExceptions,
+		"mitm":             user.MITMEnabled,
+		"mitm_hosts":       user.MITMHosts,
+		"http_cache":       user.HTTPCache,
+		"egress_ips":       user.EgressAddresses,
+		"egress_rotation":  user.EgressStrategy,
+		"client_allowlist": user.ClientAllowlist,
+		"schedule":         user.Schedule,
+		"groups":           user.GroupIDs,
+		"quota":            user.QuotaOverride,
+		"bandwidth":        user.BandwidthLimit,
+		"limits":           user.RequestLimit,
+		"created_at":       user.CreatedAt,
+		"updated_at":       user.UpdatedAt,
 	}
 }
@@ -0,0 +1,381 @@
+// Package hostlist imports the named host lists that users and groups share
+// from URLs or local files, and keeps subscribed lists up to date.
+//
+// Sources may be written in any of these formats:
+//
+//	hosts     hosts files: "0.0.0.0 ads.example.com" blocks that exact host
+//	domains   one host ("example.com") or domain with its subdomains
+//	          (".example.com") per line
+//	adblock   Adblock-style domain rules: "||example.com^" blocks the domain
+//	          and its subdomains; rules with other options, exceptions and
+//	          cosmetic filters are skipped
+//	auto      decides per line between the three (the default)
+//
+// Lines starting with "#" or "!" are comments. Duplicate entries are
+// dropped; lines that cannot be used are counted as skipped.
+//
+// Sources are read by a Fetcher, which the caller configures with an HTTP
+// client that cannot reach restricted addresses and the one directory
+// local files may be read from.
+package hostlist
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"proxy-server/rules"
+)
+
+// Source formats.
+const (
+	FormatAuto    = "auto"
+	FormatHosts   = "hosts"
+	FormatDomains = "domains"
+	FormatAdblock = "adblock"
+)
+
+const (
+	// maxSourceBytes bounds what is read from one source.
+	maxSourceBytes = 64 << 20
+	maxLineBytes   = 64 << 10
+	fetchTimeout   = 2 * time.Minute
+	maxRedirects   = 10
+)
+
+// hostsBoilerplate are names found in most hosts files that are not part
+// of the list itself.
+var hostsBoilerplate = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// ValidFormat reports whether format is one of the source formats.
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatAuto, FormatHosts, FormatDomains, FormatAdblock:
+		return true
+	}
+	return false
+}
+
+// Fetcher reads list sources.
+type Fetcher struct {
+	// client fetches URLs. It is expected to refuse restricted
+	// destinations when dialing, which covers every redirect as well.
+	client *http.Client
+	// dir is the directory local files must be in; without one, file
+	// sources are refused.
+	dir string
+}
+
+// NewFetcher returns a Fetcher that fetches URLs with client and reads
+// files from below dir. Redirects are followed only to other http(s) URLs.
+func NewFetcher(client *http.Client, dir string) *Fetcher {
+	guarded := *client
+	guarded.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to unsupported URL %q", req.URL.Redacted())
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		return nil
+	}
+	if dir != "" {
+		dir = filepath.Clean(dir)
+	}
+	return &Fetcher{client: &guarded, dir: dir}
+}
+
+// ValidateSource checks that source is an http(s) URL or an absolute path
+// in the host list directory without reading it.
+func (f *Fetcher) ValidateSource(source string) error {
+	if isURL(source) {
+		if _, err := http.NewRequest(http.MethodGet, source, nil); err != nil {
+			return fmt.Errorf("invalid URL %q", source)
+		}
+		return nil
+	}
+	_, err := f.localPath(source)
+	return err
+}
+
+// localPath returns the file a source names, refusing any outside the
+// host list directory.
+func (f *Fetcher) localPath(source string) (string, error) {
+	path := strings.TrimPrefix(source, "file://")
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("must be an http(s) URL or an absolute file path")
+	}
+	if f.dir == "" {
+		return "", fmt.Errorf("local files are disabled; set HOST_LISTS_DIR to allow them")
+	}
+	path = filepath.Clean(path)
+	if !within(f.dir, path) {
+		return "", fmt.Errorf("file must be in %s", f.dir)
+	}
+	return path, nil
+}
+
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Load reads source and parses it in format. It returns the entries in
+// canonical rule syntax and the number of lines skipped.
+func (f *Fetcher) Load(ctx context.Context, source, format string) ([]string, int, error) {
+	if err := f.ValidateSource(source); err != nil {
+		return nil, 0, err
+	}
+	body, err := f.open(ctx, source)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+
+	limited := &io.LimitedReader{R: body, N: maxSourceBytes + 1}
+	entries, skipped, err := Parse(limited, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	if limited.N == 0 {
+		return nil, 0, fmt.Errorf("source is larger than %d MiB", maxSourceBytes>>20)
+	}
+	return entries, skipped, nil
+}
+
+func (f *Fetcher) open(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !isURL(source) {
+		return f.openFile(source)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "progzy-hostlist")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("fetching %s: %s", source, resp.Status)
+	}
+	return cancelOnClose{resp.Body, cancel}, nil
+}
+
+// openFile opens a local source. Symlinks are resolved before the
+// directory check so that a link cannot lead out of it.
+func (f *Fetcher) openFile(source string) (io.ReadCloser, error) {
+	path, err := f.localPath(source)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.EvalSymlinks(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if !within(dir, resolved) {
+		return nil, fmt.Errorf("file must be in %s", f.dir)
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return file, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Parse reads a list in format. It returns the entries in canonical rule
+// syntax without duplicates and the number of lines skipped.
+func Parse(r io.Reader, format string) ([]string, int, error) {
+	if !ValidFormat(format) {
+		return nil, 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	var entries []string
+	seen := make(map[string]struct{})
+	skipped := 0
+	add := func(entry string) {
+		if _, ok := seen[entry]; !ok {
+			seen[entry] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxLineBytes)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		lineFormat := format
+		if lineFormat == FormatAuto {
+			lineFormat = detectFormat(line)
+		}
+		var parsed []string
+		var ok bool
+		switch lineFormat {
+		case FormatHosts:
+			parsed, ok = parseHostsLine(line)
+		case FormatDomains:
+			parsed, ok = parseDomainLine(line)
+		case FormatAdblock:
+			parsed, ok = parseAdblockLine(line)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		for _, entry := range parsed {
+			add(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return entries, skipped, nil
+}
+
+func detectFormat(line string) string {
+	if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.Contains(line, "##") {
+		return FormatAdblock
+	}
+	if fields := strings.Fields(line); len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return FormatHosts
+	}
+	return FormatDomains
+}
+
+// parseHostsLine reads "address host [host...]". Every host is taken as an
+// exact host, which is how a hosts file applies.
+func parseHostsLine(line string) ([]string, bool) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, false
+	}
+	entries := []string{}
+	for _, host := range fields[1:] {
+		host = strings.ToLower(host)
+		if _, ok := hostsBoilerplate[host]; ok {
+			continue
+		}
+		rule, err := rules.Parse(host)
+		if err != nil || rule.Kind != rules.KindExact || rule.Port != 0 || rule.Path != "" {
+			return nil, false
+		}
+		entries = append(entries, rule.String())
+	}
+	return entries, true
+}
+
+// parseDomainLine reads a host ("example.com") or a domain with its
+// subdomains (".example.com"). The rest of the rule language, such as
+// regexes, address ranges, ports and paths, could widen a whitelist far
+// beyond what a subscribed list should, so it is skipped.
+func parseDomainLine(line string) ([]string, bool) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) != 1 {
+		return nil, false
+	}
+	rule, err := rules.Parse(fields[0])
+	if err != nil || rule.Port != 0 || rule.Path != "" {
+		return nil, false
+	}
+	if rule.Kind != rules.KindExact && rule.Kind != rules.KindDomain {
+		return nil, false
+	}
+	return []string{rule.String()}, true
+}
+
+// parseAdblockLine reads "||host^" with no options besides "important"
+// and "all". Rules restricted by other options cannot be applied to a
+// whole host without blocking more than intended, so they are skipped.
+func parseAdblockLine(line string) ([]string, bool) {
+	if !strings.HasPrefix(line, "||") {
+		return nil, false
+	}
+	host, rest, _ := strings.Cut(line[2:], "^")
+	rest = strings.TrimPrefix(rest, "|")
+	if rest != "" {
+		if !strings.HasPrefix(rest, "$") {
+			return nil, false
+		}
+		for _, option := range strings.Split(rest[1:], ",") {
+			if option != "important" && option != "all" {
+				return nil, false
+			}
+		}
+	}
+	rule, err := rules.Parse(host)
+	if err != nil || rule.Port != 0 || rule.Path != "" {
+		return nil, false
+	}
+	switch rule.Kind {
+	case rules.KindExact:
+		rule.Kind = rules.KindDomain
+	case rules.KindIP:
+	default:
+		return nil, false
+	}
+	return []string{rule.String()}, true
+}
+
+// stripComment removes a trailing "# comment".
+func stripComment(line string) string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		return line[:idx]
+	}
+	return line
+}
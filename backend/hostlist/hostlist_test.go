@@ -0,0 +1,185 @@
+package hostlist
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		format  string
+		input   string
+		want    []string
+		skipped int
+	}{
+		{
+			FormatHosts,
+			`# comment
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 0.0.0.0
+0.0.0.0 Ads.Example.com tracker.example.com # trailing comment
+0.0.0.0 ads.example.com
+0.0.0.0 *.wild.example.com
+0.0.0.0 host.example.com:8080
+ads.example.com
+`,
+			[]string{"ads.example.com", "tracker.example.com"},
+			3,
+		},
+		{
+			FormatDomains,
+			`! comment
+example.com
+  .Example.org  
+example.com # duplicate
+*.sub.example.com
+example.com:443
+example.com/admin
+10.0.0.0/8
+10.1.2.3
+re:^ads
+two words
+`,
+			[]string{"example.com", ".example.org"},
+			7,
+		},
+		{
+			FormatAdblock,
+			`[Adblock Plus 2.0]
+! comment
+||ads.example.com^
+||tracker.example.com^|
+||Metrics.example.com^$important,all
+||noanchor.example.com
+||192.0.2.1^
+||third.example.com^$third-party
+||script.example.com^$script,important
+@@||allowed.example.com^
+example.com##.banner
+||path.example.com/ads^
+||*.wild.example.com^
+||ads.example.com^
+`,
+			[]string{".ads.example.com", ".tracker.example.com", ".metrics.example.com", ".noanchor.example.com", "192.0.2.1"},
+			7,
+		},
+		{
+			FormatAuto,
+			`0.0.0.0 hosts.example.com
+.domain.example.com
+plain.example.com
+||adblock.example.com^
+@@||exception.example.com^
+example.com##.banner
+10.0.0.0/8
+`,
+			[]string{"hosts.example.com", ".domain.example.com", "plain.example.com", ".adblock.example.com"},
+			3,
+		},
+	}
+	for _, tt := range tests {
+		entries, skipped, err := Parse(strings.NewReader(tt.input), tt.format)
+		if err != nil {
+			t.Errorf("Parse(%s) failed: %v", tt.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, tt.want) || skipped != tt.skipped {
+			t.Errorf("Parse(%s) = %q, %d skipped; want %q, %d skipped", tt.format, entries, skipped, tt.want, tt.skipped)
+		}
+	}
+
+	if _, _, err := Parse(strings.NewReader("example.com"), "csv"); err == nil {
+		t.Errorf("Parse with an unknown format succeeded")
+	}
+	if _, _, err := Parse(strings.NewReader(strings.Repeat("a", maxLineBytes+1)), FormatDomains); err == nil {
+		t.Errorf("Parse of an overlong line succeeded")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"||example.com^", FormatAdblock},
+		{"@@||example.com^", FormatAdblock},
+		{"example.com##.banner", FormatAdblock},
+		{"0.0.0.0 example.com", FormatHosts},
+		{"::1 localhost", FormatHosts},
+		{"example.com", FormatDomains},
+		{".example.com", FormatDomains},
+		{"10.0.0.1", FormatDomains},
+		{"example.com other.com", FormatDomains},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(tt.line); got != tt.want {
+			t.Errorf("detectFormat(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseDomainLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"EXAMPLE.com", "example.com", true},
+		{".example.com", ".example.com", true},
+		{"example.com # note", "example.com", true},
+		{"example.com/", "example.com", true},
+		{"example.com/admin", "", false},
+		{"example.com:8080", "", false},
+		{"[2001:db8::1]:443", "", false},
+		{"*.example.com", "", false},
+		{"re:.*", "", false},
+		{`re:^ads\d+`, "", false},
+		{"0.0.0.0/0", "", false},
+		{"10.0.0.1", "", false},
+		{"http://example.com", "", false},
+		{"# comment only", "", false},
+	}
+	for _, tt := range tests {
+		entries, ok := parseDomainLine(tt.line)
+		if ok != tt.ok || (ok && (len(entries) != 1 || entries[0] != tt.want)) {
+			t.Errorf("parseDomainLine(%q) = %q, %v; want %q, %v", tt.line, entries, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	f := NewFetcher(http.DefaultClient, "/srv/lists/")
+	tests := []struct {
+		source string
+		ok     bool
+	}{
+		{"https://example.com/hosts.txt", true},
+		{"http://example.com/list", true},
+		{"/srv/lists/ads.txt", true},
+		{"file:///srv/lists/sub/ads.txt", true},
+		{"/srv/lists/sub/../ads.txt", true},
+		{"/srv/lists", true},
+		{"/srv/lists/../secrets", false},
+		{"/srv/lists/../../etc/passwd", false},
+		{"/srv/listsx/ads.txt", false},
+		{"/etc/passwd", false},
+		{"file:///etc/passwd", false},
+		{"lists/ads.txt", false},
+		{"../ads.txt", false},
+		{"ftp://example.com/list", false},
+		{"https://exa mple.com/", false},
+	}
+	for _, tt := range tests {
+		if err := f.ValidateSource(tt.source); (err == nil) != tt.ok {
+			t.Errorf("ValidateSource(%q) = %v, want ok %v", tt.source, err, tt.ok)
+		}
+	}
+
+	if err := NewFetcher(http.DefaultClient, "").ValidateSource("/srv/lists/ads.txt"); err == nil {
+		t.Errorf("ValidateSource of a file succeeded with local files disabled")
+	}
+}
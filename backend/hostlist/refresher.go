@@ -0,0 +1,91 @@
+package hostlist
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+)
+
+// checkInterval is how often lists are checked for a due refresh.
+const checkInterval = time.Minute
+
+// Refresher re-imports lists with a source once their refresh interval has
+// passed.
+type Refresher struct {
+	db      *database.Database
+	fetcher *Fetcher
+	// invalidate is called after a list's entries change so that cached
+	// proxy settings pick up the new revision.
+	invalidate func()
+
+	// mu runs one refresh at a time.
+	mu sync.Mutex
+}
+
+func NewRefresher(db *database.Database, fetcher *Fetcher, invalidate func()) *Refresher {
+	return &Refresher{db: db, fetcher: fetcher, invalidate: invalidate}
+}
+
+// Run refreshes due lists until ctx is cancelled, which also aborts a
+// download in progress.
+func (r *Refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	r.refreshDue(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			r.refreshDue(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Refresher) refreshDue(ctx context.Context) {
+	lists, err := r.db.GetDueHostLists()
+	if err != nil {
+		log.Printf("Failed to load host lists due for refresh: %v", err)
+		return
+	}
+	for i := range lists {
+		if ctx.Err() != nil {
+			return
+		}
+		r.Refresh(ctx, &lists[i])
+	}
+}
+
+// Refresh imports list from its source now. On failure the list keeps its
+// entries and the error is stored with it, unless ctx was cancelled.
+func (r *Refresher) Refresh(ctx context.Context, list *models.HostList) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries, skipped, err := r.fetcher.Load(ctx, list.Source, list.Format)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.Printf("Failed to refresh host list %s: %v", list.Name, err)
+		if err := r.db.RecordHostListError(list.ID, err.Error()); err != nil {
+			log.Printf("Failed to record host list error for %s: %v", list.Name, err)
+		}
+		return err
+	}
+	changed, err := r.db.ReplaceHostListEntries(list.ID, entries, skipped)
+	if err != nil {
+		log.Printf("Failed to store host list %s: %v", list.Name, err)
+		return err
+	}
+	if changed {
+		log.Printf("Refreshed host list %s: %d entries, %d lines skipped", list.Name, len(entries), skipped)
+		r.invalidate()
+	}
+	return nil
+}
@@ -1,40 +1,69 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 
 	"proxy-server/database"
+	"proxy-server/guard"
 	"proxy-server/handlers"
+	"proxy-server/hostlist"
 	"proxy-server/middleware"
 	"proxy-server/proxy"
+	"proxy-server/utils"
 )
 
 func main() {
 	log.Println("Starting Proxy Server Application...")
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	db, err := database.NewDatabase()
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
-	defer db.Close()
 
 	proxyPort := os.Getenv("PROXY_PORT")
 	if proxyPort == "" {
 		proxyPort = "8080"
 	}
 
+	socksPort := os.Getenv("SOCKS_PORT")
+	if socksPort == "" {
+		socksPort = "1080"
+	}
+
 	apiPort := os.Getenv("API_PORT")
 	if apiPort == "" {
 		apiPort = "8081"
 	}
 
-	proxyServer := proxy.NewProxyServer(db, proxyPort)
+	// Background loops outside the proxy stop with ctx; they are waited for
+	// before the database is closed.
+	var background sync.WaitGroup
+	runUntilShutdown := func(run func(context.Context)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run(ctx)
+		}()
+	}
+
+	loginGuard := guard.New(db)
+	runUntilShutdown(loginGuard.Run)
+
+	proxyServer := proxy.NewProxyServer(db, proxyPort, loginGuard)
 	go func() {
 		log.Printf("Starting proxy server on port %s", proxyPort)
 		if err := proxyServer.Start(); err != nil && err != http.ErrServerClosed {
@@ -42,14 +71,41 @@ func main() {
 		}
 	}()
 
-	authHandler := handlers.NewAuthHandler(db)
-	usersHandler := handlers.NewUsersHandler(db)
-	statsHandler := handlers.NewStatsHandler(db)
+	socksServer := proxy.NewSOCKS5Server(proxyServer, socksPort)
+	go func() {
+		log.Printf("Starting SOCKS5 server on port %s", socksPort)
+		if err := socksServer.Start(); err != nil {
+			log.Fatalf("SOCKS5 server failed: %v", err)
+		}
+	}()
+
+	authHandler := handlers.NewAuthHandler(db, loginGuard)
+	usersHandler := handlers.NewUsersHandler(db, proxyServer)
+	statsHandler := handlers.NewStatsHandler(db, proxyServer)
 	settingsHandler := handlers.NewSettingsHandler(db)
-	systemHandler := handlers.NewSystemHandler()
-	scheduleLogCleanup(db)
+	systemHandler := handlers.NewSystemHandler(proxyServer)
+	upstreamsHandler := handlers.NewUpstreamsHandler(db, proxyServer)
+	connectionsHandler := handlers.NewConnectionsHandler(db, proxyServer)
+	tokensHandler := handlers.NewTokensHandler(db, proxyServer)
+	bansHandler := handlers.NewBansHandler(db, loginGuard)
+	groupsHandler := handlers.NewGroupsHandler(db, proxyServer)
+	// Imports go through the proxy's egress guard; local files are read
+	// only from HOST_LISTS_DIR.
+	hostListFetcher := hostlist.NewFetcher(proxyServer.HTTPClient(), os.Getenv("HOST_LISTS_DIR"))
+	hostLists := hostlist.NewRefresher(db, hostListFetcher, proxyServer.InvalidateAll)
+	runUntilShutdown(hostLists.Run)
+	hostListsHandler := handlers.NewHostListsHandler(db, proxyServer, hostListFetcher, hostLists)
+	cleanupDone := scheduleLogCleanup(ctx, db)
+
+	// The admin UI's nginx forwards API requests; only its X-Forwarded-For
+	// is believed.
+	apiTrusted, err := utils.LoadTrustedProxies("API_TRUSTED_PROXIES")
+	if err != nil {
+		log.Printf("Ignoring trusted proxies: %v", err)
+	}
 
 	r := mux.NewRouter()
+	r.Use(middleware.ClientIP(apiTrusted))
 
 	r.HandleFunc("/api/init/check", authHandler.CheckInit).Methods("GET")
 	r.HandleFunc("/api/init/setup", authHandler.InitSetup).Methods("POST")
@@ -71,6 +127,10 @@ func main() {
 
 	api.HandleFunc("/stats/dashboard", statsHandler.GetDashboardStats).Methods("GET")
 	api.HandleFunc("/stats/traffic", statsHandler.GetTrafficStats).Methods("GET")
+	api.HandleFunc("/stats/quotas", statsHandler.GetQuotaStatus).Methods("GET")
+	api.HandleFunc("/stats/cache", statsHandler.GetCacheStats).Methods("GET")
+	api.HandleFunc("/stats/http-cache", statsHandler.GetHTTPCacheStats).Methods("GET")
+	api.HandleFunc("/http-cache/purge", statsHandler.PurgeHTTPCache).Methods("POST")
 	api.HandleFunc("/logs/requests", statsHandler.GetRequestLogs).Methods("GET")
 	api.HandleFunc("/logs/requests/export", statsHandler.ExportRequestLogs).Methods("GET")
 	api.HandleFunc("/logs/retention", statsHandler.GetLogRetention).Methods("GET")
@@ -82,10 +142,42 @@ func main() {
 	api.HandleFunc("/users/{id}", usersHandler.GetUser).Methods("GET")
 	api.HandleFunc("/users/{id}", usersHandler.UpdateUser).Methods("PUT")
 	api.HandleFunc("/users/{id}", usersHandler.DeleteUser).Methods("DELETE")
+	api.HandleFunc("/users/{id}/connections", connectionsHandler.TerminateUserConnections).Methods("DELETE")
+	api.HandleFunc("/users/{id}/tokens", tokensHandler.GetTokens).Methods("GET")
+	api.HandleFunc("/users/{id}/tokens", tokensHandler.CreateToken).Methods("POST")
+	api.HandleFunc("/users/{id}/tokens/{tokenId}", tokensHandler.DeleteToken).Methods("DELETE")
+
+	api.HandleFunc("/groups", groupsHandler.GetGroups).Methods("GET")
+	api.HandleFunc("/groups", groupsHandler.CreateGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}", groupsHandler.GetGroup).Methods("GET")
+	api.HandleFunc("/groups/{id}", groupsHandler.UpdateGroup).Methods("PUT")
+	api.HandleFunc("/groups/{id}", groupsHandler.DeleteGroup).Methods("DELETE")
+
+	api.HandleFunc("/host-lists", hostListsHandler.GetHostLists).Methods("GET")
+	api.HandleFunc("/host-lists", hostListsHandler.CreateHostList).Methods("POST")
+	api.HandleFunc("/host-lists/{id}", hostListsHandler.GetHostList).Methods("GET")
+	api.HandleFunc("/host-lists/{id}", hostListsHandler.UpdateHostList).Methods("PUT")
+	api.HandleFunc("/host-lists/{id}", hostListsHandler.DeleteHostList).Methods("DELETE")
+	api.HandleFunc("/host-lists/{id}/refresh", hostListsHandler.RefreshHostList).Methods("POST")
+
+	api.HandleFunc("/bans", bansHandler.GetBans).Methods("GET")
+	api.HandleFunc("/bans/{id}", bansHandler.DeleteBan).Methods("DELETE")
+
+	api.HandleFunc("/connections", connectionsHandler.GetConnections).Methods("GET")
+	api.HandleFunc("/connections/{id}", connectionsHandler.TerminateConnection).Methods("DELETE")
+
+	api.HandleFunc("/upstreams/rules", upstreamsHandler.GetRules).Methods("GET")
+	api.HandleFunc("/upstreams/rules", upstreamsHandler.CreateRule).Methods("POST")
+	api.HandleFunc("/upstreams/rules/{id}", upstreamsHandler.DeleteRule).Methods("DELETE")
+	api.HandleFunc("/upstreams", upstreamsHandler.GetUpstreams).Methods("GET")
+	api.HandleFunc("/upstreams", upstreamsHandler.CreateUpstream).Methods("POST")
+	api.HandleFunc("/upstreams/{id}", upstreamsHandler.UpdateUpstream).Methods("PUT")
+	api.HandleFunc("/upstreams/{id}", upstreamsHandler.DeleteUpstream).Methods("DELETE")
 
 	api.HandleFunc("/settings", settingsHandler.GetSettings).Methods("GET")
 	api.HandleFunc("/settings", settingsHandler.UpdateSetting).Methods("PUT")
 	api.HandleFunc("/system/public-ip", systemHandler.GetPublicIP).Methods("GET")
+	api.HandleFunc("/system/mitm-ca", systemHandler.GetMITMCA).Methods("GET")
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -96,14 +188,58 @@ func main() {
 
 	handler := c.Handler(r)
 
-	log.Printf("Starting API server on port %s", apiPort)
-	if err := http.ListenAndServe(":"+apiPort, handler); err != nil {
-		log.Fatalf("API server failed: %v", err)
+	apiServer := &http.Server{
+		Addr:              ":" + apiPort,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		log.Printf("Starting API server on port %s", apiPort)
+		if err := apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("API server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	timeout := shutdownTimeout()
+	log.Printf("Shutdown requested, draining connections for up to %s", timeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	socksServer.Close()
+	if err := apiServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("API server shutdown incomplete: %v", err)
 	}
+	if err := proxyServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Proxy shutdown incomplete: %v", err)
+	}
+	<-cleanupDone
+	background.Wait()
+
+	log.Println("Closing database connection")
+	db.Close()
+	log.Println("Shutdown complete")
+}
+
+// shutdownTimeout is how long open tunnels may take to finish after
+// SIGINT/SIGTERM, from SHUTDOWN_TIMEOUT_SECONDS (default 30).
+func shutdownTimeout() time.Duration {
+	if value := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		log.Printf("Ignoring invalid SHUTDOWN_TIMEOUT_SECONDS %q", value)
+	}
+	return 30 * time.Second
 }
 
-func scheduleLogCleanup(db *database.Database) {
+// scheduleLogCleanup removes request logs past the retention period once a
+// day until ctx is cancelled. The returned channel is closed when it stops.
+func scheduleLogCleanup(ctx context.Context, db *database.Database) <-chan struct{} {
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		runCleanup := func() {
 			days, err := db.GetLogRetentionDays()
 			if err != nil {
@@ -124,8 +260,15 @@ func scheduleLogCleanup(db *database.Database) {
 		ticker := time.NewTicker(24 * time.Hour)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			runCleanup()
+		for {
+			select {
+			case <-ticker.C:
+				runCleanup()
+			case <-ctx.Done():
+				log.Println("Log cleanup stopped")
+				return
+			}
 		}
 	}()
+	return done
 }
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"proxy-server/utils"
+)
+
+const ClientIPContextKey contextKey = "client_ip"
+
+// ClientIP resolves the address each request comes from, believing
+// X-Forwarded-For only from the trusted proxies in front of the API.
+func ClientIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), ClientIPContextKey, utils.ClientIP(r, trusted))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// GetClientIP returns the address ClientIP resolved, or the direct peer
+// for requests that did not pass through it.
+func GetClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ClientIPContextKey).(string); ok {
+		return ip
+	}
+	return utils.ClientIP(r, nil)
+}
@@ -1,43 +1,300 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"`
-	Email        string    `json:"email"`
-	Comment      string    `json:"comment"`
-	IsAdmin      bool      `json:"is_admin"`
-	IsActive     bool      `json:"is_active"`
-	ProxyType    string    `json:"proxy_type"`
-	TwoFAEnabled bool      `json:"twofa_enabled"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	Whitelist    []string  `json:"whitelist,omitempty"`
-	Blacklist    []string  `json:"blacklist,omitempty"`
+	ID               int         `json:"id"`
+	Username         string      `json:"username"`
+	PasswordHash     string      `json:"-"`
+	Email            string      `json:"email"`
+	Comment          string      `json:"comment"`
+	IsAdmin          bool        `json:"is_admin"`
+	IsActive         bool        `json:"is_active"`
+	ProxyType        *string     `json:"proxy_type"`
+	TwoFAEnabled     bool        `json:"twofa_enabled"`
+	UpstreamPool     string      `json:"upstream_pool"`
+	MITMEnabled      bool        `json:"mitm_enabled"`
+	HTTPCache        bool        `json:"http_cache"`
+	EgressAddresses  []string    `json:"egress_addresses"`
+	EgressStrategy   string      `json:"egress_strategy"`
+	Schedule         *Schedule   `json:"schedule"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	Whitelist        []string    `json:"whitelist,omitempty"`
+	Blacklist        []string    `json:"blacklist,omitempty"`
+	EgressExceptions []string    `json:"egress_exceptions,omitempty"`
+	MITMHosts        []string    `json:"mitm_hosts,omitempty"`
+	ClientAllowlist  []string    `json:"client_allowlist,omitempty"`
+	WhitelistLists   []int       `json:"whitelist_lists"`
+	BlacklistLists   []int       `json:"blacklist_lists"`
+	GroupIDs         []int       `json:"group_ids"`
+	QuotaUsage       *QuotaUsage `json:"quota_usage,omitempty"`
+	GroupExclusions
+	QuotaOverride
+	BandwidthLimit
+	RequestLimit
+}
+
+// EgressAddress is a local address outgoing connections can be bound to.
+type EgressAddress struct {
+	Address   string `json:"address"`
+	Family    string `json:"family"`
+	Interface string `json:"interface"`
 }
 
 type UserCreate struct {
-	Username  string   `json:"username"`
-	Password  string   `json:"password"`
-	Email     string   `json:"email"`
-	Comment   string   `json:"comment"`
-	IsAdmin   bool     `json:"is_admin"`
-	ProxyType string   `json:"proxy_type"`
-	Whitelist []string `json:"whitelist"`
-	Blacklist []string `json:"blacklist"`
+	Username         string    `json:"username"`
+	Password         string    `json:"password"`
+	Email            string    `json:"email"`
+	Comment          string    `json:"comment"`
+	IsAdmin          bool      `json:"is_admin"`
+	ProxyType        *string   `json:"proxy_type"`
+	UpstreamPool     string    `json:"upstream_pool"`
+	MITMEnabled      bool      `json:"mitm_enabled"`
+	HTTPCache        *bool     `json:"http_cache"`
+	EgressAddresses  []string  `json:"egress_addresses"`
+	EgressStrategy   string    `json:"egress_strategy"`
+	Schedule         *Schedule `json:"schedule"`
+	Whitelist        []string  `json:"whitelist"`
+	Blacklist        []string  `json:"blacklist"`
+	EgressExceptions []string  `json:"egress_exceptions"`
+	MITMHosts        []string  `json:"mitm_hosts"`
+	ClientAllowlist  []string  `json:"client_allowlist"`
+	WhitelistLists   []int     `json:"whitelist_lists"`
+	BlacklistLists   []int     `json:"blacklist_lists"`
+	GroupIDs         []int     `json:"group_ids"`
+	GroupExclusions
+	QuotaOverride
+	BandwidthLimit
+	RequestLimit
 }
 
 type UserUpdate struct {
-	Email     *string   `json:"email"`
-	Comment   *string   `json:"comment"`
-	IsAdmin   *bool     `json:"is_admin"`
-	IsActive  *bool     `json:"is_active"`
-	Password  *string   `json:"password,omitempty"`
-	ProxyType *string   `json:"proxy_type,omitempty"`
-	Whitelist *[]string `json:"whitelist,omitempty"`
-	Blacklist *[]string `json:"blacklist,omitempty"`
+	Email                *string            `json:"email"`
+	Comment              *string            `json:"comment"`
+	IsAdmin              *bool              `json:"is_admin"`
+	IsActive             *bool              `json:"is_active"`
+	Password             *string            `json:"password,omitempty"`
+	ProxyType            Nullable[string]   `json:"proxy_type"`
+	UpstreamPool         *string            `json:"upstream_pool,omitempty"`
+	QuotaDailyBytes      Nullable[int64]    `json:"quota_daily_bytes"`
+	QuotaMonthlyBytes    Nullable[int64]    `json:"quota_monthly_bytes"`
+	QuotaDailyRequests   Nullable[int64]    `json:"quota_daily_requests"`
+	QuotaMonthlyRequests Nullable[int64]    `json:"quota_monthly_requests"`
+	BandwidthUp          *int64             `json:"bandwidth_up,omitempty"`
+	BandwidthDown        *int64             `json:"bandwidth_down,omitempty"`
+	BandwidthBurst       *int64             `json:"bandwidth_burst,omitempty"`
+	MaxConnections       *int               `json:"max_connections,omitempty"`
+	RequestsPerSecond    *int               `json:"requests_per_second,omitempty"`
+	RequestsPerMinute    *int               `json:"requests_per_minute,omitempty"`
+	MITMEnabled          *bool              `json:"mitm_enabled,omitempty"`
+	HTTPCache            *bool              `json:"http_cache,omitempty"`
+	EgressAddresses      *[]string          `json:"egress_addresses,omitempty"`
+	EgressStrategy       *string            `json:"egress_strategy,omitempty"`
+	Schedule             Nullable[Schedule] `json:"schedule"`
+	Whitelist            *[]string          `json:"whitelist,omitempty"`
+	Blacklist            *[]string          `json:"blacklist,omitempty"`
+	WhitelistExclusions  *[]string          `json:"whitelist_exclusions,omitempty"`
+	BlacklistExclusions  *[]string          `json:"blacklist_exclusions,omitempty"`
+	EgressExceptions     *[]string          `json:"egress_exceptions,omitempty"`
+	MITMHosts            *[]string          `json:"mitm_hosts,omitempty"`
+	ClientAllowlist      *[]string          `json:"client_allowlist,omitempty"`
+	WhitelistLists       *[]int             `json:"whitelist_lists,omitempty"`
+	BlacklistLists       *[]int             `json:"blacklist_lists,omitempty"`
+	GroupIDs             *[]int             `json:"group_ids,omitempty"`
+}
+
+// Nullable is an update field that can also be cleared. Set reports
+// whether the field was given at all; a nil Value means it was null.
+type Nullable[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (n *Nullable[T]) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	n.Value = nil
+	if string(data) == "null" {
+		return nil
+	}
+	var value T
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	n.Value = &value
+	return nil
+}
+
+// Schedule limits when a user may use the proxy to windows such as
+// "mon-fri 09:00-18:00" in TimeZone, except on Holidays (YYYY-MM-DD).
+// Without windows access is not limited.
+type Schedule struct {
+	TimeZone string   `json:"time_zone"`
+	Windows  []string `json:"windows"`
+	Holidays []string `json:"holidays"`
+}
+
+// Group is a proxy policy shared by its members. A member's lists are
+// combined with those of all their groups, less the entries the member
+// excludes. For the proxy type, quotas and schedule the member's own
+// setting wins, even when it is "default" or zero; where the member leaves
+// it null, the group with the highest priority that sets it (not
+// "default", zero or no windows) applies.
+type Group struct {
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	Priority       int       `json:"priority"`
+	ProxyType      string    `json:"proxy_type"`
+	Whitelist      []string  `json:"whitelist"`
+	Blacklist      []string  `json:"blacklist"`
+	WhitelistLists []int     `json:"whitelist_lists"`
+	BlacklistLists []int     `json:"blacklist_lists"`
+	Schedule       Schedule  `json:"schedule"`
+	MemberIDs      []int     `json:"member_ids"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	UserQuota
+}
+
+type GroupCreate struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Priority       int      `json:"priority"`
+	ProxyType      string   `json:"proxy_type"`
+	Whitelist      []string `json:"whitelist"`
+	Blacklist      []string `json:"blacklist"`
+	WhitelistLists []int    `json:"whitelist_lists"`
+	BlacklistLists []int    `json:"blacklist_lists"`
+	Schedule       Schedule `json:"schedule"`
+	MemberIDs      []int    `json:"member_ids"`
+	UserQuota
+}
+
+type GroupUpdate struct {
+	Name                 *string   `json:"name"`
+	Description          *string   `json:"description"`
+	Priority             *int      `json:"priority"`
+	ProxyType            *string   `json:"proxy_type,omitempty"`
+	Whitelist            *[]string `json:"whitelist,omitempty"`
+	Blacklist            *[]string `json:"blacklist,omitempty"`
+	WhitelistLists       *[]int    `json:"whitelist_lists,omitempty"`
+	BlacklistLists       *[]int    `json:"blacklist_lists,omitempty"`
+	Schedule             *Schedule `json:"schedule,omitempty"`
+	MemberIDs            *[]int    `json:"member_ids,omitempty"`
+	QuotaDailyBytes      *int64    `json:"quota_daily_bytes,omitempty"`
+	QuotaMonthlyBytes    *int64    `json:"quota_monthly_bytes,omitempty"`
+	QuotaDailyRequests   *int64    `json:"quota_daily_requests,omitempty"`
+	QuotaMonthlyRequests *int64    `json:"quota_monthly_requests,omitempty"`
+}
+
+// HostList is a named list of host rules that users and groups reference
+// instead of copying its entries. Lists with a Source are imported from a
+// URL or local file and refreshed every RefreshMinutes; others hold the
+// entries given through the API.
+type HostList struct {
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description"`
+	Source          string     `json:"source"`
+	Format          string     `json:"format"`
+	RefreshMinutes  int        `json:"refresh_minutes"`
+	Revision        int        `json:"revision"`
+	EntryCount      int        `json:"entry_count"`
+	SkippedCount    int        `json:"skipped_count"`
+	LastRefreshedAt *time.Time `json:"last_refreshed_at"`
+	LastError       string     `json:"last_error"`
+	Entries         []string   `json:"entries,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type HostListCreate struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Source         string   `json:"source"`
+	Format         string   `json:"format"`
+	RefreshMinutes int      `json:"refresh_minutes"`
+	Entries        []string `json:"entries"`
+}
+
+type HostListUpdate struct {
+	Name           *string   `json:"name"`
+	Description    *string   `json:"description"`
+	Source         *string   `json:"source,omitempty"`
+	Format         *string   `json:"format,omitempty"`
+	RefreshMinutes *int      `json:"refresh_minutes,omitempty"`
+	Entries        *[]string `json:"entries,omitempty"`
+}
+
+// HostListRef names a host list in a user's effective settings. Revision
+// changes whenever the list's entries do.
+type HostListRef struct {
+	ID       int `json:"id"`
+	Revision int `json:"revision"`
+}
+
+// UserQuota holds per-user traffic limits. Bytes count both directions;
+// zero means unlimited.
+type UserQuota struct {
+	QuotaDailyBytes      int64 `json:"quota_daily_bytes"`
+	QuotaMonthlyBytes    int64 `json:"quota_monthly_bytes"`
+	QuotaDailyRequests   int64 `json:"quota_daily_requests"`
+	QuotaMonthlyRequests int64 `json:"quota_monthly_requests"`
+}
+
+// QuotaOverride holds a user's own traffic limits. A nil limit is
+// inherited from their groups; zero is unlimited.
+type QuotaOverride struct {
+	QuotaDailyBytes      *int64 `json:"quota_daily_bytes"`
+	QuotaMonthlyBytes    *int64 `json:"quota_monthly_bytes"`
+	QuotaDailyRequests   *int64 `json:"quota_daily_requests"`
+	QuotaMonthlyRequests *int64 `json:"quota_monthly_requests"`
+}
+
+// GroupExclusions are whitelist and blacklist entries a user's groups add
+// that do not apply to the user.
+type GroupExclusions struct {
+	WhitelistExclusions []string `json:"whitelist_exclusions,omitempty"`
+	BlacklistExclusions []string `json:"blacklist_exclusions,omitempty"`
+}
+
+// BandwidthLimit caps a user's throughput in bytes per second across all of
+// their connections. Up is client to destination, down the reverse. Burst
+// is the bucket size in bytes; zero means one second at the configured
+// rate. A zero rate is unlimited.
+type BandwidthLimit struct {
+	BandwidthUp    int64 `json:"bandwidth_up"`
+	BandwidthDown  int64 `json:"bandwidth_down"`
+	BandwidthBurst int64 `json:"bandwidth_burst"`
+}
+
+// RequestLimit bounds how many connections a user may hold open at once
+// and how fast they may start new ones. Zero means unlimited.
+type RequestLimit struct {
+	MaxConnections    int `json:"max_connections"`
+	RequestsPerSecond int `json:"requests_per_second"`
+	RequestsPerMinute int `json:"requests_per_minute"`
+}
+
+// QuotaUsage is a user's consumption for the current day and calendar
+// month, as recorded in traffic_stats.
+type QuotaUsage struct {
+	DailyBytes      int64    `json:"daily_bytes"`
+	MonthlyBytes    int64    `json:"monthly_bytes"`
+	DailyRequests   int64    `json:"daily_requests"`
+	MonthlyRequests int64    `json:"monthly_requests"`
+	Exceeded        []string `json:"exceeded,omitempty"`
+}
+
+type QuotaStatus struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	UserQuota
+	Usage QuotaUsage `json:"usage"`
 }
 
 type LoginRequest struct {
@@ -81,13 +338,81 @@ type RequestLog struct {
 	BytesSent     int64     `json:"bytes_sent"`
 	BytesReceived int64     `json:"bytes_received"`
 	DurationMs    int       `json:"duration_ms"`
+	Reason        string    `json:"reason,omitempty"`
+	CacheStatus   string    `json:"cache_status,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
 type UserProxySettings struct {
-	ProxyType string   `json:"proxy_type"`
-	Whitelist []string `json:"whitelist"`
-	Blacklist []string `json:"blacklist"`
+	ProxyType        string         `json:"proxy_type"`
+	Whitelist        []string       `json:"whitelist"`
+	Blacklist        []string       `json:"blacklist"`
+	WhitelistLists   []HostListRef  `json:"whitelist_lists"`
+	BlacklistLists   []HostListRef  `json:"blacklist_lists"`
+	UpstreamPool     string         `json:"upstream_pool"`
+	UpstreamRules    []UpstreamRule `json:"upstream_rules"`
+	EgressExceptions []string       `json:"egress_exceptions"`
+	MITMEnabled      bool           `json:"mitm_enabled"`
+	MITMHosts        []string       `json:"mitm_hosts"`
+	ClientAllowlist  []string       `json:"client_allowlist"`
+	HTTPCache        bool           `json:"http_cache"`
+	EgressAddresses  []string       `json:"egress_addresses"`
+	EgressStrategy   string         `json:"egress_strategy"`
+	Schedule         Schedule       `json:"schedule"`
+	Quota            UserQuota      `json:"quota"`
+	Bandwidth        BandwidthLimit `json:"bandwidth"`
+	Limits           RequestLimit   `json:"limits"`
+}
+
+type UpstreamProxy struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Type          string     `json:"type"`
+	Address       string     `json:"address"`
+	Username      string     `json:"username"`
+	Password      string     `json:"-"`
+	HasPassword   bool       `json:"has_password"`
+	Pool          string     `json:"pool"`
+	Priority      int        `json:"priority"`
+	IsActive      bool       `json:"is_active"`
+	Healthy       bool       `json:"healthy"`
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type UpstreamProxyCreate struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Pool     string `json:"pool"`
+	Priority int    `json:"priority"`
+}
+
+type UpstreamProxyUpdate struct {
+	Name     *string `json:"name"`
+	Type     *string `json:"type"`
+	Address  *string `json:"address"`
+	Username *string `json:"username"`
+	Password *string `json:"password,omitempty"`
+	Pool     *string `json:"pool"`
+	Priority *int    `json:"priority"`
+	IsActive *bool   `json:"is_active"`
+}
+
+// UpstreamRule routes destinations matching Pattern through Pool. Rules
+// without a UserID apply to every user. The pool name "direct" bypasses
+// chaining.
+type UpstreamRule struct {
+	ID        int       `json:"id"`
+	UserID    *int      `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
+	Pattern   string    `json:"pattern"`
+	Pool      string    `json:"pool"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type AdminAuditLog struct {
@@ -107,6 +432,7 @@ type LogFilterOptions struct {
 	Username      string
 	Method        string
 	URLContains   string
+	CacheStatus   string
 	StatusCode    *int
 	MinBytesSent  *int64
 	MaxBytesSent  *int64
@@ -120,6 +446,86 @@ type LogFilterOptions struct {
 	Offset        int
 }
 
+// CacheStats reports proxy authentication and policy cache effectiveness
+// since startup.
+type CacheStats struct {
+	AuthHits      int64   `json:"auth_hits"`
+	AuthMisses    int64   `json:"auth_misses"`
+	AuthHitRate   float64 `json:"auth_hit_rate"`
+	AuthEntries   int     `json:"auth_entries"`
+	PolicyHits    int64   `json:"policy_hits"`
+	PolicyMisses  int64   `json:"policy_misses"`
+	PolicyHitRate float64 `json:"policy_hit_rate"`
+	PolicyEntries int     `json:"policy_entries"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+// HTTPCacheStats describes the shared HTTP response cache since startup.
+type HTTPCacheStats struct {
+	Enabled     bool    `json:"enabled"`
+	Entries     int     `json:"entries"`
+	SizeBytes   int64   `json:"size_bytes"`
+	MaxBytes    int64   `json:"max_bytes"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	Revalidated int64   `json:"revalidated"`
+	Stored      int64   `json:"stored"`
+	Evicted     int64   `json:"evicted"`
+	HitRate     float64 `json:"hit_rate"`
+}
+
+// ActiveConnection is a proxy request, tunnel or SOCKS5 session that is
+// currently open. Byte counters are live.
+type ActiveConnection struct {
+	ID            uint64    `json:"id"`
+	UserID        int       `json:"user_id"`
+	Username      string    `json:"username"`
+	ClientIP      string    `json:"client_ip"`
+	Method        string    `json:"method"`
+	Target        string    `json:"target"`
+	StartedAt     time.Time `json:"started_at"`
+	DurationMs    int64     `json:"duration_ms"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+// ProxyToken is a named credential a user can log in to the proxy with
+// instead of their password. Only a hash of the token is stored.
+type ProxyToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type ProxyTokenCreate struct {
+	Name      string     `json:"name"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ProxyTokenCreated carries the token itself, which is only ever returned
+// once, on creation.
+type ProxyTokenCreated struct {
+	ProxyToken
+	Token string `json:"token"`
+}
+
+// AuthBan blocks logins from a source IP or for a username until it
+// expires, after too many failed attempts.
+type AuthBan struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	Failures  int       `json:"failures"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 type StatsResponse struct {
 	TotalUsers     int            `json:"total_users"`
 	ActiveUsers    int            `json:"active_users"`
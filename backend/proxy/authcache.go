@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/models"
+	"proxy-server/utils"
+)
+
+const (
+	// authCacheTTL bounds how long a verified username/password pair skips
+	// the database and bcrypt.
+	authCacheTTL = 60 * time.Second
+	// policyCacheTTL bounds how long user settings are reused; admin edits
+	// through the API invalidate sooner.
+	policyCacheTTL = 10 * time.Second
+	// cacheSweepInterval is how often expired entries are dropped.
+	cacheSweepInterval = time.Minute
+)
+
+type credentialKey [sha256.Size]byte
+
+// credentialHash keys the auth cache without keeping plaintext passwords
+// in memory.
+func credentialHash(username, password string) credentialKey {
+	h := sha256.New()
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	var key credentialKey
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+type authEntry struct {
+	claims  *utils.Claims
+	expires time.Time
+}
+
+type policyEntry struct {
+	settings *models.UserProxySettings
+	expires  time.Time
+}
+
+// authCache holds successful credential checks and per-user settings for
+// the proxy hot path. Failed logins are never cached.
+type authCache struct {
+	mu       sync.Mutex
+	creds    map[credentialKey]authEntry
+	policies map[int]policyEntry
+
+	authHits, authMisses     atomic.Int64
+	policyHits, policyMisses atomic.Int64
+	invalidations            atomic.Int64
+}
+
+func newAuthCache() *authCache {
+	return &authCache{
+		creds:    make(map[credentialKey]authEntry),
+		policies: make(map[int]policyEntry),
+	}
+}
+
+func (c *authCache) lookupCredentials(key credentialKey) (*utils.Claims, bool) {
+	c.mu.Lock()
+	entry, ok := c.creds[key]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		c.authMisses.Add(1)
+		return nil, false
+	}
+	c.authHits.Add(1)
+	return entry.claims, true
+}
+
+// generation changes on every invalidation. Values loaded before an
+// invalidation are discarded by the store methods.
+func (c *authCache) generation() int64 {
+	return c.invalidations.Load()
+}
+
+func (c *authCache) storeCredentials(gen int64, key credentialKey, claims *utils.Claims) {
+	c.storeCredentialsUntil(gen, key, claims, nil)
+}
+
+// storeCredentialsUntil caches credentials that stop being valid at
+// validUntil, if set, even when that is sooner than authCacheTTL.
+func (c *authCache) storeCredentialsUntil(gen int64, key credentialKey, claims *utils.Claims, validUntil *time.Time) {
+	expires := time.Now().Add(authCacheTTL)
+	if validUntil != nil && validUntil.Before(expires) {
+		expires = *validUntil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.invalidations.Load() {
+		return
+	}
+	c.creds[key] = authEntry{claims: claims, expires: expires}
+}
+
+func (c *authCache) lookupSettings(userID int) (*models.UserProxySettings, bool) {
+	c.mu.Lock()
+	entry, ok := c.policies[userID]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		c.policyMisses.Add(1)
+		return nil, false
+	}
+	c.policyHits.Add(1)
+	return entry.settings, true
+}
+
+func (c *authCache) storeSettings(gen int64, userID int, settings *models.UserProxySettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.invalidations.Load() {
+		return
+	}
+	c.policies[userID] = policyEntry{settings: settings, expires: time.Now().Add(policyCacheTTL)}
+}
+
+// invalidateUser drops every cached credential and the settings of one
+// user, so password, status and policy changes apply to the next request.
+func (c *authCache) invalidateUser(userID int) {
+	c.mu.Lock()
+	for key, entry := range c.creds {
+		if entry.claims.UserID == userID {
+			delete(c.creds, key)
+		}
+	}
+	delete(c.policies, userID)
+	c.invalidations.Add(1)
+	c.mu.Unlock()
+}
+
+func (c *authCache) invalidateAll() {
+	c.mu.Lock()
+	c.creds = make(map[credentialKey]authEntry)
+	c.policies = make(map[int]policyEntry)
+	c.invalidations.Add(1)
+	c.mu.Unlock()
+}
+
+func (c *authCache) run(ctx context.Context) {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *authCache) sweep() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.creds {
+		if now.After(entry.expires) {
+			delete(c.creds, key)
+		}
+	}
+	for userID, entry := range c.policies {
+		if now.After(entry.expires) {
+			delete(c.policies, userID)
+		}
+	}
+}
+
+func (c *authCache) stats() models.CacheStats {
+	c.mu.Lock()
+	authEntries, policyEntries := len(c.creds), len(c.policies)
+	c.mu.Unlock()
+
+	stats := models.CacheStats{
+		AuthHits:      c.authHits.Load(),
+		AuthMisses:    c.authMisses.Load(),
+		AuthEntries:   authEntries,
+		PolicyHits:    c.policyHits.Load(),
+		PolicyMisses:  c.policyMisses.Load(),
+		PolicyEntries: policyEntries,
+		Invalidations: c.invalidations.Load(),
+	}
+	stats.AuthHitRate = hitRate(stats.AuthHits, stats.AuthMisses)
+	stats.PolicyHitRate = hitRate(stats.PolicyHits, stats.PolicyMisses)
+	return stats
+}
+
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"proxy-server/utils"
+)
+
+// reasonClientNotAllowed is logged for requests from an address outside the
+// user's client allowlist.
+const reasonClientNotAllowed = "client_ip_not_allowed"
+
+// parseClientNets turns a user's client allowlist into ranges, skipping
+// entries that no longer parse.
+func parseClientNets(userID int, entries []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		network, err := utils.ParseIPNet(strings.TrimSpace(entry))
+		if err != nil {
+			log.Printf("Ignoring invalid client allowlist entry for user %d: %v", userID, err)
+			continue
+		}
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// clientAllowed reports whether the user may connect from clientIP. Users
+// without an allowlist may connect from anywhere.
+func (p *userPolicy) clientAllowed(clientIP string) bool {
+	if p == nil || p.UserProxySettings == nil || len(p.ClientAllowlist) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	return ip != nil && utils.ContainsIP(p.clientNets, ip)
+}
+
+// clientIP returns the address a request comes from, believing
+// X-Forwarded-For only from PROXY_TRUSTED_PROXIES.
+func (ps *ProxyServer) clientIP(r *http.Request) string {
+	return utils.ClientIP(r, ps.trustedProxies)
+}
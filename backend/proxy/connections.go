@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/models"
+	"proxy-server/utils"
+)
+
+// activeConn is one proxied request, tunnel or SOCKS5 session in the
+// connection registry.
+type activeConn struct {
+	id        uint64
+	userID    int
+	username  string
+	clientIP  string
+	method    string
+	target    string
+	startTime time.Time
+
+	sent     atomic.Int64
+	received atomic.Int64
+
+	mu sync.Mutex
+	// closer ends the connection; allowed reports whether the user's
+	// current policy still permits it (nil means it is not re-checked).
+	closer  func()
+	allowed func(*userPolicy) bool
+}
+
+type activeConnKey struct{}
+
+// withActiveConn attaches c to ctx so handlers further down can update it.
+func withActiveConn(ctx context.Context, c *activeConn) context.Context {
+	return context.WithValue(ctx, activeConnKey{}, c)
+}
+
+func activeConnFrom(ctx context.Context) *activeConn {
+	c, _ := ctx.Value(activeConnKey{}).(*activeConn)
+	return c
+}
+
+// setCloser sets how the connection is ended, for connections whose
+// context only exists once they are registered. Cancelling that context
+// also interrupts bandwidth throttling and closes hijacked connections.
+func (c *activeConn) setCloser(closer func()) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.closer = closer
+	c.mu.Unlock()
+}
+
+func (c *activeConn) setAllowed(allowed func(*userPolicy) bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.allowed = allowed
+	c.mu.Unlock()
+}
+
+func (c *activeConn) close() {
+	c.mu.Lock()
+	closer := c.closer
+	c.mu.Unlock()
+	if closer != nil {
+		closer()
+	}
+}
+
+func (c *activeConn) permittedBy(policy *userPolicy) bool {
+	c.mu.Lock()
+	allowed := c.allowed
+	c.mu.Unlock()
+	return allowed == nil || allowed(policy)
+}
+
+// wrap counts the bytes read from and written to a client connection.
+func (c *activeConn) wrap(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	return &countedConn{Conn: conn, owner: c}
+}
+
+func (c *activeConn) snapshot(now time.Time) models.ActiveConnection {
+	return models.ActiveConnection{
+		ID:            c.id,
+		UserID:        c.userID,
+		Username:      c.username,
+		ClientIP:      c.clientIP,
+		Method:        c.method,
+		Target:        c.target,
+		StartedAt:     c.startTime,
+		DurationMs:    now.Sub(c.startTime).Milliseconds(),
+		BytesSent:     c.sent.Load(),
+		BytesReceived: c.received.Load(),
+	}
+}
+
+// countedConn feeds the live byte counters of its owner: bytes read from
+// the client were sent by it, bytes written were received.
+type countedConn struct {
+	net.Conn
+	owner *activeConn
+}
+
+func (cc *countedConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	cc.owner.sent.Add(int64(n))
+	return n, err
+}
+
+func (cc *countedConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	cc.owner.received.Add(int64(n))
+	return n, err
+}
+
+// connRegistry tracks every active proxy connection so admins can list and
+// terminate them, and so shutdown can close the ones http.Server does not
+// manage (hijacked tunnels, upgrades, SOCKS5 sessions).
+type connRegistry struct {
+	nextID atomic.Uint64
+
+	mu    sync.Mutex
+	conns map[uint64]*activeConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*activeConn)}
+}
+
+func (r *connRegistry) register(claims *utils.Claims, remoteAddr, method, target string, closer func()) *activeConn {
+	clientIP := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		clientIP = host
+	}
+	c := &activeConn{
+		id:        r.nextID.Add(1),
+		userID:    claims.UserID,
+		username:  claims.Username,
+		clientIP:  clientIP,
+		method:    method,
+		target:    target,
+		startTime: time.Now(),
+		closer:    closer,
+	}
+	r.mu.Lock()
+	r.conns[c.id] = c
+	r.mu.Unlock()
+	return c
+}
+
+func (r *connRegistry) unregister(c *activeConn) {
+	r.mu.Lock()
+	delete(r.conns, c.id)
+	r.mu.Unlock()
+}
+
+// matching returns the registered connections accepted by keep.
+func (r *connRegistry) matching(keep func(*activeConn) bool) []*activeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var conns []*activeConn
+	for _, c := range r.conns {
+		if keep(c) {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// users returns the IDs of the users with open connections.
+func (r *connRegistry) users() map[int]struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	users := make(map[int]struct{})
+	for _, c := range r.conns {
+		users[c.userID] = struct{}{}
+	}
+	return users
+}
+
+func (r *connRegistry) list() []models.ActiveConnection {
+	now := time.Now()
+	conns := r.matching(func(*activeConn) bool { return true })
+	list := make([]models.ActiveConnection, 0, len(conns))
+	for _, c := range conns {
+		list = append(list, c.snapshot(now))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *connRegistry) closeWhere(keep func(*activeConn) bool) int {
+	conns := r.matching(keep)
+	for _, c := range conns {
+		c.close()
+	}
+	return len(conns)
+}
+
+func (r *connRegistry) closeAll() int {
+	return r.closeWhere(func(*activeConn) bool { return true })
+}
+
+// ActiveConnections lists the proxy connections currently open.
+func (ps *ProxyServer) ActiveConnections() []models.ActiveConnection {
+	return ps.conns.list()
+}
+
+// TerminateConnection closes one active connection and reports whether it
+// existed.
+func (ps *ProxyServer) TerminateConnection(id uint64) bool {
+	return ps.conns.closeWhere(func(c *activeConn) bool { return c.id == id }) > 0
+}
+
+// TerminateUserConnections closes every active connection of a user and
+// returns how many were closed.
+func (ps *ProxyServer) TerminateUserConnections(userID int) int {
+	return ps.conns.closeWhere(func(c *activeConn) bool { return c.userID == userID })
+}
+
+// enforceUser re-checks the open connections of a user after their account
+// changed: all of them are closed if the user was deleted or deactivated,
+// otherwise those their current policy no longer allows.
+func (ps *ProxyServer) enforceUser(userID int) {
+	if len(ps.conns.matching(func(c *activeConn) bool { return c.userID == userID })) == 0 {
+		return
+	}
+
+	user, err := ps.db.GetUserByID(userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.IsActive) {
+		if closed := ps.TerminateUserConnections(userID); closed > 0 {
+			log.Printf("Closed %d connections of inactive user %d", closed, userID)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to re-check connections of user %d: %v", userID, err)
+		return
+	}
+
+	policy, err := ps.loadPolicy(userID)
+	if err != nil {
+		log.Printf("Failed to re-check connections of user %d: %v", userID, err)
+		return
+	}
+	closed := ps.conns.closeWhere(func(c *activeConn) bool {
+		return c.userID == userID && (!c.permittedBy(policy) || !policy.clientAllowed(c.clientIP))
+	})
+	if closed > 0 {
+		log.Printf("Closed %d connections of user %d no longer allowed by policy", closed, userID)
+	}
+}
+
+// countedResponseWriter counts response bytes of a plain HTTP request.
+// Unwrap keeps hijacking available through http.ResponseController.
+type countedResponseWriter struct {
+	http.ResponseWriter
+	owner *activeConn
+}
+
+func (w *countedResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.owner.received.Add(int64(n))
+	return n, err
+}
+
+func (w *countedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countedBody struct {
+	io.ReadCloser
+	owner *activeConn
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.owner.sent.Add(int64(n))
+	return n, err
+}
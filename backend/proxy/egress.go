@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const reasonPrivateDestination = "private_destination"
+
+// reservedNetworks lists destinations proxied traffic may not reach unless
+// the user has an explicit egress exception.
+var reservedNetworks = mustParseCIDRs(
+	// IPv4
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // RFC 1918
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, cloud metadata
+	"172.16.0.0/12",      // RFC 1918
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.0.2.0/24",       // TEST-NET-1
+	"192.88.99.0/24",     // 6to4 relay anycast
+	"192.168.0.0/16",     // RFC 1918
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // TEST-NET-2
+	"203.0.113.0/24",     // TEST-NET-3
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+	// IPv6
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b:1::/48", // local-use NAT64
+	"100::/64",       // discard-only
+	"2001::/23",      // IETF protocol assignments, incl. Teredo
+	"2001:db8::/32",  // documentation
+	"2002::/16",      // 6to4
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"fec0::/10",      // site-local (deprecated)
+	"ff00::/8",       // multicast
+)
+
+// nat64Network is the well-known NAT64 prefix (RFC 6052). Its addresses
+// reach the IPv4 address in their last four bytes on IPv6-only networks.
+var nat64Network = mustParseCIDRs("64:ff9b::/96")[0]
+
+func mustParseCIDRs(values ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// isReservedIP reports whether ip falls in a reserved range. IPv4-mapped
+// and NAT64 addresses are checked as the IPv4 address they embed.
+func isReservedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if nat64Network.Contains(ip) {
+		ip = ip[net.IPv6len-net.IPv4len:]
+	}
+	for _, ipNet := range reservedNetworks {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// egressDeniedError reports a destination rejected by the egress guard.
+type egressDeniedError struct {
+	host string
+	ip   net.IP
+}
+
+func (e *egressDeniedError) Error() string {
+	if e.ip != nil && e.ip.String() != e.host {
+		return fmt.Sprintf("destination %s (%s) is in a restricted address range", e.host, e.ip)
+	}
+	return fmt.Sprintf("destination %s is in a restricted address range", e.host)
+}
+
+func isEgressDenied(err error) bool {
+	var denied *egressDeniedError
+	return errors.As(err, &denied)
+}
+
+// egressAllowed reports whether the policy permits reaching ip for host.
+// Exceptions may name the host itself or the address/range it resolves to.
+func (ps *ProxyServer) egressAllowed(policy *userPolicy, host string, ip net.IP, port int) bool {
+	if !ps.settings.get().BlockPrivateDestinations || !isReservedIP(ip) {
+		return true
+	}
+	if policy == nil || policy.egressExceptions == nil {
+		return false
+	}
+	return policy.egressExceptions.Match(host, port) || policy.egressExceptions.Match(ip.String(), port)
+}
+
+// checkEgress resolves host and rejects it when any address is restricted.
+// It is used where the final connection is made by someone else (upstream
+// proxies); direct dials are additionally verified by egressControl.
+func (ps *ProxyServer) checkEgress(ctx context.Context, policy *userPolicy, host string, port int) error {
+	if !ps.settings.get().BlockPrivateDestinations {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ps.egressAllowed(policy, host, ip, port) {
+			return &egressDeniedError{host: host, ip: ip}
+		}
+		return nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if err != nil {
+		// Resolution failures are left to the dialer, which reports them.
+		return nil
+	}
+	for _, addr := range addrs {
+		if !ps.egressAllowed(policy, host, addr.IP, port) {
+			return &egressDeniedError{host: host, ip: addr.IP}
+		}
+	}
+	return nil
+}
+
+// egressControl returns a net.Dialer Control hook that validates the
+// address actually being connected to, defeating DNS rebinding between
+// policy checks and the dial.
+func (ps *ProxyServer) egressControl(policy *userPolicy, host string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		ipStr, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return fmt.Errorf("unexpected dial address %q", address)
+		}
+		port, _ := strconv.Atoi(portStr)
+		if !ps.egressAllowed(policy, host, ip, port) {
+			return &egressDeniedError{host: host, ip: ip}
+		}
+		return nil
+	}
+}
+
+// HTTPClient returns a client for requests the server makes on its own
+// behalf, such as host list imports. They pass the egress guard like
+// those of a user without exceptions: redirect targets are checked before
+// they are followed, and every connection when it is dialed. Proxy
+// environment variables are ignored, as they would bypass the dial check.
+func (ps *ProxyServer) HTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &net.Dialer{
+			Timeout: ps.settings.get().Timeout,
+			Control: ps.egressControl(nil, host),
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			defaultPort := 80
+			if req.URL.Scheme == "https" {
+				defaultPort = 443
+			}
+			host, port := splitTarget(req.URL.Host, defaultPort)
+			return ps.checkEgress(req.Context(), nil, host, port)
+		},
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsReservedIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"0.0.0.0", true},
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"192.168.1.1", true},
+		{"198.18.0.1", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"::", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fd12:3456::1", true},
+		{"fe80::1", true},
+		{"ff02::1", true},
+		{"2001:db8::1", true},
+		{"2002:c0a8:101::1", true},
+		{"2606:4700:4700::1111", false},
+		// IPv4-mapped addresses are checked as the IPv4 address.
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:8.8.8.8", false},
+		// NAT64 addresses reach the IPv4 address they embed.
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b::127.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"64:ff9b::c0a8:101", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", false},
+		{"64:ff9b:1::808:808", true},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		if ip == nil {
+			t.Fatalf("invalid test address %q", tt.ip)
+		}
+		if got := isReservedIP(ip); got != tt.want {
+			t.Errorf("isReservedIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestEgressAllowed(t *testing.T) {
+	ps := &ProxyServer{settings: &settingsWatcher{}}
+	ps.settings.current.Store(defaultRuntimeSettings())
+	policy := &userPolicy{
+		egressExceptions: compileList(0, "egress exception", []string{"intranet.example", "10.1.0.0/16", "192.168.1.5:8080"}),
+	}
+
+	tests := []struct {
+		policy *userPolicy
+		host   string
+		ip     string
+		port   int
+		want   bool
+	}{
+		{nil, "example.com", "93.184.216.34", 443, true},
+		{nil, "localhost", "127.0.0.1", 80, false},
+		{nil, "rebound.example", "64:ff9b::a01:203", 80, false},
+		{policy, "intranet.example", "10.9.9.9", 80, true},
+		{policy, "other.example", "10.1.2.3", 80, true},
+		{policy, "other.example", "10.2.0.1", 80, false},
+		{policy, "192.168.1.5", "192.168.1.5", 8080, true},
+		{policy, "192.168.1.5", "192.168.1.5", 22, false},
+	}
+	for _, tt := range tests {
+		if got := ps.egressAllowed(tt.policy, tt.host, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("egressAllowed(%s, %s, %d) = %v, want %v", tt.host, tt.ip, tt.port, got, tt.want)
+		}
+	}
+
+	ps.settings.current.Store(&runtimeSettings{BlockPrivateDestinations: false})
+	if !ps.egressAllowed(nil, "localhost", net.ParseIP("127.0.0.1"), 80) {
+		t.Errorf("egressAllowed with the guard disabled = false, want true")
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+	"proxy-server/rules"
+)
+
+// hostListCache compiles each named host list once, however many users
+// reference it, and keeps the matcher until the list's revision changes.
+type hostListCache struct {
+	db *database.Database
+
+	mu   sync.Mutex
+	byID map[int]*sharedHostList
+}
+
+type sharedHostList struct {
+	revision int
+	once     sync.Once
+	matcher  *rules.Matcher
+	// lastUsed is guarded by hostListCache.mu.
+	lastUsed time.Time
+}
+
+func newHostListCache(db *database.Database) *hostListCache {
+	return &hostListCache{db: db, byID: make(map[int]*sharedHostList)}
+}
+
+// set combines own, compiled from a user's entries, with the host lists
+// they reference.
+func (c *hostListCache) set(own *rules.Matcher, refs []models.HostListRef) rules.Set {
+	set := rules.Set{own}
+	for _, ref := range refs {
+		if matcher := c.matcher(ref); matcher != nil {
+			set = append(set, matcher)
+		}
+	}
+	return set
+}
+
+func (c *hostListCache) matcher(ref models.HostListRef) *rules.Matcher {
+	c.mu.Lock()
+	list, ok := c.byID[ref.ID]
+	// Settings cached before a refresh may still name an older revision;
+	// they get the newer one rather than a recompile.
+	if !ok || list.revision < ref.Revision {
+		list = &sharedHostList{revision: ref.Revision}
+		c.byID[ref.ID] = list
+	}
+	list.lastUsed = time.Now()
+	c.mu.Unlock()
+
+	list.once.Do(func() {
+		entries, err := c.db.GetHostListEntries(ref.ID)
+		if err != nil {
+			log.Printf("Failed to load host list %d: %v", ref.ID, err)
+			c.mu.Lock()
+			if c.byID[ref.ID] == list {
+				delete(c.byID, ref.ID)
+			}
+			c.mu.Unlock()
+			return
+		}
+		matcher, errs := rules.Compile(entries)
+		if len(errs) > 0 {
+			log.Printf("Ignoring %d invalid entries in host list %d, e.g. %v", len(errs), ref.ID, errs[0])
+		}
+		list.matcher = matcher
+	})
+	return list.matcher
+}
+
+// sweep drops the lists no policy has been compiled with since cutoff,
+// including lists that were deleted or are no longer referenced.
+func (c *hostListCache) sweep(cutoff time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, list := range c.byID {
+		if list.lastUsed.Before(cutoff) {
+			delete(c.byID, id)
+		}
+	}
+}
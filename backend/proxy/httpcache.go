@@ -0,0 +1,808 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/models"
+)
+
+// Cache outcomes recorded in request_logs.cache_status.
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+const (
+	// cacheMaxVariants bounds how many Vary variants are kept per URL.
+	cacheMaxVariants = 8
+	// cacheObjectFraction limits a single response to this share of the
+	// cache size.
+	cacheObjectFraction = 10
+	// heuristicMaxLifetime caps freshness derived from Last-Modified.
+	heuristicMaxLifetime = 24 * time.Hour
+)
+
+// heuristicStatuses may be given a heuristic freshness lifetime and are the
+// only statuses stored (RFC 9110, section 15.1).
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// responseCache is a shared HTTP cache following RFC 9111 for GET requests
+// on plain HTTP. Bodies and metadata live in dir so the cache survives
+// restarts; the index is kept in memory and evicted least recently used
+// first once the configured size is exceeded.
+type responseCache struct {
+	dir      string
+	maxBytes func() int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	byURL   map[string][]*cacheEntry
+	lru     *list.List
+	size    int64
+
+	hits, misses, revalidated atomic.Int64
+	stored, evicted           atomic.Int64
+}
+
+// cacheEntry is one stored response, persisted as <ID>.meta next to its
+// <ID>.body.
+type cacheEntry struct {
+	ID           string            `json:"id"`
+	URL          string            `json:"url"`
+	Host         string            `json:"host"`
+	StatusCode   int               `json:"status_code"`
+	Header       http.Header       `json:"header"`
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"request_time"`
+	ResponseTime time.Time         `json:"response_time"`
+	Size         int64             `json:"size"`
+
+	elem *list.Element
+}
+
+// httpCacheDir returns HTTP_CACHE_DIR, or a directory under the system
+// temporary directory when it is not set.
+func httpCacheDir() string {
+	if dir := strings.TrimSpace(os.Getenv("HTTP_CACHE_DIR")); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "progzy-http-cache")
+}
+
+func newResponseCache(dir string, maxBytes func() int64) (*responseCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &responseCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		byURL:    make(map[string][]*cacheEntry),
+		lru:      list.New(),
+	}
+	c.load()
+	return c, nil
+}
+
+// load rebuilds the index from disk, oldest responses first so that they
+// are evicted first.
+func (c *responseCache) load() {
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Failed to read HTTP cache directory: %v", err)
+		return
+	}
+
+	var loaded []*cacheEntry
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(c.dir, name)
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			os.Remove(path)
+		case strings.HasSuffix(name, ".meta"):
+			data, err := os.ReadFile(path)
+			var entry cacheEntry
+			if err == nil {
+				err = json.Unmarshal(data, &entry)
+			}
+			info, statErr := os.Stat(c.bodyPath(entry.ID))
+			if err != nil || statErr != nil || entry.ID == "" || info.Size() != entry.Size {
+				os.Remove(path)
+				continue
+			}
+			loaded = append(loaded, &entry)
+		}
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].ResponseTime.Before(loaded[j].ResponseTime) })
+	c.mu.Lock()
+	for _, entry := range loaded {
+		c.insertLocked(entry)
+	}
+	c.mu.Unlock()
+	c.evict()
+	if len(loaded) > 0 {
+		log.Printf("Loaded %d cached HTTP responses", len(loaded))
+	}
+}
+
+func (c *responseCache) bodyPath(id string) string {
+	return filepath.Join(c.dir, id+".body")
+}
+
+func (c *responseCache) metaPath(id string) string {
+	return filepath.Join(c.dir, id+".meta")
+}
+
+// fetch answers req from the cache when a fresh response is stored,
+// revalidates stale responses that carry validators, and otherwise calls
+// do and stores the response if it may be reused. The returned status is
+// recorded in request_logs.
+func (c *responseCache) fetch(req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, string, error) {
+	if !isCacheableRequest(req) {
+		resp, err := do(req)
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+			c.invalidate(cacheKey(req.URL))
+		}
+		return resp, cacheBypass, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-cache"]; !ok && len(req.Header.Values("Cache-Control")) == 0 &&
+		strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		reqCC["no-cache"] = ""
+	}
+
+	key := cacheKey(req.URL)
+	entry := c.lookup(key, req.Header)
+	now := time.Now()
+	if entry != nil {
+		if _, noCache := reqCC["no-cache"]; !noCache && entry.fresh(now, reqCC) {
+			if resp, ok := c.serve(entry, req, now); ok {
+				c.hits.Add(1)
+				return resp, cacheHit, nil
+			}
+			entry = nil
+		}
+	}
+	if _, ok := reqCC["only-if-cached"]; ok {
+		c.misses.Add(1)
+		return gatewayTimeout(req), cacheMiss, nil
+	}
+
+	if entry != nil && entry.hasValidators() {
+		conditional := req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			conditional.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			conditional.Header.Set("If-Modified-Since", modified)
+		}
+		requestTime := time.Now()
+		resp, err := do(conditional)
+		if err != nil {
+			return nil, cacheMiss, err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			c.refresh(entry, resp.Header, requestTime, time.Now())
+			if served, ok := c.serve(entry, req, time.Now()); ok {
+				c.revalidated.Add(1)
+				return served, cacheRevalidated, nil
+			}
+			requestTime = time.Now()
+			if resp, err = do(req); err != nil {
+				return nil, cacheMiss, err
+			}
+		}
+		c.misses.Add(1)
+		return c.store(req, resp, requestTime), cacheMiss, nil
+	}
+
+	c.misses.Add(1)
+	requestTime := time.Now()
+	resp, err := do(req)
+	if err != nil {
+		return nil, cacheMiss, err
+	}
+	return c.store(req, resp, requestTime), cacheMiss, nil
+}
+
+// lookup finds the stored variant of key matching the request headers
+// named by its Vary header.
+func (c *responseCache) lookup(key string, header http.Header) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.byURL[key] {
+		if entry.matches(header) {
+			c.lru.MoveToFront(entry.elem)
+			return entry
+		}
+	}
+	return nil
+}
+
+// serve builds a response from a stored entry. It fails if the body was
+// removed from disk in the meantime.
+func (c *responseCache) serve(entry *cacheEntry, req *http.Request, now time.Time) (*http.Response, bool) {
+	c.mu.Lock()
+	header := entry.Header.Clone()
+	status, size := entry.StatusCode, entry.Size
+	age := entry.age(now)
+	c.mu.Unlock()
+
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	resp := &http.Response{
+		StatusCode:    status,
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: size,
+		Request:       req,
+	}
+
+	if etag := header.Get("ETag"); etag != "" && etagMatches(req.Header.Get("If-None-Match"), etag) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 Not Modified"
+		resp.ContentLength = 0
+		resp.Header.Del("Content-Length")
+		resp.Body = http.NoBody
+		return resp, true
+	}
+
+	body, err := os.Open(c.bodyPath(entry.ID))
+	if err != nil {
+		c.remove(entry)
+		return nil, false
+	}
+	resp.Body = body
+	return resp, true
+}
+
+// store wraps resp so that its body is written to the cache while it is
+// relayed, if the response may be stored.
+func (c *responseCache) store(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	if !isStorable(req, resp) {
+		return resp
+	}
+	limit := c.maxBytes() / cacheObjectFraction
+	if resp.ContentLength > limit {
+		return resp
+	}
+
+	vary := make(map[string]string)
+	for _, field := range varyFields(resp.Header) {
+		vary[field] = strings.Join(req.Header.Values(field), ", ")
+	}
+	key := cacheKey(req.URL)
+	entry := &cacheEntry{
+		ID:           variantID(key, vary),
+		URL:          key,
+		Host:         strings.ToLower(req.URL.Hostname()),
+		StatusCode:   resp.StatusCode,
+		Header:       storedHeader(resp.Header),
+		Vary:         vary,
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+
+	file, err := os.CreateTemp(c.dir, entry.ID+"-*.tmp")
+	if err != nil {
+		log.Printf("Failed to create HTTP cache file: %v", err)
+		return resp
+	}
+	resp.Body = &cacheFill{ReadCloser: resp.Body, cache: c, entry: entry, file: file, limit: limit}
+	return resp
+}
+
+// commit publishes a fully written body.
+func (c *responseCache) commit(entry *cacheEntry, tmpPath string) {
+	meta, err := json.Marshal(entry)
+	if err == nil {
+		err = os.Rename(tmpPath, c.bodyPath(entry.ID))
+	}
+	if err == nil {
+		err = os.WriteFile(c.metaPath(entry.ID), meta, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to store cached response for %s: %v", entry.URL, err)
+		os.Remove(tmpPath)
+		return
+	}
+
+	c.mu.Lock()
+	if old, ok := c.entries[entry.ID]; ok {
+		c.unlinkLocked(old)
+	}
+	c.insertLocked(entry)
+	variants := c.byURL[entry.URL]
+	var dropped []*cacheEntry
+	if len(variants) > cacheMaxVariants {
+		dropped = append(dropped, variants[0])
+		c.unlinkLocked(variants[0])
+	}
+	c.mu.Unlock()
+
+	for _, old := range dropped {
+		c.deleteFiles(old.ID)
+	}
+	c.stored.Add(1)
+	c.evict()
+}
+
+// refresh applies the headers of a 304 response to a stored entry.
+func (c *responseCache) refresh(entry *cacheEntry, header http.Header, requestTime, responseTime time.Time) {
+	c.mu.Lock()
+	for name, values := range storedHeader(header) {
+		if name == "Content-Length" {
+			continue
+		}
+		entry.Header[name] = values
+	}
+	entry.RequestTime = requestTime
+	entry.ResponseTime = responseTime
+	meta, err := json.Marshal(entry)
+	c.mu.Unlock()
+
+	if err == nil {
+		err = os.WriteFile(c.metaPath(entry.ID), meta, 0o600)
+	}
+	if err != nil {
+		log.Printf("Failed to update cached response for %s: %v", entry.URL, err)
+	}
+}
+
+// evict drops least recently used entries until the cache fits.
+func (c *responseCache) evict() {
+	max := c.maxBytes()
+	var dropped []*cacheEntry
+	c.mu.Lock()
+	for c.size > max && c.lru.Len() > 0 {
+		entry := c.lru.Back().Value.(*cacheEntry)
+		c.unlinkLocked(entry)
+		dropped = append(dropped, entry)
+	}
+	c.mu.Unlock()
+
+	for _, entry := range dropped {
+		c.deleteFiles(entry.ID)
+	}
+	c.evicted.Add(int64(len(dropped)))
+}
+
+func (c *responseCache) insertLocked(entry *cacheEntry) {
+	entry.elem = c.lru.PushFront(entry)
+	c.entries[entry.ID] = entry
+	c.byURL[entry.URL] = append(c.byURL[entry.URL], entry)
+	c.size += entry.Size
+}
+
+func (c *responseCache) unlinkLocked(entry *cacheEntry) {
+	if c.entries[entry.ID] != entry {
+		return
+	}
+	c.lru.Remove(entry.elem)
+	delete(c.entries, entry.ID)
+	variants := c.byURL[entry.URL]
+	for i, v := range variants {
+		if v == entry {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.byURL, entry.URL)
+	} else {
+		c.byURL[entry.URL] = variants
+	}
+	c.size -= entry.Size
+}
+
+func (c *responseCache) remove(entry *cacheEntry) {
+	c.mu.Lock()
+	c.unlinkLocked(entry)
+	c.mu.Unlock()
+	c.deleteFiles(entry.ID)
+}
+
+func (c *responseCache) deleteFiles(id string) {
+	os.Remove(c.metaPath(id))
+	os.Remove(c.bodyPath(id))
+}
+
+// invalidate drops every variant of key, after an unsafe request changed
+// the resource.
+func (c *responseCache) invalidate(key string) int {
+	c.mu.Lock()
+	variants := append([]*cacheEntry(nil), c.byURL[key]...)
+	for _, entry := range variants {
+		c.unlinkLocked(entry)
+	}
+	c.mu.Unlock()
+
+	for _, entry := range variants {
+		c.deleteFiles(entry.ID)
+	}
+	return len(variants)
+}
+
+// purge removes entries for rawURL, for host (with or without port), or
+// every entry if both are empty, and returns how many were removed.
+func (c *responseCache) purge(rawURL, host string) int {
+	if rawURL != "" {
+		parsed, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || parsed.Host == "" {
+			return 0
+		}
+		if parsed.Scheme == "" {
+			parsed.Scheme = "http"
+		}
+		return c.invalidate(cacheKey(parsed))
+	}
+
+	host = strings.ToLower(strings.TrimSpace(host))
+	var removed []*cacheEntry
+	c.mu.Lock()
+	for _, entry := range c.entries {
+		if host == "" || entry.Host == host || entry.Host == extractHost(host) {
+			removed = append(removed, entry)
+		}
+	}
+	for _, entry := range removed {
+		c.unlinkLocked(entry)
+	}
+	c.mu.Unlock()
+
+	for _, entry := range removed {
+		c.deleteFiles(entry.ID)
+	}
+	return len(removed)
+}
+
+func (c *responseCache) stats() models.HTTPCacheStats {
+	c.mu.Lock()
+	entries, size := len(c.entries), c.size
+	c.mu.Unlock()
+
+	stats := models.HTTPCacheStats{
+		Entries:     entries,
+		SizeBytes:   size,
+		MaxBytes:    c.maxBytes(),
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Revalidated: c.revalidated.Load(),
+		Stored:      c.stored.Load(),
+		Evicted:     c.evicted.Load(),
+	}
+	stats.HitRate = hitRate(stats.Hits+stats.Revalidated, stats.Misses)
+	return stats
+}
+
+// cacheFill copies a response body into a temporary file as the client
+// reads it and commits the entry once the body is complete. Bodies that
+// are cut short or grow past limit are discarded.
+type cacheFill struct {
+	io.ReadCloser
+	cache   *responseCache
+	entry   *cacheEntry
+	file    *os.File
+	limit   int64
+	written int64
+	done    bool
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.done {
+		return n, err
+	}
+	if n > 0 {
+		f.written += int64(n)
+		if f.written > f.limit {
+			f.abort()
+			return n, err
+		}
+		if _, werr := f.file.Write(p[:n]); werr != nil {
+			f.abort()
+			return n, err
+		}
+	}
+	if err == io.EOF {
+		f.done = true
+		f.entry.Size = f.written
+		if cerr := f.file.Close(); cerr != nil {
+			os.Remove(f.file.Name())
+		} else {
+			f.cache.commit(f.entry, f.file.Name())
+		}
+	} else if err != nil {
+		f.abort()
+	}
+	return n, err
+}
+
+func (f *cacheFill) Close() error {
+	f.abort()
+	return f.ReadCloser.Close()
+}
+
+func (f *cacheFill) abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+func (e *cacheEntry) matches(header http.Header) bool {
+	for field, value := range e.Vary {
+		if strings.Join(header.Values(field), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// fresh reports whether the entry may be served without revalidation
+// (RFC 9111, section 4.2).
+func (e *cacheEntry) fresh(now time.Time, reqCC map[string]string) bool {
+	respCC := parseCacheControl(e.Header)
+	if _, ok := respCC["no-cache"]; ok {
+		return false
+	}
+	lifetime := e.freshnessLifetime(respCC)
+	if maxAge, ok := ccSeconds(reqCC, "max-age"); ok && maxAge < lifetime {
+		lifetime = maxAge
+	}
+	age := e.age(now)
+	if minFresh, ok := ccSeconds(reqCC, "min-fresh"); ok {
+		age += minFresh
+	}
+	return age < lifetime
+}
+
+func (e *cacheEntry) freshnessLifetime(respCC map[string]string) time.Duration {
+	if lifetime, ok := ccSeconds(respCC, "s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := ccSeconds(respCC, "max-age"); ok {
+		return lifetime
+	}
+
+	date := e.ResponseTime
+	if parsed, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		date = parsed
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		parsed, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return parsed.Sub(date)
+	}
+	if modified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && heuristicStatuses[e.StatusCode] {
+		lifetime := date.Sub(modified) / 10
+		if lifetime > heuristicMaxLifetime {
+			lifetime = heuristicMaxLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// age is the current age of the response (RFC 9111, section 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	var apparent time.Duration
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil && e.ResponseTime.After(date) {
+		apparent = e.ResponseTime.Sub(date)
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	if corrected < apparent {
+		corrected = apparent
+	}
+	return corrected + now.Sub(e.ResponseTime)
+}
+
+// isCacheableRequest reports whether req may be answered from the cache.
+// Requests with credentials or byte ranges always go to the origin.
+func isCacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.URL.Scheme != "http" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// isStorable applies the shared cache storage rules of RFC 9111, section 3.
+// Responses that set cookies are not stored.
+func isStorable(req *http.Request, resp *http.Response) bool {
+	if !heuristicStatuses[resp.StatusCode] {
+		return false
+	}
+	if resp.Request != nil && resp.Request.URL.String() != req.URL.String() {
+		return false
+	}
+	respCC := parseCacheControl(resp.Header)
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := respCC[directive]; ok {
+			return false
+		}
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, field := range varyFields(resp.Header) {
+		if field == "*" {
+			return false
+		}
+	}
+
+	_, public := respCC["public"]
+	_, maxAge := respCC["max-age"]
+	_, sMaxAge := respCC["s-maxage"]
+	return public || maxAge || sMaxAge || resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("Last-Modified") != "" || resp.Header.Get("ETag") != ""
+}
+
+// parseCacheControl returns the Cache-Control directives in header with
+// lowercased names.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, arg, _ := strings.Cut(part, "=")
+			directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return directives
+}
+
+func ccSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	return fields
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	weak := func(tag string) string { return strings.TrimPrefix(strings.TrimSpace(tag), "W/") }
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimSpace(candidate) == "*" || weak(candidate) == weak(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheKey normalizes u to the form entries are indexed by.
+func cacheKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = strings.ToLower(u.Hostname())
+	}
+	return scheme + "://" + host + u.RequestURI()
+}
+
+func variantID(key string, vary map[string]string) string {
+	fields := make([]string, 0, len(vary))
+	for field := range vary {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, field := range fields {
+		h.Write([]byte{0})
+		h.Write([]byte(field + ":" + vary[field]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	removeHopHeaders(stored)
+	stored.Del("Age")
+	stored.Del("X-Cache")
+	return stored
+}
+
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		Status:     "504 Gateway Timeout",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Length": {"0"}},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// HTTPCacheStats reports the size and hit rate of the response cache.
+func (ps *ProxyServer) HTTPCacheStats() models.HTTPCacheStats {
+	if ps.httpCache == nil {
+		return models.HTTPCacheStats{MaxBytes: ps.settings.get().HTTPCacheMaxBytes}
+	}
+	stats := ps.httpCache.stats()
+	stats.Enabled = ps.settings.get().HTTPCacheEnabled
+	return stats
+}
+
+// PurgeHTTPCache removes cached responses for rawURL or host, or every
+// cached response if both are empty, and returns how many were removed.
+func (ps *ProxyServer) PurgeHTTPCache(rawURL, host string) int {
+	if ps.httpCache == nil {
+		return 0
+	}
+	return ps.httpCache.purge(rawURL, host)
+}
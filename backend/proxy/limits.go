@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/models"
+)
+
+const (
+	reasonUserConnectionLimit = "user_connection_limit"
+	reasonUserRateLimit       = "user_rate_limit"
+
+	// userStateSweepInterval is how often per-user state of idle users is
+	// dropped, and userStateIdleTimeout how long it is kept unused.
+	userStateSweepInterval = 10 * time.Minute
+	userStateIdleTimeout   = 30 * time.Minute
+)
+
+// userLimiter enforces per-user concurrent connection and request-rate
+// limits. Rate limits use token buckets sized to the limit, so a user may
+// burst up to a full second's or minute's allowance at once.
+type userLimiter struct {
+	mu    sync.Mutex
+	users map[int]*userLimitState
+}
+
+type userLimitState struct {
+	active    atomic.Int64
+	perSecond tokenBucket
+	perMinute tokenBucket
+	// lastUsed is guarded by userLimiter.mu.
+	lastUsed time.Time
+}
+
+func newUserLimiter() *userLimiter {
+	return &userLimiter{users: make(map[int]*userLimitState)}
+}
+
+func (l *userLimiter) state(userID int) *userLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, ok := l.users[userID]
+	if !ok {
+		st = &userLimitState{}
+		l.users[userID] = st
+	}
+	st.lastUsed = time.Now()
+	return st
+}
+
+// forget drops the state of a deleted user.
+func (l *userLimiter) forget(userID int) {
+	l.mu.Lock()
+	delete(l.users, userID)
+	l.mu.Unlock()
+}
+
+// sweep drops the state of users without open connections that has not
+// been used since cutoff. Their buckets would be full again by now anyway.
+func (l *userLimiter) sweep(cutoff time.Time, busy map[int]struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for userID, st := range l.users {
+		if _, ok := busy[userID]; !ok && st.active.Load() == 0 && st.lastUsed.Before(cutoff) {
+			delete(l.users, userID)
+		}
+	}
+}
+
+// acquire admits a new request for the user. On success the returned
+// function must be called when the connection ends; on rejection the
+// request_logs reason is returned instead.
+func (l *userLimiter) acquire(userID int, limit *models.RequestLimit) (func(), string) {
+	st := l.state(userID)
+
+	max := int64(limit.MaxConnections)
+	if n := st.active.Add(1); max > 0 && n > max {
+		st.active.Add(-1)
+		return nil, reasonUserConnectionLimit
+	}
+
+	// A request rejected by one bucket gives back what it took from the
+	// other, so rejected requests do not use up the allowance.
+	st.perSecond.configure(float64(limit.RequestsPerSecond), float64(limit.RequestsPerSecond))
+	st.perMinute.configure(float64(limit.RequestsPerMinute)/60, float64(limit.RequestsPerMinute))
+	if !st.perSecond.allow() {
+		st.active.Add(-1)
+		return nil, reasonUserRateLimit
+	}
+	if !st.perMinute.allow() {
+		st.perSecond.refund()
+		st.active.Add(-1)
+		return nil, reasonUserRateLimit
+	}
+	return func() { st.active.Add(-1) }, ""
+}
+
+// sweepIdleUsers periodically drops the limiter, quota, bandwidth and
+// compiled policy state of users that have been idle for
+// userStateIdleTimeout, so that it does not pile up for every user that
+// ever connected.
+func (ps *ProxyServer) sweepIdleUsers(ctx context.Context) {
+	ticker := time.NewTicker(userStateSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cutoff := time.Now().Add(-userStateIdleTimeout)
+		busy := ps.conns.users()
+		ps.limiter.sweep(cutoff, busy)
+		ps.quotas.sweep(cutoff, busy)
+		ps.bandwidth.sweep(cutoff, busy)
+		ps.policies.sweep(cutoff)
+	}
+}
+
+// forgetUser drops the per-user state of a deleted user.
+func (ps *ProxyServer) forgetUser(userID int) {
+	ps.limiter.forget(userID)
+	ps.quotas.forget(userID)
+	ps.bandwidth.forget(userID)
+}
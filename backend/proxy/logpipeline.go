@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+)
+
+const (
+	logQueueSize      = 10000
+	logBatchSize      = 500
+	logFlushInterval  = time.Second
+	logEnqueueTimeout = 50 * time.Millisecond
+)
+
+type trafficKey struct {
+	userID int
+	date   string
+}
+
+// logPipeline takes request logging and traffic accounting off the request
+// path. Logs are queued and written in batches with COPY; traffic is summed
+// per user and day in memory and upserted once per flush.
+//
+// When the queue is full a request waits up to logEnqueueTimeout before its
+// log row is dropped. Traffic deltas are never dropped: if the database is
+// unavailable they are kept and retried on the next flush.
+type logPipeline struct {
+	db    *database.Database
+	queue chan models.RequestLog
+
+	mu       sync.Mutex
+	traffic  map[trafficKey]*models.TrafficStats
+	flushing []models.TrafficStats
+	retry    []models.RequestLog
+
+	dropped  atomic.Int64
+	reported int64
+	stopped  atomic.Bool
+}
+
+func newLogPipeline(db *database.Database) *logPipeline {
+	return &logPipeline{
+		db:      db,
+		queue:   make(chan models.RequestLog, logQueueSize),
+		traffic: make(map[trafficKey]*models.TrafficStats),
+	}
+}
+
+// enqueue schedules a request log row for writing.
+func (p *logPipeline) enqueue(entry models.RequestLog) {
+	if p.stopped.Load() {
+		p.dropped.Add(1)
+		return
+	}
+	select {
+	case p.queue <- entry:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(logEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.queue <- entry:
+	case <-timer.C:
+		p.dropped.Add(1)
+	}
+}
+
+// addTraffic accumulates one finished request for the user.
+func (p *logPipeline) addTraffic(userID int, bytesSent, bytesReceived int64, at time.Time) {
+	p.accumulate(userID, bytesSent, bytesReceived, 1, at)
+}
+
+// addLiveTraffic accumulates bytes of a connection that is still open; the
+// request itself is counted by addTraffic when it finishes.
+func (p *logPipeline) addLiveTraffic(userID int, bytesSent, bytesReceived int64, at time.Time) {
+	p.accumulate(userID, bytesSent, bytesReceived, 0, at)
+}
+
+func (p *logPipeline) accumulate(userID int, bytesSent, bytesReceived int64, requests int, at time.Time) {
+	year, month, day := at.Date()
+	date := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	key := trafficKey{userID: userID, date: date.Format("2006-01-02")}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delta, ok := p.traffic[key]
+	if !ok {
+		delta = &models.TrafficStats{UserID: userID, Date: date}
+		p.traffic[key] = delta
+	}
+	delta.BytesSent += bytesSent
+	delta.BytesReceived += bytesReceived
+	delta.RequestCount += requests
+}
+
+// pendingUsage returns traffic accepted but not yet stored for the user,
+// in the same shape as the quota usage read from traffic_stats.
+func (p *logPipeline) pendingUsage(userID int, now time.Time) models.QuotaUsage {
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+
+	var usage models.QuotaUsage
+	add := func(delta *models.TrafficStats) {
+		if delta.UserID != userID || delta.Date.Before(monthStart) {
+			return
+		}
+		bytes := delta.BytesSent + delta.BytesReceived
+		usage.MonthlyBytes += bytes
+		usage.MonthlyRequests += int64(delta.RequestCount)
+		if delta.Date.Equal(today) {
+			usage.DailyBytes += bytes
+			usage.DailyRequests += int64(delta.RequestCount)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, delta := range p.traffic {
+		add(delta)
+	}
+	for i := range p.flushing {
+		add(&p.flushing[i])
+	}
+	return usage
+}
+
+// run writes logs and traffic until ctx is cancelled, then stops accepting
+// logs and writes out what is still queued.
+func (p *logPipeline) run(ctx context.Context) {
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.RequestLog, 0, logBatchSize)
+	for {
+		select {
+		case entry := <-p.queue:
+			batch = append(batch, entry)
+			if len(batch) >= logBatchSize {
+				p.flushLogs(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			p.flushLogs(batch)
+			batch = batch[:0]
+			p.flushTraffic()
+			p.reportDrops()
+		case <-ctx.Done():
+			p.stopped.Store(true)
+		drain:
+			for {
+				select {
+				case entry := <-p.queue:
+					batch = append(batch, entry)
+				default:
+					break drain
+				}
+			}
+			p.flushLogs(batch)
+			p.flushTraffic()
+			p.reportDrops()
+			return
+		}
+	}
+}
+
+func (p *logPipeline) flushLogs(batch []models.RequestLog) {
+	logs := append(p.retry, batch...)
+	p.retry = nil
+	if len(logs) == 0 {
+		return
+	}
+
+	err := p.db.InsertRequestLogs(logs)
+	if err == nil {
+		return
+	}
+	if database.IsConstraintError(err) {
+		// A row references something that is gone (e.g. a deleted user);
+		// store the rest individually.
+		for i := range logs {
+			if err := p.db.LogRequest(&logs[i]); err != nil {
+				p.dropped.Add(1)
+			}
+		}
+		return
+	}
+
+	log.Printf("Failed to write %d request logs, will retry: %v", len(logs), err)
+	if over := len(logs) - logQueueSize; over > 0 {
+		p.dropped.Add(int64(over))
+		logs = logs[over:]
+	}
+	p.retry = append([]models.RequestLog(nil), logs...)
+}
+
+func (p *logPipeline) flushTraffic() {
+	p.mu.Lock()
+	if len(p.traffic) == 0 {
+		p.mu.Unlock()
+		return
+	}
+	deltas := make([]models.TrafficStats, 0, len(p.traffic))
+	for _, delta := range p.traffic {
+		deltas = append(deltas, *delta)
+	}
+	p.traffic = make(map[trafficKey]*models.TrafficStats)
+	p.flushing = deltas
+	p.mu.Unlock()
+
+	err := p.db.AddTrafficStats(deltas)
+	if err != nil && database.IsConstraintError(err) {
+		for _, delta := range deltas {
+			if err := p.db.AddTrafficStats([]models.TrafficStats{delta}); err != nil && !database.IsConstraintError(err) {
+				log.Printf("Failed to update traffic stats for user %d: %v", delta.UserID, err)
+			}
+		}
+		err = nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flushing = nil
+	if err == nil {
+		return
+	}
+
+	log.Printf("Failed to update traffic stats, will retry: %v", err)
+	for _, delta := range deltas {
+		key := trafficKey{userID: delta.UserID, date: delta.Date.Format("2006-01-02")}
+		if existing, ok := p.traffic[key]; ok {
+			existing.BytesSent += delta.BytesSent
+			existing.BytesReceived += delta.BytesReceived
+			existing.RequestCount += delta.RequestCount
+			continue
+		}
+		d := delta
+		p.traffic[key] = &d
+	}
+}
+
+func (p *logPipeline) reportDrops() {
+	dropped := p.dropped.Load()
+	if dropped > p.reported {
+		log.Printf("Request log pipeline dropped %d entries (%d total)", dropped-p.reported, dropped)
+		p.reported = dropped
+	}
+}
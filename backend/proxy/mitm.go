@@ -0,0 +1,429 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/utils"
+)
+
+const (
+	reasonMITMHandshake = "mitm_handshake_failed"
+	// reasonHostMismatch is logged for intercepted requests whose SNI or
+	// Host names another server than the CONNECT target, which the rules
+	// were checked against.
+	reasonHostMismatch = "host_mismatch"
+
+	caValidity = 10 * 365 * 24 * time.Hour
+	// Leaf certificates are short-lived and re-minted from the cache well
+	// before they expire.
+	leafValidity   = 7 * 24 * time.Hour
+	leafRenewAfter = 6 * 24 * time.Hour
+	leafCacheSize  = 1024
+
+	tlsRecordHandshake = 0x16
+)
+
+// certAuthority signs leaf certificates for intercepted hosts. The CA comes
+// from MITM_CA_CERT/MITM_CA_KEY when set; otherwise it is generated once
+// and kept in the database with its key encrypted.
+type certAuthority struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+	// leafKey is shared by all minted certificates; generating a key per
+	// host would dominate handshake cost.
+	leafKey *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	leaves map[string]leafEntry
+}
+
+type leafEntry struct {
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+func loadCertAuthority(db *database.Database) (*certAuthority, error) {
+	var certPEM, keyPEM []byte
+	if certFile, keyFile := os.Getenv("MITM_CA_CERT"), os.Getenv("MITM_CA_KEY"); certFile != "" || keyFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(certFile); err != nil {
+			return nil, fmt.Errorf("read MITM_CA_CERT: %w", err)
+		}
+		if keyPEM, err = os.ReadFile(keyFile); err != nil {
+			return nil, fmt.Errorf("read MITM_CA_KEY: %w", err)
+		}
+	} else {
+		storedCert, storedKey, err := db.GetMITMCA()
+		if errors.Is(err, sql.ErrNoRows) {
+			storedCert, storedKey, err = createStoredCA(db)
+		}
+		if err != nil {
+			return nil, err
+		}
+		decrypted, err := utils.DecryptSecret(storedKey)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt CA key: %w", err)
+		}
+		certPEM, keyPEM = []byte(storedCert), []byte(decrypted)
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse CA: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %q is not a CA", cert.Subject.CommonName)
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key type %T", pair.PrivateKey)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certAuthority{
+		cert:    cert,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		key:     signer,
+		leafKey: leafKey,
+		leaves:  make(map[string]leafEntry),
+	}, nil
+}
+
+func createStoredCA(db *database.Database) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Progzy Interception CA", Organization: []string{"Progzy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	encrypted, err := utils.EncryptSecret(string(keyPEM))
+	if err != nil {
+		return "", "", fmt.Errorf("encrypt CA key: %w", err)
+	}
+	log.Printf("Generated TLS interception CA (serial %s)", serial.Text(16))
+	return db.SaveMITMCA(string(certPEM), encrypted)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// certificate returns a leaf certificate for host, minting one if the
+// cache has none that is still fresh.
+func (ca *certAuthority) certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+
+	ca.mu.Lock()
+	entry, ok := ca.leaves[host]
+	ca.mu.Unlock()
+	if ok && now.Before(entry.renewAt) {
+		return entry.cert, nil
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+	}
+
+	ca.mu.Lock()
+	if len(ca.leaves) >= leafCacheSize {
+		for name, e := range ca.leaves {
+			if now.After(e.renewAt) || len(ca.leaves) >= leafCacheSize {
+				delete(ca.leaves, name)
+			}
+		}
+	}
+	ca.leaves[host] = leafEntry{cert: cert, renewAt: now.Add(leafRenewAfter)}
+	ca.mu.Unlock()
+	return cert, nil
+}
+
+// shouldIntercept reports whether a tunnel to host and port is decrypted:
+// interception must be enabled globally, the host must not be bypassed and
+// the user must have opted in for all destinations or this one.
+func (ps *ProxyServer) shouldIntercept(policy *userPolicy, host string, port int) bool {
+	if ps.mitm == nil || !ps.settings.get().MITMEnabled {
+		return false
+	}
+	if ps.settings.mitmBypass().Match(host, port) {
+		return false
+	}
+	return policy.MITMEnabled || policy.mitmHosts.Match(host, port)
+}
+
+// CACertificate returns the PEM encoded interception CA so that clients
+// can be configured to trust it.
+func (ps *ProxyServer) CACertificate() ([]byte, error) {
+	if ps.mitm == nil {
+		return nil, fmt.Errorf("TLS interception CA is not available")
+	}
+	return ps.mitm.certPEM, nil
+}
+
+// interceptTLS terminates the client's TLS session with a certificate
+// minted for the target, then forwards each decrypted request over a new
+// TLS session to the destination. Every request is checked against the
+// user's URL rules and logged on its own. Clients that do not start with
+// a TLS handshake are tunnelled unchanged.
+func (ps *ProxyServer) interceptTLS(ctx context.Context, clientConn net.Conn, clientReader *bufio.Reader, destConn net.Conn, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, target string, startTime time.Time) {
+	host, port := splitTarget(target, 443)
+	timeout := ps.settings.get().Timeout
+
+	clientConn.SetReadDeadline(time.Now().Add(timeout))
+	first, err := clientReader.Peek(1)
+	clientConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		ps.logRequest(claims.UserID, http.MethodConnect, target, http.StatusOK, 0, 0, startTime)
+		return
+	}
+	if first[0] != tlsRecordHandshake {
+		ps.tunnel(ctx, &bufferedConn{Conn: clientConn, reader: clientReader}, destConn, claims, prefs, meter, target, startTime)
+		return
+	}
+
+	tlsConn := tls.Server(&bufferedConn{Conn: clientConn, reader: clientReader}, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		// The certificate is only ever minted for the CONNECT target: a
+		// client may not use it to reach another name on the same address.
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" && !sameHost(hello.ServerName, host) {
+				return nil, fmt.Errorf("server name %q does not match %s", hello.ServerName, host)
+			}
+			return ps.mitm.certificate(host)
+		},
+	})
+	defer tlsConn.Close()
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		ps.logRequestReason(claims.UserID, http.MethodConnect, target, http.StatusBadGateway, 0, 0, startTime, reasonMITMHandshake)
+		return
+	}
+
+	// The destination connection dialed for the CONNECT is handed to the
+	// transport first; later connections are dialed the same way.
+	conns := make(chan net.Conn, 1)
+	conns <- destConn
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			select {
+			case conn := <-conns:
+				return conn, nil
+			default:
+			}
+			return ps.dialTarget(ctx, prefs, addr)
+		},
+		TLSClientConfig:       &tls.Config{ServerName: host},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		DisableCompression:    true,
+	}
+	defer transport.CloseIdleConnections()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go meter.watch(stop, func(*quotaExceededError) {
+		tlsConn.Close()
+	})
+
+	reader := bufio.NewReader(tlsConn)
+	client := &bufferedConn{Conn: tlsConn, reader: reader}
+	for {
+		tlsConn.SetReadDeadline(time.Now().Add(timeout))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		tlsConn.SetReadDeadline(time.Time{})
+
+		if !ps.forwardIntercepted(ctx, client, req, transport, claims, prefs, meter, host, port, target) {
+			return
+		}
+	}
+}
+
+// forwardIntercepted relays one decrypted request and reports whether the
+// client connection may be reused. Accepted protocol upgrades take over the
+// connection until it closes.
+func (ps *ProxyServer) forwardIntercepted(ctx context.Context, w net.Conn, req *http.Request, transport *http.Transport, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, host string, port int, target string) bool {
+	startTime := time.Now()
+	origin := target
+	if port == 443 {
+		origin = strings.TrimSuffix(target, ":443")
+	}
+	requestURL := "https://" + origin + req.URL.RequestURI()
+
+	if exceeded := meter.exceeded(); exceeded != nil {
+		writeInterceptedError(w, req, http.StatusTooManyRequests, exceeded.message())
+		ps.logRequestReason(claims.UserID, req.Method, requestURL, http.StatusTooManyRequests, 0, 0, startTime, exceeded.reason())
+		return false
+	}
+	if req.Host != "" && !sameHost(req.Host, host) {
+		writeInterceptedError(w, req, http.StatusForbidden, "Host does not match the CONNECT target")
+		ps.logRequestReason(claims.UserID, req.Method, requestURL, http.StatusForbidden, 0, 0, startTime, reasonHostMismatch)
+		return false
+	}
+	if !isURLAllowed(prefs, host, port, req.URL.EscapedPath()) {
+		writeInterceptedError(w, req, http.StatusForbidden, "Access to this URL is not permitted")
+		ps.logRequest(claims.UserID, req.Method, requestURL, http.StatusForbidden, 0, 0, startTime)
+		return false
+	}
+
+	req.URL.Scheme = "https"
+	req.URL.Host = hostWithPort(target, "443")
+	req.Host = origin
+	req.RequestURI = ""
+	req = req.WithContext(ctx)
+	upgrade := prepareOutboundHeader(req.Header)
+
+	upload := &meteredReader{ReadCloser: prefs.bandwidth.uploadReader(ctx, req.Body), meter: meter}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = upload
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		if isEgressDenied(err) {
+			writeInterceptedError(w, req, http.StatusForbidden, "Access to this destination is not permitted")
+			ps.logRequestReason(claims.UserID, req.Method, requestURL, http.StatusForbidden, upload.n, 0, startTime, reasonPrivateDestination)
+			return false
+		}
+		writeInterceptedError(w, req, http.StatusBadGateway, err.Error())
+		ps.logRequest(claims.UserID, req.Method, requestURL, http.StatusBadGateway, upload.n, 0, startTime)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if upgrade == "" || !strings.EqualFold(upgradeType(resp.Header), upgrade) {
+			writeInterceptedError(w, req, http.StatusBadGateway, "Upstream switched to an unrequested protocol")
+			ps.logRequest(claims.UserID, req.Method, requestURL, http.StatusBadGateway, upload.n, 0, startTime)
+			return false
+		}
+		ps.relayUpgrade(ctx, w, resp, claims, prefs, meter, req.Method, requestURL, upload.n, startTime)
+		return false
+	}
+
+	removeHopHeaders(resp.Header)
+	download := &countingWriter{w: meteredWriter{w: prefs.bandwidth.download(ctx, w), meter: meter}}
+	err = resp.Write(download)
+
+	ps.logRequest(claims.UserID, req.Method, requestURL, resp.StatusCode, upload.n, download.n, startTime)
+	ps.recordTraffic(claims.UserID, meter, upload.n, download.n)
+	return err == nil && !resp.Close && !req.Close
+}
+
+func writeInterceptedError(w io.Writer, req *http.Request, status int, message string) {
+	body := message + "\n"
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	resp.Write(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// sameHost reports whether name, with or without a port, is host.
+func sameHost(name, host string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	name = strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+	return name == strings.TrimSuffix(strings.ToLower(host), ".")
+}
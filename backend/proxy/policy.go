@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"hash/fnv"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/models"
+	"proxy-server/rules"
+	"proxy-server/schedule"
+)
+
+// userPolicy couples a user's proxy settings with matchers compiled from
+// their list entries and the bandwidth buckets shared by their connections.
+type userPolicy struct {
+	*models.UserProxySettings
+	whitelist        rules.Set
+	blacklist        rules.Set
+	egressExceptions *rules.Matcher
+	mitmHosts        *rules.Matcher
+	upstreamRules    []upstreamRoute
+	sourceAddrs      []net.IP
+	clientNets       []*net.IPNet
+	schedule         *schedule.Schedule
+	rotation         *atomic.Uint64
+	bandwidth        *userBandwidth
+}
+
+type upstreamRoute struct {
+	matcher *rules.Matcher
+	pool    string
+}
+
+type compiledLists struct {
+	fingerprint      uint64
+	whitelist        rules.Set
+	blacklist        rules.Set
+	egressExceptions *rules.Matcher
+	mitmHosts        *rules.Matcher
+	upstreamRules    []upstreamRoute
+	sourceAddrs      []net.IP
+	clientNets       []*net.IPNet
+	schedule         *schedule.Schedule
+	// rotation is shared by every policy compiled from these lists, so
+	// round robin continues across requests.
+	rotation *atomic.Uint64
+	// lastUsed is guarded by policyCompiler.mu.
+	lastUsed time.Time
+}
+
+// policyCompiler memoizes compiled matchers per user. Lists are only
+// recompiled when their contents change.
+type policyCompiler struct {
+	hostLists *hostListCache
+
+	mu     sync.Mutex
+	byUser map[int]*compiledLists
+}
+
+func newPolicyCompiler(hostLists *hostListCache) *policyCompiler {
+	return &policyCompiler{hostLists: hostLists, byUser: make(map[int]*compiledLists)}
+}
+
+func (c *policyCompiler) compile(userID int, settings *models.UserProxySettings) *userPolicy {
+	fingerprint := fingerprintSettings(settings)
+
+	c.mu.Lock()
+	compiled, ok := c.byUser[userID]
+	if ok {
+		compiled.lastUsed = time.Now()
+	}
+	c.mu.Unlock()
+
+	if !ok || compiled.fingerprint != fingerprint {
+		compiled = &compiledLists{
+			fingerprint:      fingerprint,
+			whitelist:        c.hostLists.set(compileList(userID, "whitelist", settings.Whitelist), settings.WhitelistLists),
+			blacklist:        c.hostLists.set(compileList(userID, "blacklist", settings.Blacklist), settings.BlacklistLists),
+			egressExceptions: compileList(userID, "egress exception", settings.EgressExceptions),
+			mitmHosts:        compileList(userID, "interception host", settings.MITMHosts),
+			sourceAddrs:      parseSourceAddrs(userID, settings.EgressAddresses),
+			clientNets:       parseClientNets(userID, settings.ClientAllowlist),
+			schedule:         compileSchedule(userID, settings.Schedule),
+			rotation:         new(atomic.Uint64),
+		}
+		for _, rule := range settings.UpstreamRules {
+			compiled.upstreamRules = append(compiled.upstreamRules, upstreamRoute{
+				matcher: compileList(userID, "upstream rule", []string{rule.Pattern}),
+				pool:    rule.Pool,
+			})
+		}
+
+		c.mu.Lock()
+		compiled.lastUsed = time.Now()
+		c.byUser[userID] = compiled
+		c.mu.Unlock()
+	}
+
+	return &userPolicy{
+		UserProxySettings: settings,
+		whitelist:         compiled.whitelist,
+		blacklist:         compiled.blacklist,
+		egressExceptions:  compiled.egressExceptions,
+		mitmHosts:         compiled.mitmHosts,
+		upstreamRules:     compiled.upstreamRules,
+		sourceAddrs:       compiled.sourceAddrs,
+		clientNets:        compiled.clientNets,
+		schedule:          compiled.schedule,
+		rotation:          compiled.rotation,
+	}
+}
+
+func (c *policyCompiler) forget(userID int) {
+	c.mu.Lock()
+	delete(c.byUser, userID)
+	c.mu.Unlock()
+}
+
+// sweep drops the matchers of users, and the host lists, that have not
+// been compiled since cutoff. Policies already handed out keep theirs.
+func (c *policyCompiler) sweep(cutoff time.Time) {
+	c.mu.Lock()
+	for userID, compiled := range c.byUser {
+		if compiled.lastUsed.Before(cutoff) {
+			delete(c.byUser, userID)
+		}
+	}
+	c.mu.Unlock()
+	c.hostLists.sweep(cutoff)
+}
+
+func compileList(userID int, name string, entries []string) *rules.Matcher {
+	matcher, errs := rules.Compile(entries)
+	for _, err := range errs {
+		log.Printf("Ignoring invalid %s entry for user %d: %v", name, userID, err)
+	}
+	return matcher
+}
+
+func fingerprintSettings(settings *models.UserProxySettings) uint64 {
+	h := fnv.New64a()
+	write := func(values ...string) {
+		for _, v := range values {
+			h.Write([]byte(v))
+			h.Write([]byte{0})
+		}
+		h.Write([]byte{1})
+	}
+	write(settings.Whitelist...)
+	write(settings.Blacklist...)
+	for _, refs := range [][]models.HostListRef{settings.WhitelistLists, settings.BlacklistLists} {
+		for _, ref := range refs {
+			write(strconv.Itoa(ref.ID), strconv.Itoa(ref.Revision))
+		}
+		write()
+	}
+	write(settings.EgressExceptions...)
+	write(settings.MITMHosts...)
+	for _, rule := range settings.UpstreamRules {
+		write(rule.Pattern, rule.Pool)
+	}
+	write(settings.EgressAddresses...)
+	write(settings.ClientAllowlist...)
+	write(settings.Schedule.TimeZone)
+	write(settings.Schedule.Windows...)
+	write(settings.Schedule.Holidays...)
+	return h.Sum64()
+}
+
+func isHostAllowed(policy *userPolicy, host string, port int) bool {
+	if policy == nil || policy.UserProxySettings == nil {
+		return true
+	}
+	if host == "" {
+		return true
+	}
+	switch strings.ToLower(policy.ProxyType) {
+	case "whitelist":
+		return policy.whitelist.Match(host, port)
+	case "blacklist":
+		return !policy.blacklist.Match(host, port)
+	default:
+		return true
+	}
+}
+
+// isURLAllowed is isHostAllowed for requests whose path is known, so that
+// path rules apply as well. rawPath is the escaped path; requests whose
+// path climbs above the root are refused outright.
+func isURLAllowed(policy *userPolicy, host string, port int, rawPath string) bool {
+	if policy == nil || policy.UserProxySettings == nil {
+		return true
+	}
+	if host == "" {
+		return true
+	}
+	if _, ok := rules.CleanPath(rawPath); !ok {
+		return false
+	}
+	switch strings.ToLower(policy.ProxyType) {
+	case "whitelist":
+		return policy.whitelist.MatchURL(host, port, rawPath)
+	case "blacklist":
+		return !policy.blacklist.MatchURL(host, port, rawPath)
+	default:
+		return true
+	}
+}
+
+// isTunnelAllowed admits an intercepted tunnel that some request could be
+// allowed through; each request is then checked with isURLAllowed.
+func isTunnelAllowed(policy *userPolicy, host string, port int) bool {
+	if policy == nil || policy.UserProxySettings == nil {
+		return true
+	}
+	if strings.ToLower(policy.ProxyType) == "whitelist" {
+		return policy.whitelist.MatchAnyPath(host, port)
+	}
+	return isHostAllowed(policy, host, port)
+}
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -9,42 +11,265 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"proxy-server/database"
+	"proxy-server/guard"
 	"proxy-server/models"
 	"proxy-server/utils"
 )
 
 type ProxyServer struct {
-	db     *database.Database
-	server *http.Server
+	db             *database.Database
+	server         *http.Server
+	upstreams      *upstreamManager
+	settings       *settingsWatcher
+	policies       *policyCompiler
+	quotas         *quotaTracker
+	bandwidth      *bandwidthManager
+	limiter        *userLimiter
+	cache          *authCache
+	logs           *logPipeline
+	mitm           *certAuthority
+	tls            *proxyTLS
+	httpCache      *responseCache
+	transports     *transportPool
+	conns          *connRegistry
+	tokenUsage     *tokenUsage
+	guard          *guard.LoginGuard
+	trustedProxies []*net.IPNet
+	activeConns    atomic.Int64
+
+	// loopCtx is cancelled by Shutdown once connections are drained, and
+	// the background loops tracked by loops then flush and return.
+	loopCtx   context.Context
+	stopLoops context.CancelFunc
+	loops     sync.WaitGroup
 }
 
-func NewProxyServer(db *database.Database, port string) *ProxyServer {
+func NewProxyServer(db *database.Database, port string, loginGuard *guard.LoginGuard) *ProxyServer {
+	logs := newLogPipeline(db)
 	ps := &ProxyServer{
-		db: db,
+		db:         db,
+		upstreams:  newUpstreamManager(db),
+		settings:   newSettingsWatcher(db),
+		policies:   newPolicyCompiler(newHostListCache(db)),
+		quotas:     newQuotaTracker(db, logs),
+		bandwidth:  newBandwidthManager(db),
+		limiter:    newUserLimiter(),
+		cache:      newAuthCache(),
+		logs:       logs,
+		conns:      newConnRegistry(),
+		tokenUsage: newTokenUsage(db),
+		guard:      loginGuard,
+	}
+	ps.transports = newTransportPool(ps)
+	ps.loopCtx, ps.stopLoops = context.WithCancel(context.Background())
+
+	ca, err := loadCertAuthority(db)
+	if err != nil {
+		log.Printf("TLS interception unavailable: %v", err)
+	} else {
+		ps.mitm = ca
 	}
 
+	trusted, err := utils.LoadTrustedProxies("PROXY_TRUSTED_PROXIES")
+	if err != nil {
+		log.Printf("Ignoring trusted proxies: %v", err)
+	} else {
+		ps.trustedProxies = trusted
+	}
+
+	listenerTLS, err := loadProxyTLS()
+	if err != nil {
+		log.Printf("Proxy TLS listener unavailable: %v", err)
+	} else {
+		ps.tls = listenerTLS
+	}
+
+	httpCache, err := newResponseCache(httpCacheDir(), func() int64 { return ps.settings.get().HTTPCacheMaxBytes })
+	if err != nil {
+		log.Printf("HTTP cache unavailable: %v", err)
+	} else {
+		ps.httpCache = httpCache
+	}
+
+	// Per-request deadlines are applied from timeout_seconds in the handlers
+	// so that long-lived CONNECT tunnels are not cut by server-wide timeouts.
 	ps.server = &http.Server{
-		Addr:         ":" + port,
-		Handler:      http.HandlerFunc(ps.handleProxy),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		Addr:              ":" + port,
+		Handler:           http.HandlerFunc(ps.handleProxy),
+		ReadHeaderTimeout: 30 * time.Second,
 	}
 
 	return ps
 }
 
+// runLoop runs a background loop until Shutdown stops it.
+func (ps *ProxyServer) runLoop(loop func(ctx context.Context)) {
+	ps.loops.Add(1)
+	go func() {
+		defer ps.loops.Done()
+		loop(ps.loopCtx)
+	}()
+}
+
 func (ps *ProxyServer) Start() error {
 	log.Printf("Proxy server starting on port %s", ps.server.Addr)
-	return ps.server.ListenAndServe()
+	ps.runLoop(ps.upstreams.run)
+	ps.runLoop(ps.settings.run)
+	ps.runLoop(ps.bandwidth.run)
+	ps.runLoop(ps.cache.run)
+	ps.runLoop(ps.tokenUsage.run)
+	ps.runLoop(ps.logs.run)
+	ps.runLoop(ps.enforceSchedules)
+	ps.runLoop(ps.sweepIdleUsers)
+
+	errs := make(chan error, 2)
+	if ps.tls != nil {
+		listener, err := net.Listen("tcp", ps.tls.addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Proxy TLS listener starting on port %s", strings.TrimPrefix(ps.tls.addr, ":"))
+		go func() {
+			errs <- ps.server.Serve(tls.NewListener(listener, ps.tls.config()))
+		}()
+	}
+	go func() {
+		errs <- ps.server.ListenAndServe()
+	}()
+	return <-errs
+}
+
+// dialTarget connects to addr either directly or through the upstream pool
+// selected for the user and destination. Restricted destinations are
+// rejected with an *egressDeniedError.
+func (ps *ProxyServer) dialTarget(ctx context.Context, prefs *userPolicy, addr string) (net.Conn, error) {
+	return ps.dialRoute(ctx, prefs, selectUpstreamPool(prefs, addr), addr)
+}
+
+// dialRoute connects to addr directly, or through pool when it is set.
+// Direct connections leave from the user's egress address, if any.
+func (ps *ProxyServer) dialRoute(ctx context.Context, prefs *userPolicy, pool, addr string) (net.Conn, error) {
+	host, port := splitTarget(addr, 0)
+
+	if pool != "" {
+		if err := ps.checkEgress(ctx, prefs, host, port); err != nil {
+			return nil, err
+		}
+		return ps.upstreams.dial(ctx, pool, addr)
+	}
+	source, err := prefs.sourceAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout: ps.settings.get().Timeout,
+		Control: ps.egressControl(prefs, host),
+	}
+	if source != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: source}
+	}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// userSettings returns the user's proxy settings, served from the cache
+// when fresh.
+func (ps *ProxyServer) userSettings(userID int) (*models.UserProxySettings, error) {
+	if settings, ok := ps.cache.lookupSettings(userID); ok {
+		return settings, nil
+	}
+	gen := ps.cache.generation()
+	settings, err := ps.db.GetUserProxySettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	ps.cache.storeSettings(gen, userID, settings)
+	return settings, nil
+}
+
+// loadPolicy fetches the user's proxy settings and attaches compiled
+// matchers and bandwidth limiters for them.
+func (ps *ProxyServer) loadPolicy(userID int) (*userPolicy, error) {
+	settings, err := ps.userSettings(userID)
+	if err != nil {
+		return nil, err
+	}
+	policy := ps.policies.compile(userID, settings)
+	policy.bandwidth = ps.bandwidth.forUser(userID, settings.Bandwidth)
+	return policy, nil
+}
+
+// acquireConn reserves a slot under max_connections. A limit of zero means
+// unlimited.
+func (ps *ProxyServer) acquireConn() bool {
+	limit := int64(ps.settings.get().MaxConnections)
+	if n := ps.activeConns.Add(1); limit > 0 && n > limit {
+		ps.activeConns.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (ps *ProxyServer) releaseConn() {
+	ps.activeConns.Add(-1)
+}
+
+// admitUser applies the user's own connection and request-rate limits. It
+// returns a release function on success or the rejection reason.
+func (ps *ProxyServer) admitUser(userID int) (func(), string, error) {
+	settings, err := ps.userSettings(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	release, reason := ps.limiter.acquire(userID, &settings.Limits)
+	return release, reason, nil
+}
+
+// InvalidateUser drops cached credentials and settings for a user and
+// closes their connections that are no longer allowed. The admin API calls
+// it after changing or deleting the user; for a deleted user every piece
+// of per-user state is dropped.
+func (ps *ProxyServer) InvalidateUser(userID int) {
+	ps.cache.invalidateUser(userID)
+	ps.tokenUsage.forgetUser(userID)
+	ps.policies.forget(userID)
+	ps.transports.forgetUser(userID)
+	ps.enforceUser(userID)
+
+	missing, err := ps.db.MissingUserIDs([]int{userID})
+	if err != nil {
+		log.Printf("Failed to check whether user %d still exists: %v", userID, err)
+		return
+	}
+	if len(missing) > 0 {
+		ps.forgetUser(userID)
+	}
+}
+
+// InvalidateAll drops every cached credential and setting, for changes
+// such as global upstream rules that affect all users.
+func (ps *ProxyServer) InvalidateAll() {
+	ps.cache.invalidateAll()
+	ps.tokenUsage.forgetAll()
+}
+
+// CacheStats reports authentication and policy cache hit rates.
+func (ps *ProxyServer) CacheStats() models.CacheStats {
+	return ps.cache.stats()
 }
 
 func (ps *ProxyServer) authenticateRequest(r *http.Request) (*utils.Claims, error) {
 	authHeader := r.Header.Get("Proxy-Authorization")
 	if authHeader == "" {
+		if cert := ps.clientCertificate(r); cert != nil {
+			return ps.authenticateCertificate(cert)
+		}
 		return nil, fmt.Errorf("missing proxy authorization")
 	}
 
@@ -74,47 +299,128 @@ func (ps *ProxyServer) authenticateRequest(r *http.Request) (*utils.Claims, erro
 		}
 
 	case "Bearer":
-		claims, err := utils.ValidateToken(parts[1])
-		if err != nil {
+		// Only proxy tokens; admin API sessions are not proxy credentials.
+		if !utils.IsProxyToken(parts[1]) {
 			return nil, fmt.Errorf("invalid token")
 		}
-		if claims.IsAdmin {
-			return nil, fmt.Errorf("admin accounts cannot use proxy")
-		}
-		return claims, nil
+		return ps.guardedLogin(ps.clientIP(r), func() (*utils.Claims, error) {
+			return ps.authenticateToken("", parts[1], ps.clientIP(r))
+		})
 
 	default:
 		return nil, fmt.Errorf("unsupported authorization method")
 	}
 
-	user, err := ps.db.GetUserByUsername(username)
+	return ps.authenticateCredentials(username, password, ps.clientIP(r))
+}
+
+// authenticateCredentials checks a username with either their password or
+// one of their proxy tokens. A password that merely looks like a token is
+// checked as a password once no token matches.
+func (ps *ProxyServer) authenticateCredentials(username, password, clientIP string) (*utils.Claims, error) {
+	return ps.guardedLogin(clientIP, func() (*utils.Claims, error) {
+		if utils.IsProxyToken(password) {
+			if claims, err := ps.authenticateToken(username, password, clientIP); err == nil {
+				return claims, nil
+			}
+		}
+		return ps.authenticateUser(credentialHash(username, password), username, func(user *models.User) error {
+			if !utils.CheckPasswordHash(password, user.PasswordHash) {
+				return fmt.Errorf("invalid password")
+			}
+			return nil
+		})
+	})
+}
+
+// guardedLogin runs authenticate unless the login guard refuses the
+// client IP. A failure is counted against the IP; the caller answers it
+// straight away, and the guard refuses further attempts until their delay
+// has passed.
+func (ps *ProxyServer) guardedLogin(ip string, authenticate func() (*utils.Claims, error)) (*utils.Claims, error) {
+	if ps.guard == nil {
+		return authenticate()
+	}
+	if err := ps.guard.Check(ip); err != nil {
+		return nil, err
+	}
+
+	claims, err := authenticate()
 	if err != nil {
-		return nil, fmt.Errorf("user not found")
+		ps.guard.Failed(ip, "proxy")
+		return nil, err
 	}
+	return claims, nil
+}
 
-	if !user.IsActive {
-		return nil, fmt.Errorf("user is inactive")
+// clientCertificate returns the verified certificate the client presented
+// on the TLS listener, if client certificates are accepted.
+func (ps *ProxyServer) clientCertificate(r *http.Request) *x509.Certificate {
+	if ps.tls == nil || ps.tls.clientCAs == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
 	}
+	return r.TLS.PeerCertificates[0]
+}
 
-	if user.IsAdmin {
-		return nil, fmt.Errorf("admin accounts cannot use proxy")
+// authenticateCertificate logs in the user a verified client certificate
+// names. The certificate stands in for the password.
+func (ps *ProxyServer) authenticateCertificate(cert *x509.Certificate) (*utils.Claims, error) {
+	username, err := ps.tls.clientUsername(cert)
+	if err != nil {
+		return nil, err
 	}
+	return ps.authenticateUser(credentialHash(username, string(cert.Raw)), username, func(*models.User) error {
+		return nil
+	})
+}
 
-	if !utils.CheckPasswordHash(password, user.PasswordHash) {
-		return nil, fmt.Errorf("invalid password")
+// authenticateUser loads an active, non-admin user and checks their
+// credential with verify. Successful checks are cached under key.
+func (ps *ProxyServer) authenticateUser(key credentialKey, username string, verify func(*models.User) error) (*utils.Claims, error) {
+	if claims, ok := ps.cache.lookupCredentials(key); ok {
+		return claims, nil
 	}
+	gen := ps.cache.generation()
 
-	return &utils.Claims{
+	user, err := ps.db.GetUserByUsername(username)
+	if err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	if err := checkProxyUser(user); err != nil {
+		return nil, err
+	}
+
+	if err := verify(user); err != nil {
+		return nil, err
+	}
+
+	claims := &utils.Claims{
 		UserID:   user.ID,
 		Username: user.Username,
 		IsAdmin:  user.IsAdmin,
-	}, nil
+	}
+	ps.cache.storeCredentials(gen, key, claims)
+	return claims, nil
 }
 
 func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
+	if !ps.acquireConn() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Proxy connection limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	defer ps.releaseConn()
+
 	claims, err := ps.authenticateRequest(r)
+	if wait, refused := guard.RetryAfter(err); refused {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Too many failed logins", http.StatusTooManyRequests)
+		log.Printf("Authentication refused: %v", err)
+		return
+	}
 	if err != nil {
 		w.Header().Set("Proxy-Authenticate", `Basic realm="Proxy Server"`)
 		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
@@ -122,36 +428,129 @@ func (ps *ProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	settings, err := ps.db.GetUserProxySettings(claims.UserID)
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+
+	// A disabled protocol is refused before the request counts against
+	// the user's limits or quotas.
+	runtime := ps.settings.get()
+	if r.Method == http.MethodConnect && !runtime.AllowHTTPS {
+		http.Error(w, "HTTPS proxying is disabled", http.StatusForbidden)
+		ps.logRequestReason(claims.UserID, r.Method, target, http.StatusForbidden, 0, 0, startTime, reasonProtocolDisabled)
+		return
+	}
+	if r.Method != http.MethodConnect && !runtime.AllowHTTP {
+		http.Error(w, "HTTP proxying is disabled", http.StatusForbidden)
+		ps.logRequestReason(claims.UserID, r.Method, target, http.StatusForbidden, 0, 0, startTime, reasonProtocolDisabled)
+		return
+	}
+
+	release, reason, err := ps.admitUser(claims.UserID)
 	if err != nil {
 		http.Error(w, "Failed to load proxy settings", http.StatusInternalServerError)
 		return
 	}
+	if reason != "" {
+		message := "Too many requests"
+		if reason == reasonUserConnectionLimit {
+			message = "Too many concurrent connections"
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, message, http.StatusTooManyRequests)
+		ps.logRequestReason(claims.UserID, r.Method, target, http.StatusTooManyRequests, 0, 0, startTime, reason)
+		return
+	}
+	defer release()
+
+	settings, err := ps.loadPolicy(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to load proxy settings", http.StatusInternalServerError)
+		return
+	}
+
+	clientIP := ps.clientIP(r)
+	if !settings.clientAllowed(clientIP) {
+		http.Error(w, "Client address not allowed", http.StatusForbidden)
+		ps.logRequestReason(claims.UserID, r.Method, target, http.StatusForbidden, 0, 0, startTime, reasonClientNotAllowed)
+		log.Printf("Rejected %s for user %s: client address %s not in allowlist", target, claims.Username, clientIP)
+		return
+	}
+	if !settings.allowedAt(startTime) {
+		http.Error(w, "Proxy access is not allowed at this time", http.StatusForbidden)
+		ps.logRequestReason(claims.UserID, r.Method, target, http.StatusForbidden, 0, 0, startTime, reasonOutsideSchedule)
+		return
+	}
+
+	meter, exceeded := ps.quotas.admit(claims.UserID, settings.Quota)
+	if exceeded != nil {
+		ps.rejectOverQuota(w, claims.UserID, r.Method, target, exceeded, startTime)
+		return
+	}
+	defer meter.release()
+
+	entry := ps.conns.register(claims, clientIP, r.Method, target, nil)
+	defer ps.conns.unregister(entry)
+	ctx, cancel := context.WithCancel(withActiveConn(r.Context(), entry))
+	defer cancel()
+	entry.setCloser(cancel)
+	r = r.WithContext(ctx)
+	if r.Method == http.MethodConnect {
+		host, port := splitTarget(r.Host, 443)
+		entry.setAllowed(func(policy *userPolicy) bool { return isHostAllowed(policy, host, port) })
+	} else {
+		defaultPort := 80
+		if r.URL.Scheme == "https" {
+			defaultPort = 443
+		}
+		host, port := splitTarget(r.URL.Host, defaultPort)
+		path := r.URL.EscapedPath()
+		entry.setAllowed(func(policy *userPolicy) bool { return isURLAllowed(policy, host, port, path) })
+		w = &countedResponseWriter{ResponseWriter: w, owner: entry}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countedBody{ReadCloser: r.Body, owner: entry}
+		}
+	}
 
 	if r.Method == http.MethodConnect {
-		ps.handleHTTPS(w, r, claims, settings, startTime)
+		ps.handleHTTPS(w, r, claims, settings, meter, startTime)
 	} else {
-		ps.handleHTTP(w, r, claims, settings, startTime)
+		ps.handleHTTP(w, r, claims, settings, meter, startTime)
 	}
 }
 
-func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request, claims *utils.Claims, prefs *models.UserProxySettings, startTime time.Time) {
-	outboundReq, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), r.Body)
+// rejectOverQuota answers a request refused by admit with 429 and the time
+// until the quota resets.
+func (ps *ProxyServer) rejectOverQuota(w http.ResponseWriter, userID int, method, target string, exceeded *quotaExceededError, startTime time.Time) {
+	retry := exceeded.retryAfter(time.Now())
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+	http.Error(w, exceeded.message(), http.StatusTooManyRequests)
+	ps.logRequestReason(userID, method, target, http.StatusTooManyRequests, 0, 0, startTime, exceeded.reason())
+}
+
+// recordTraffic queues a finished request for traffic_stats and adds it to
+// the user's quota accounting.
+func (ps *ProxyServer) recordTraffic(userID int, meter *quotaMeter, bytesSent, bytesReceived int64) {
+	ps.logs.addTraffic(userID, bytesSent, bytesReceived, time.Now())
+	meter.markRecorded(bytesSent + bytesReceived)
+}
+
+func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, startTime time.Time) {
+	body := r.Body
+	if r.ContentLength != 0 {
+		body = prefs.bandwidth.uploadReader(r.Context(), r.Body)
+	}
+	outboundReq, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), body)
 	if err != nil {
 		http.Error(w, "Failed to create upstream request", http.StatusBadGateway)
 		ps.logRequest(claims.UserID, r.Method, r.URL.String(), http.StatusBadGateway, 0, 0, startTime)
 		return
 	}
 
-	outboundReq.Header = make(http.Header)
-	for k, vv := range r.Header {
-		if strings.EqualFold(k, "Proxy-Authorization") || strings.EqualFold(k, "Proxy-Connection") {
-			continue
-		}
-		for _, v := range vv {
-			outboundReq.Header.Add(k, v)
-		}
-	}
+	outboundReq.ContentLength = r.ContentLength
+	outboundReq.Header = r.Header.Clone()
+	upgrade := prepareOutboundHeader(outboundReq.Header)
 
 	if outboundReq.URL.Scheme == "" {
 		outboundReq.URL.Scheme = "http"
@@ -160,70 +559,151 @@ func (ps *ProxyServer) handleHTTP(w http.ResponseWriter, r *http.Request, claims
 		outboundReq.Host = outboundReq.URL.Host
 	}
 
-	targetHost := extractHost(outboundReq.URL.Host)
-	if !isHostAllowed(prefs, targetHost) {
-		http.Error(w, "Access to this host is not permitted", http.StatusForbidden)
+	defaultPort := 80
+	if outboundReq.URL.Scheme == "https" {
+		defaultPort = 443
+	}
+	targetHost, targetPort := splitTarget(outboundReq.URL.Host, defaultPort)
+	if !isURLAllowed(prefs, targetHost, targetPort, outboundReq.URL.EscapedPath()) {
+		http.Error(w, "Access to this URL is not permitted", http.StatusForbidden)
 		ps.logRequest(claims.UserID, r.Method, r.URL.String(), http.StatusForbidden, 0, 0, startTime)
 		return
 	}
 
-	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		if prior := outboundReq.Header.Get("X-Forwarded-For"); prior != "" {
-			outboundReq.Header.Set("X-Forwarded-For", prior+", "+clientIP)
-		} else {
-			outboundReq.Header.Set("X-Forwarded-For", clientIP)
-		}
-	}
+	// Sites see the address the client allowlist was checked against. A
+	// header the client sent itself is replaced, not extended: behind a
+	// trusted load balancer it already ends in that address, and from
+	// anyone else it cannot be believed.
+	outboundReq.Header.Set("X-Forwarded-For", ps.clientIP(r))
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			Proxy: nil,
-		},
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if len(via) >= 10 {
-				return fmt.Errorf("stopped after 10 redirects")
-			}
-			return nil
-		},
+	timeout := ps.settings.get().Timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+
+	// timeout_seconds bounds the whole exchange, except for upgraded
+	// connections which only need their response headers in time.
+	if upgrade == "" {
+		ctx, cancel := context.WithTimeout(outboundReq.Context(), timeout)
+		defer cancel()
+		outboundReq = outboundReq.WithContext(ctx)
+	}
+	roundTrip := func(req *http.Request) (*http.Response, error) {
+		return ps.transports.roundTrip(req, claims.UserID, prefs)
 	}
 
-	resp, err := client.Do(outboundReq)
+	var resp *http.Response
+	var cacheStatus string
+	if upgrade == "" && ps.useHTTPCache(prefs) {
+		resp, cacheStatus, err = ps.httpCache.fetch(outboundReq, roundTrip)
+	} else {
+		resp, err = roundTrip(outboundReq)
+	}
 	if err != nil {
+		if isEgressDenied(err) {
+			http.Error(w, "Access to this destination is not permitted", http.StatusForbidden)
+			ps.logRequestReason(claims.UserID, r.Method, r.URL.String(), http.StatusForbidden, 0, 0, startTime, reasonPrivateDestination)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		ps.logRequest(claims.UserID, r.Method, r.URL.String(), http.StatusBadGateway, 0, 0, startTime)
 		return
 	}
 	defer resp.Body.Close()
 
+	var requestSize int64
+	if r.ContentLength > 0 {
+		requestSize = r.ContentLength
+	}
+	meter.add(requestSize)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		ps.switchProtocols(w, r, resp, upgrade, claims, prefs, meter, requestSize, startTime)
+		return
+	}
+
+	removeHopHeaders(resp.Header)
 	for k, vv := range resp.Header {
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
 	}
+	if cacheStatus != "" {
+		w.Header().Set("X-Cache", cacheStatus)
+	}
 	w.WriteHeader(resp.StatusCode)
 
-	bytesSent, _ := io.Copy(w, resp.Body)
+	bytesSent, _ := io.Copy(meteredWriter{w: prefs.bandwidth.download(r.Context(), w), meter: meter}, resp.Body)
+
+	ps.logRequestEntry(models.RequestLog{
+		UserID:        &claims.UserID,
+		Method:        r.Method,
+		URL:           r.URL.String(),
+		StatusCode:    resp.StatusCode,
+		BytesSent:     requestSize,
+		BytesReceived: bytesSent,
+		CacheStatus:   cacheStatus,
+	}, startTime)
+	ps.recordTraffic(claims.UserID, meter, requestSize, bytesSent)
+}
 
-	var requestSize int64
-	if r.ContentLength > 0 {
-		requestSize = r.ContentLength
+// switchProtocols takes over the client connection after the upstream
+// accepted a protocol upgrade and relays the upgraded stream.
+func (ps *ProxyServer) switchProtocols(w http.ResponseWriter, r *http.Request, resp *http.Response, upgrade string, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, requestSize int64, startTime time.Time) {
+	method, requestURL := r.Method, r.URL.String()
+	if upgrade == "" || !strings.EqualFold(upgradeType(resp.Header), upgrade) {
+		http.Error(w, "Upstream switched to an unrequested protocol", http.StatusBadGateway)
+		ps.logRequest(claims.UserID, method, requestURL, http.StatusBadGateway, requestSize, 0, startTime)
+		return
+	}
+
+	clientConn, bufrw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Protocol upgrade not supported", http.StatusInternalServerError)
+		ps.logRequest(claims.UserID, method, requestURL, http.StatusInternalServerError, requestSize, 0, startTime)
+		return
+	}
+	defer clientConn.Close()
+	// Ending the request's context, as terminating the connection does,
+	// now has to close the hijacked connection as well.
+	defer context.AfterFunc(r.Context(), func() { clientConn.Close() })()
+
+	client := activeConnFrom(r.Context()).wrap(clientConn)
+	if bufrw.Reader.Buffered() > 0 {
+		client = &bufferedConn{Conn: client, reader: bufrw.Reader}
 	}
+	ps.relayUpgrade(r.Context(), client, resp, claims, prefs, meter, method, requestURL, requestSize, startTime)
+}
 
-	ps.logRequest(claims.UserID, r.Method, r.URL.String(), resp.StatusCode, requestSize, bytesSent, startTime)
-	ps.db.UpdateTrafficStats(claims.UserID, requestSize, bytesSent)
+// useHTTPCache reports whether plain HTTP requests of the user go through
+// the shared response cache. Users with egress exceptions bypass it so that
+// responses from destinations only they may reach are never shared.
+func (ps *ProxyServer) useHTTPCache(prefs *userPolicy) bool {
+	return ps.httpCache != nil && ps.settings.get().HTTPCacheEnabled &&
+		prefs.HTTPCache && len(prefs.EgressExceptions) == 0
 }
 
-func (ps *ProxyServer) handleHTTPS(w http.ResponseWriter, r *http.Request, claims *utils.Claims, prefs *models.UserProxySettings, startTime time.Time) {
-	targetHost := extractHost(r.Host)
-	if !isHostAllowed(prefs, targetHost) {
+func (ps *ProxyServer) handleHTTPS(w http.ResponseWriter, r *http.Request, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, startTime time.Time) {
+	targetHost, targetPort := splitTarget(r.Host, 443)
+	intercept := ps.shouldIntercept(prefs, targetHost, targetPort)
+	allowed := isHostAllowed(prefs, targetHost, targetPort)
+	if intercept {
+		allowed = isTunnelAllowed(prefs, targetHost, targetPort)
+		activeConnFrom(r.Context()).setAllowed(func(policy *userPolicy) bool {
+			return isTunnelAllowed(policy, targetHost, targetPort)
+		})
+	}
+	if !allowed {
 		http.Error(w, "Access to this host is not permitted", http.StatusForbidden)
 		ps.logRequest(claims.UserID, r.Method, r.Host, http.StatusForbidden, 0, 0, startTime)
 		return
 	}
 
-	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	destConn, err := ps.dialTarget(r.Context(), prefs, hostWithPort(r.Host, "443"))
 	if err != nil {
+		if isEgressDenied(err) {
+			http.Error(w, "Access to this destination is not permitted", http.StatusForbidden)
+			ps.logRequestReason(claims.UserID, r.Method, r.Host, http.StatusForbidden, 0, 0, startTime, reasonPrivateDestination)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		ps.logRequest(claims.UserID, r.Method, r.Host, http.StatusServiceUnavailable, 0, 0, startTime)
 		return
@@ -236,53 +716,72 @@ func (ps *ProxyServer) handleHTTPS(w http.ResponseWriter, r *http.Request, claim
 		return
 	}
 
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, bufrw, err := hijacker.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 	defer clientConn.Close()
+	defer context.AfterFunc(r.Context(), func() { clientConn.Close() })()
+	clientConn = activeConnFrom(r.Context()).wrap(clientConn)
 
-	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
-	var bytesSent, bytesReceived int64
+	// Drop deadlines inherited from the HTTP server; tunnels may be long-lived.
+	clientConn.SetDeadline(time.Time{})
 
-	errChan := make(chan error, 2)
-
-	go func() {
-		n, err := io.Copy(destConn, clientConn)
-		bytesSent = n
-		errChan <- err
-	}()
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	go func() {
-		n, err := io.Copy(clientConn, destConn)
-		bytesReceived = n
-		errChan <- err
-	}()
+	if intercept {
+		ps.interceptTLS(r.Context(), clientConn, bufrw.Reader, destConn, claims, prefs, meter, r.Host, startTime)
+		return
+	}
+	if bufrw.Reader.Buffered() > 0 {
+		clientConn = &bufferedConn{Conn: clientConn, reader: bufrw.Reader}
+	}
+	ps.tunnel(r.Context(), clientConn, destConn, claims, prefs, meter, r.Host, startTime)
+}
 
-	<-errChan
+// tunnel copies bytes between the client and destination until either
+// side closes, then logs the tunnel as one request.
+func (ps *ProxyServer) tunnel(ctx context.Context, clientConn, destConn net.Conn, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, target string, startTime time.Time) {
+	traffic := ps.startLiveTraffic(claims.UserID, meter)
+	exceeded := ps.relay(ctx, clientConn, destConn, traffic, prefs, meter)
+	bytesSent, bytesReceived := traffic.finish()
 
-	ps.logRequest(claims.UserID, r.Method, r.Host, http.StatusOK, bytesSent, bytesReceived, startTime)
-	ps.db.UpdateTrafficStats(claims.UserID, bytesSent, bytesReceived)
+	status, reason := http.StatusOK, ""
+	if exceeded != nil {
+		status, reason = http.StatusTooManyRequests, exceeded.reason()
+	}
+	ps.logRequestReason(claims.UserID, http.MethodConnect, target, status, bytesSent, bytesReceived, startTime, reason)
 }
 
 func (ps *ProxyServer) logRequest(userID int, method, url string, statusCode int, bytesSent, bytesReceived int64, startTime time.Time) {
-	duration := time.Since(startTime).Milliseconds()
+	ps.logRequestReason(userID, method, url, statusCode, bytesSent, bytesReceived, startTime, "")
+}
 
-	requestLog := &models.RequestLog{
+// logRequestReason records a request together with the reason it was
+// refused, so policy rejections can be told apart from other 403s.
+func (ps *ProxyServer) logRequestReason(userID int, method, url string, statusCode int, bytesSent, bytesReceived int64, startTime time.Time, reason string) {
+	ps.logRequestEntry(models.RequestLog{
 		UserID:        &userID,
 		Method:        method,
 		URL:           url,
 		StatusCode:    statusCode,
 		BytesSent:     bytesSent,
 		BytesReceived: bytesReceived,
-		DurationMs:    int(duration),
-	}
+		Reason:        reason,
+	}, startTime)
+}
 
-	if err := ps.db.LogRequest(requestLog); err != nil {
-		log.Printf("Failed to log request: %v", err)
+// logRequestEntry fills in the timing of entry and queues it for
+// request_logs.
+func (ps *ProxyServer) logRequestEntry(entry models.RequestLog, startTime time.Time) {
+	if !ps.settings.get().EnableLogging {
+		return
 	}
+
+	entry.DurationMs = int(time.Since(startTime).Milliseconds())
+	entry.CreatedAt = time.Now()
+	ps.logs.enqueue(entry)
 }
 
 func init() {
@@ -307,36 +806,22 @@ func extractHost(raw string) string {
 	return host
 }
 
-func isHostAllowed(prefs *models.UserProxySettings, host string) bool {
-	if prefs == nil {
-		return true
-	}
-	if host == "" {
-		return true
-	}
-	switch prefs.ProxyType {
-	case "whitelist":
-		return matchesList(prefs.Whitelist, host)
-	case "blacklist":
-		return !matchesList(prefs.Blacklist, host)
-	default:
-		return true
+// splitTarget returns the lowercased host and numeric port of raw, using
+// defaultPort when raw has none.
+func splitTarget(raw string, defaultPort int) (string, int) {
+	host := extractHost(raw)
+	if _, portStr, err := net.SplitHostPort(strings.TrimSpace(raw)); err == nil {
+		if port, err := strconv.Atoi(portStr); err == nil {
+			return host, port
+		}
 	}
+	return host, defaultPort
 }
 
-func matchesList(list []string, host string) bool {
-	if len(list) == 0 {
-		return false
-	}
-	lowerHost := strings.ToLower(host)
-	for _, entry := range list {
-		entry = strings.ToLower(strings.TrimSpace(entry))
-		if entry == "" {
-			continue
-		}
-		if strings.Contains(lowerHost, entry) {
-			return true
-		}
+// hostWithPort appends defaultPort when raw carries no explicit port.
+func hostWithPort(raw, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(raw); err == nil {
+		return raw
 	}
-	return false
+	return net.JoinHostPort(strings.Trim(raw, "[]"), defaultPort)
 }
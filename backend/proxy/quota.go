@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+)
+
+const (
+	// quotaRefreshInterval bounds how stale cached usage may get before it
+	// is reloaded from traffic_stats.
+	quotaRefreshInterval = 5 * time.Second
+	// quotaCheckInterval is how often open tunnels re-check byte quotas.
+	quotaCheckInterval = time.Second
+)
+
+// quotaExceededError reports the first quota a user has used up.
+type quotaExceededError struct {
+	quota string
+}
+
+func (e *quotaExceededError) Error() string {
+	return "traffic quota exceeded: " + e.quota
+}
+
+// reason is the request_logs reason recorded for the rejection.
+func (e *quotaExceededError) reason() string {
+	return "quota_" + e.quota
+}
+
+// message is the client-facing text for the rejection.
+func (e *quotaExceededError) message() string {
+	period := "Daily"
+	if strings.HasPrefix(e.quota, "monthly") {
+		period = "Monthly"
+	}
+	kind := "traffic"
+	if strings.HasSuffix(e.quota, "requests") {
+		kind = "request"
+	}
+	return fmt.Sprintf("%s %s quota exceeded", period, kind)
+}
+
+// retryAfter is the time until the exhausted quota resets.
+func (e *quotaExceededError) retryAfter(now time.Time) time.Duration {
+	year, month, day := now.Date()
+	reset := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	if strings.HasPrefix(e.quota, "monthly") {
+		reset = time.Date(year, month+1, 1, 0, 0, 0, 0, now.Location())
+	}
+	return reset.Sub(now)
+}
+
+// quotaTracker combines usage persisted in traffic_stats with traffic that
+// is still in flight or waiting in the log pipeline, so limits hold for
+// concurrent and long-lived connections before their totals are written.
+type quotaTracker struct {
+	db    *database.Database
+	logs  *logPipeline
+	mu    sync.Mutex
+	users map[int]*quotaEntry
+}
+
+type quotaEntry struct {
+	mu       sync.Mutex
+	usage    models.QuotaUsage
+	loadedAt time.Time
+	// lastUsed is guarded by quotaTracker.mu.
+	lastUsed time.Time
+
+	liveBytes    atomic.Int64
+	liveRequests atomic.Int64
+}
+
+func newQuotaTracker(db *database.Database, logs *logPipeline) *quotaTracker {
+	return &quotaTracker{db: db, logs: logs, users: make(map[int]*quotaEntry)}
+}
+
+func (q *quotaTracker) entry(userID int) *quotaEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.users[userID]
+	if !ok {
+		e = &quotaEntry{}
+		q.users[userID] = e
+	}
+	e.lastUsed = time.Now()
+	return e
+}
+
+// forget drops the cached usage of a deleted user.
+func (q *quotaTracker) forget(userID int) {
+	q.mu.Lock()
+	delete(q.users, userID)
+	q.mu.Unlock()
+}
+
+// sweep drops cached usage that no open request refers to and that has not
+// been used since cutoff; it is reloaded on the user's next request.
+func (q *quotaTracker) sweep(cutoff time.Time, busy map[int]struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for userID, e := range q.users {
+		if _, ok := busy[userID]; !ok && e.liveRequests.Load() == 0 && e.lastUsed.Before(cutoff) {
+			delete(q.users, userID)
+		}
+	}
+}
+
+// usage returns recorded plus in-flight usage for the user.
+func (q *quotaTracker) usage(userID int, e *quotaEntry) (models.QuotaUsage, error) {
+	e.mu.Lock()
+	if time.Since(e.loadedAt) > quotaRefreshInterval {
+		loaded, err := q.db.GetQuotaUsage(userID)
+		if err != nil {
+			e.mu.Unlock()
+			return models.QuotaUsage{}, err
+		}
+		now := time.Now()
+		pending := q.logs.pendingUsage(userID, now)
+		loaded.DailyBytes += pending.DailyBytes
+		loaded.MonthlyBytes += pending.MonthlyBytes
+		loaded.DailyRequests += pending.DailyRequests
+		loaded.MonthlyRequests += pending.MonthlyRequests
+		e.usage = *loaded
+		e.loadedAt = now
+	}
+	usage := e.usage
+	e.mu.Unlock()
+
+	live := e.liveBytes.Load()
+	requests := e.liveRequests.Load()
+	usage.DailyBytes += live
+	usage.MonthlyBytes += live
+	usage.DailyRequests += requests
+	usage.MonthlyRequests += requests
+	return usage, nil
+}
+
+// admit checks the user's quotas before traffic is forwarded. On success
+// the request is counted as in flight until the returned meter is released.
+// Usage lookups that fail are logged and do not block traffic.
+func (q *quotaTracker) admit(userID int, quota models.UserQuota) (*quotaMeter, *quotaExceededError) {
+	m := &quotaMeter{tracker: q, userID: userID, quota: quota}
+	if !database.HasQuota(quota) {
+		return m, nil
+	}
+
+	entry := q.entry(userID)
+	usage, err := q.usage(userID, entry)
+	if err != nil {
+		log.Printf("Failed to load quota usage for user %d: %v", userID, err)
+		return m, nil
+	}
+	if exceeded := database.ExceededQuotas(quota, usage); len(exceeded) > 0 {
+		return nil, &quotaExceededError{quota: exceeded[0]}
+	}
+	entry.liveRequests.Add(1)
+	m.entry = entry
+	return m, nil
+}
+
+// quotaMeter tracks the traffic of one admitted request or tunnel.
+type quotaMeter struct {
+	tracker *quotaTracker
+	userID  int
+	quota   models.UserQuota
+	entry   *quotaEntry
+
+	bytes    atomic.Int64
+	recorded int64
+	requests int64
+}
+
+func (m *quotaMeter) add(n int64) {
+	if m == nil || m.entry == nil || n <= 0 {
+		return
+	}
+	m.bytes.Add(n)
+	m.entry.liveBytes.Add(n)
+}
+
+// exceededBytes reports a byte quota reached while the connection is open.
+// Request quotas are only enforced on admission.
+func (m *quotaMeter) exceededBytes() *quotaExceededError {
+	if m == nil || m.entry == nil || (m.quota.QuotaDailyBytes == 0 && m.quota.QuotaMonthlyBytes == 0) {
+		return nil
+	}
+	usage, err := m.tracker.usage(m.userID, m.entry)
+	if err != nil {
+		return nil
+	}
+	for _, name := range database.ExceededQuotas(m.quota, usage) {
+		if name == database.QuotaDailyBytes || name == database.QuotaMonthlyBytes {
+			return &quotaExceededError{quota: name}
+		}
+	}
+	return nil
+}
+
+// exceeded reports any quota reached so far, for connections that carry
+// several requests.
+func (m *quotaMeter) exceeded() *quotaExceededError {
+	if m == nil || m.entry == nil {
+		return nil
+	}
+	usage, err := m.tracker.usage(m.userID, m.entry)
+	if err != nil {
+		return nil
+	}
+	if exceeded := database.ExceededQuotas(m.quota, usage); len(exceeded) > 0 {
+		return &quotaExceededError{quota: exceeded[0]}
+	}
+	return nil
+}
+
+// watch calls onExceeded once if a byte quota is reached before stop is
+// closed.
+func (m *quotaMeter) watch(stop <-chan struct{}, onExceeded func(*quotaExceededError)) {
+	if m == nil || m.entry == nil || (m.quota.QuotaDailyBytes == 0 && m.quota.QuotaMonthlyBytes == 0) {
+		return
+	}
+	ticker := time.NewTicker(quotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if exceeded := m.exceededBytes(); exceeded != nil {
+				onExceeded(exceeded)
+				return
+			}
+		}
+	}
+}
+
+// markRecorded notes that a request of total bytes was written to
+// traffic_stats. It must be called from the goroutine that releases m.
+func (m *quotaMeter) markRecorded(total int64) {
+	if m == nil {
+		return
+	}
+	m.recorded += total
+	m.requests++
+}
+
+// fold moves n bytes of a connection that is still open from the live
+// count to the cached usage as record writes them toward traffic_stats.
+// record runs under the usage lock, so a concurrent reload sees the bytes
+// either as pending or as folded, never both.
+func (m *quotaMeter) fold(n int64, record func()) {
+	if m == nil || m.entry == nil {
+		record()
+		return
+	}
+	m.entry.mu.Lock()
+	defer m.entry.mu.Unlock()
+	record()
+	m.entry.usage.DailyBytes += n
+	m.entry.usage.MonthlyBytes += n
+	m.bytes.Add(-n)
+	m.entry.liveBytes.Add(-n)
+}
+
+// release drops the in-flight counts. Recorded traffic is folded into the
+// cached usage so it stays visible until the next reload.
+func (m *quotaMeter) release() {
+	if m == nil || m.entry == nil {
+		return
+	}
+	m.entry.liveBytes.Add(-m.bytes.Load())
+	m.entry.liveRequests.Add(-1)
+
+	if m.requests > 0 {
+		m.entry.mu.Lock()
+		m.entry.usage.DailyBytes += m.recorded
+		m.entry.usage.MonthlyBytes += m.recorded
+		m.entry.usage.DailyRequests += m.requests
+		m.entry.usage.MonthlyRequests += m.requests
+		m.entry.mu.Unlock()
+	}
+}
+
+// meteredWriter counts bytes written through it against a quota meter.
+type meteredWriter struct {
+	w     io.Writer
+	meter *quotaMeter
+}
+
+func (mw meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.w.Write(p)
+	mw.meter.add(int64(n))
+	return n, err
+}
+
+// meteredReader counts bytes read through it against a quota meter.
+type meteredReader struct {
+	io.ReadCloser
+	meter *quotaMeter
+	n     int64
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	n, err := mr.ReadCloser.Read(p)
+	mr.n += int64(n)
+	mr.meter.add(int64(n))
+	return n, err
+}
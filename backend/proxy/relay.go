@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficFlushInterval is how often long-lived connections report their
+// traffic to traffic_stats while they are open.
+const trafficFlushInterval = 10 * time.Second
+
+// liveTraffic counts the bytes of a long-lived connection and reports them
+// to traffic_stats as they are transferred, so that open tunnels show up on
+// the dashboard and each day is credited with the bytes moved on it.
+type liveTraffic struct {
+	ps     *ProxyServer
+	userID int
+	meter  *quotaMeter
+
+	sent     atomic.Int64
+	received atomic.Int64
+
+	// flushedSent and flushedReceived are owned by run until it is done.
+	flushedSent     int64
+	flushedReceived int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (ps *ProxyServer) startLiveTraffic(userID int, meter *quotaMeter) *liveTraffic {
+	lt := &liveTraffic{
+		ps:     ps,
+		userID: userID,
+		meter:  meter,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go lt.run()
+	return lt
+}
+
+// add counts bytes that do not pass through relay, such as the request and
+// response heads of an upgrade or SOCKS5 datagrams.
+func (lt *liveTraffic) add(sent, received int64) {
+	lt.sent.Add(sent)
+	lt.received.Add(received)
+}
+
+func (lt *liveTraffic) upload(w io.Writer) io.Writer {
+	return &trafficWriter{w: w, n: &lt.sent}
+}
+
+func (lt *liveTraffic) download(w io.Writer) io.Writer {
+	return &trafficWriter{w: w, n: &lt.received}
+}
+
+// run flushes periodically and at every local midnight, so that a delta
+// never spans two days.
+func (lt *liveTraffic) run() {
+	defer close(lt.done)
+	for {
+		now := time.Now()
+		year, month, day := now.Date()
+		midnight := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+		wait, at := trafficFlushInterval, time.Time{}
+		if untilMidnight := midnight.Sub(now); untilMidnight <= wait {
+			wait, at = untilMidnight, midnight.Add(-time.Nanosecond)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-lt.stop:
+			timer.Stop()
+			return
+		case fired := <-timer.C:
+			if at.IsZero() {
+				at = fired
+			}
+			lt.flush(at)
+		}
+	}
+}
+
+// flush reports the bytes counted since the last periodic flush and hands
+// them from the live quota count over to the recorded usage.
+func (lt *liveTraffic) flush(at time.Time) {
+	sent, received := lt.delta()
+	if sent == 0 && received == 0 {
+		return
+	}
+	lt.meter.fold(sent+received, func() {
+		lt.ps.logs.addLiveTraffic(lt.userID, sent, received, at)
+	})
+}
+
+func (lt *liveTraffic) delta() (sent, received int64) {
+	totalSent, totalReceived := lt.sent.Load(), lt.received.Load()
+	sent, received = totalSent-lt.flushedSent, totalReceived-lt.flushedReceived
+	lt.flushedSent, lt.flushedReceived = totalSent, totalReceived
+	return sent, received
+}
+
+// finish stops periodic flushing, records the rest together with the
+// request itself and returns the totals for the request log. It must be
+// called from the goroutine that releases the quota meter.
+func (lt *liveTraffic) finish() (sent, received int64) {
+	close(lt.stop)
+	<-lt.done
+
+	lastSent, lastReceived := lt.delta()
+	lt.ps.recordTraffic(lt.userID, lt.meter, lastSent, lastReceived)
+	return lt.sent.Load(), lt.received.Load()
+}
+
+type trafficWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (tw *trafficWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.n.Add(int64(n))
+	return n, err
+}
+
+// relay copies between client and dest until both directions are done.
+// When one side finishes sending, the other is half-closed so the opposite
+// direction can still drain; errors close both. The connection is cut if
+// a byte quota runs out, which is returned.
+func (ps *ProxyServer) relay(ctx context.Context, client, dest io.ReadWriteCloser, traffic *liveTraffic, prefs *userPolicy, meter *quotaMeter) *quotaExceededError {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			client.Close()
+			dest.Close()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(traffic.upload(meteredWriter{w: prefs.bandwidth.upload(ctx, dest), meter: meter}), client)
+		if err != nil || !closeWrite(dest) {
+			closeBoth()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(traffic.download(meteredWriter{w: prefs.bandwidth.download(ctx, client), meter: meter}), dest)
+		if err != nil || !closeWrite(client) {
+			closeBoth()
+		}
+	}()
+
+	stop := make(chan struct{})
+	var quotaErr atomic.Pointer[quotaExceededError]
+	go meter.watch(stop, func(exceeded *quotaExceededError) {
+		quotaErr.Store(exceeded)
+		closeBoth()
+	})
+
+	wg.Wait()
+	close(stop)
+	return quotaErr.Load()
+}
+
+// closeWrite half-closes conn so the peer sees EOF while the opposite
+// direction keeps flowing, looking through the proxy's own wrappers. It
+// reports false if conn cannot be half-closed.
+func closeWrite(conn io.ReadWriteCloser) bool {
+	for {
+		switch c := conn.(type) {
+		case *bufferedConn:
+			conn = c.Conn
+			continue
+		case *countedConn:
+			conn = c.Conn
+			continue
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		}
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"proxy-server/models"
+	"proxy-server/schedule"
+)
+
+// reasonOutsideSchedule is logged for requests made outside the user's
+// access schedule.
+const reasonOutsideSchedule = "outside_schedule"
+
+// compileSchedule parses a user's access schedule. A schedule that no
+// longer parses is ignored, as invalid list entries are.
+func compileSchedule(userID int, s models.Schedule) *schedule.Schedule {
+	compiled, err := schedule.Compile(s)
+	if err != nil {
+		log.Printf("Ignoring invalid access schedule for user %d: %v", userID, err)
+		return nil
+	}
+	return compiled
+}
+
+// allowedAt reports whether the user's access schedule permits use of the
+// proxy at t.
+func (p *userPolicy) allowedAt(t time.Time) bool {
+	return p == nil || p.schedule.Allows(t)
+}
+
+// enforceSchedules closes the open connections of users whose access
+// window has ended, until ctx is cancelled. Windows are set in whole
+// minutes, so it checks right after every minute boundary.
+func (ps *ProxyServer) enforceSchedules(ctx context.Context) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		now = time.Now()
+		for userID := range ps.conns.users() {
+			policy, err := ps.loadPolicy(userID)
+			if err != nil || policy.allowedAt(now) {
+				continue
+			}
+			if closed := ps.TerminateUserConnections(userID); closed > 0 {
+				log.Printf("Closed %d connections of user %d outside their access schedule", closed, userID)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/rules"
+)
+
+const settingsRefreshInterval = 5 * time.Second
+
+// reasonProtocolDisabled is logged for requests using a protocol the
+// settings turn off.
+const reasonProtocolDisabled = "protocol_disabled"
+
+// runtimeSettings is the subset of proxy_settings the proxy enforces.
+type runtimeSettings struct {
+	MaxConnections int
+	Timeout        time.Duration
+	EnableLogging  bool
+	AllowHTTP      bool
+	AllowHTTPS     bool
+	// BlockPrivateDestinations rejects loopback, private, link-local and
+	// other reserved destinations unless a user has an egress exception.
+	BlockPrivateDestinations bool
+	// MITMEnabled allows TLS interception for users and destinations that
+	// opt in; MITMBypass lists hosts that are always tunnelled.
+	MITMEnabled bool
+	MITMBypass  string
+	// HTTPCacheEnabled caches plain HTTP responses up to HTTPCacheMaxBytes
+	// on disk.
+	HTTPCacheEnabled  bool
+	HTTPCacheMaxBytes int64
+	// Transport* tune the pooled connections plain HTTP requests are
+	// forwarded over. A zero TransportMaxConnsPerHost means unlimited.
+	TransportDialTimeout     time.Duration
+	TransportTLSTimeout      time.Duration
+	TransportIdleTimeout     time.Duration
+	TransportMaxIdlePerHost  int
+	TransportMaxConnsPerHost int
+	TransportHTTP2           bool
+}
+
+func defaultRuntimeSettings() *runtimeSettings {
+	return &runtimeSettings{
+		MaxConnections: 1000,
+		Timeout:        30 * time.Second,
+		EnableLogging:  true,
+		AllowHTTP:      true,
+		AllowHTTPS:     true,
+
+		BlockPrivateDestinations: true,
+		HTTPCacheMaxBytes:        1024 << 20,
+
+		TransportDialTimeout:    10 * time.Second,
+		TransportTLSTimeout:     10 * time.Second,
+		TransportIdleTimeout:    90 * time.Second,
+		TransportMaxIdlePerHost: 16,
+		TransportHTTP2:          true,
+	}
+}
+
+// settingsWatcher polls proxy_settings so admin changes apply without a
+// restart.
+type settingsWatcher struct {
+	db      *database.Database
+	current atomic.Pointer[runtimeSettings]
+	bypass  atomic.Pointer[rules.Matcher]
+}
+
+func newSettingsWatcher(db *database.Database) *settingsWatcher {
+	w := &settingsWatcher{db: db}
+	w.current.Store(defaultRuntimeSettings())
+	w.reload()
+	return w
+}
+
+func (w *settingsWatcher) get() *runtimeSettings {
+	return w.current.Load()
+}
+
+// mitmBypass returns the compiled mitm_bypass list.
+func (w *settingsWatcher) mitmBypass() *rules.Matcher {
+	return w.bypass.Load()
+}
+
+func (w *settingsWatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(settingsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *settingsWatcher) reload() {
+	rows, err := w.db.GetProxySettings()
+	if err != nil {
+		log.Printf("Failed to load proxy settings: %v", err)
+		return
+	}
+
+	next := defaultRuntimeSettings()
+	for _, row := range rows {
+		value := strings.TrimSpace(row.Value)
+		switch row.Key {
+		case "max_connections":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				next.MaxConnections = n
+			}
+		case "timeout_seconds":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				next.Timeout = time.Duration(n) * time.Second
+			}
+		case "enable_logging":
+			next.EnableLogging = parseSettingBool(value, next.EnableLogging)
+		case "allow_http":
+			next.AllowHTTP = parseSettingBool(value, next.AllowHTTP)
+		case "allow_https":
+			next.AllowHTTPS = parseSettingBool(value, next.AllowHTTPS)
+		case "block_private_destinations":
+			next.BlockPrivateDestinations = parseSettingBool(value, next.BlockPrivateDestinations)
+		case "mitm_enabled":
+			next.MITMEnabled = parseSettingBool(value, next.MITMEnabled)
+		case "mitm_bypass":
+			next.MITMBypass = value
+		case "http_cache_enabled":
+			next.HTTPCacheEnabled = parseSettingBool(value, next.HTTPCacheEnabled)
+		case "http_cache_max_mb":
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+				next.HTTPCacheMaxBytes = n << 20
+			}
+		case "transport_dial_timeout_seconds":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				next.TransportDialTimeout = time.Duration(n) * time.Second
+			}
+		case "transport_tls_timeout_seconds":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				next.TransportTLSTimeout = time.Duration(n) * time.Second
+			}
+		case "transport_idle_timeout_seconds":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				next.TransportIdleTimeout = time.Duration(n) * time.Second
+			}
+		case "transport_max_idle_per_host":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				next.TransportMaxIdlePerHost = n
+			}
+		case "transport_max_conns_per_host":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				next.TransportMaxConnsPerHost = n
+			}
+		case "transport_http2":
+			next.TransportHTTP2 = parseSettingBool(value, next.TransportHTTP2)
+		}
+	}
+
+	prev := w.current.Swap(next)
+	if prev == nil || prev.MITMBypass != next.MITMBypass || w.bypass.Load() == nil {
+		matcher, errs := rules.Compile(strings.FieldsFunc(next.MITMBypass, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\n' || r == '\t'
+		}))
+		for _, err := range errs {
+			log.Printf("Ignoring invalid mitm_bypass entry: %v", err)
+		}
+		w.bypass.Store(matcher)
+	}
+	if prev != nil && *prev != *next {
+		log.Printf("Proxy settings updated: max_connections=%d timeout=%s logging=%t http=%t https=%t block_private=%t mitm=%t http_cache=%t",
+			next.MaxConnections, next.Timeout, next.EnableLogging, next.AllowHTTP, next.AllowHTTPS, next.BlockPrivateDestinations,
+			next.MITMEnabled, next.HTTPCacheEnabled)
+	}
+}
+
+func parseSettingBool(value string, fallback bool) bool {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return parsed
+}
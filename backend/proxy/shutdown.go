@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	drainPollInterval = 100 * time.Millisecond
+	drainLogInterval  = 5 * time.Second
+	// drainGrace is how long handlers get to record connections that were
+	// closed at the shutdown deadline.
+	drainGrace = 2 * time.Second
+	// logFlushTimeout bounds writing buffered logs once traffic has stopped.
+	logFlushTimeout = 5 * time.Second
+)
+
+// Shutdown stops accepting proxy connections and lets open requests,
+// tunnels and SOCKS5 sessions finish until ctx expires; whatever is still
+// open then is closed. The background loops are stopped last, so that
+// buffered request logs, traffic stats and token usage are written out,
+// with a budget of their own.
+func (ps *ProxyServer) Shutdown(ctx context.Context) error {
+	log.Printf("Proxy server no longer accepting connections")
+	err := ps.server.Shutdown(ctx)
+	if drainErr := ps.drain(ctx); drainErr != nil && err == nil {
+		err = drainErr
+	}
+	ps.transports.closeIdle()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+	defer cancel()
+	log.Printf("Flushing buffered request logs, traffic stats and token usage")
+	if loopErr := ps.stopBackground(flushCtx); loopErr != nil && err == nil {
+		err = loopErr
+	}
+	return err
+}
+
+// stopBackground cancels the background loops and waits for them to flush
+// and return, or for ctx to expire.
+func (ps *ProxyServer) stopBackground(ctx context.Context) error {
+	ps.stopLoops()
+	done := make(chan struct{})
+	go func() {
+		ps.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain waits for every proxy connection to be released, then force-closes
+// the rest once ctx expires.
+func (ps *ProxyServer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		active := ps.activeConns.Load()
+		if active <= 0 {
+			log.Printf("All proxy connections finished")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			ps.server.Close()
+			closed := ps.conns.closeAll()
+			log.Printf("Shutdown deadline reached, closed %d open connections", closed)
+			ps.waitReleased(drainGrace)
+			return ctx.Err()
+		case <-ticker.C:
+			if time.Since(lastLog) >= drainLogInterval {
+				log.Printf("Waiting for %d proxy connections to finish", active)
+				lastLog = time.Now()
+			}
+		}
+	}
+}
+
+func (ps *ProxyServer) waitReleased(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for ps.activeConns.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+}
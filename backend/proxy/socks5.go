@@ -0,0 +1,621 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"proxy-server/utils"
+)
+
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5MethodUserPass = 0x02
+	socks5MethodNoAccept = 0xFF
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded          = 0x00
+	socks5ReplyGeneralFailure     = 0x01
+	socks5ReplyNotAllowed         = 0x02
+	socks5ReplyNetworkUnreachable = 0x03
+	socks5ReplyHostUnreachable    = 0x04
+	socks5ReplyConnectionRefused  = 0x05
+	socks5ReplyCommandUnsupported = 0x07
+	socks5ReplyAddressUnsupported = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+	socks5MaxUDPPacket     = 65535
+
+	socks5MethodConnect = "SOCKS5"
+	socks5MethodUDP     = "SOCKS5-UDP"
+)
+
+// SOCKS5Server accepts RFC 1928 clients and shares authentication, host
+// policy and accounting with the HTTP proxy it was created from.
+type SOCKS5Server struct {
+	ps   *ProxyServer
+	addr string
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+func NewSOCKS5Server(ps *ProxyServer, port string) *SOCKS5Server {
+	return &SOCKS5Server{
+		ps:   ps,
+		addr: ":" + port,
+	}
+}
+
+func (s *SOCKS5Server) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	log.Printf("SOCKS5 server starting on port %s", s.addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops accepting SOCKS5 clients. Open sessions are drained by the
+// ProxyServer's Shutdown.
+func (s *SOCKS5Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	log.Printf("SOCKS5 server no longer accepting connections")
+	return s.listener.Close()
+}
+
+func (s *SOCKS5Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	startTime := time.Now()
+
+	// Over the limit the client is dropped before negotiation; SOCKS5 has no
+	// way to report an error before a method is selected.
+	if !s.ps.acquireConn() {
+		return
+	}
+	defer s.ps.releaseConn()
+
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	claims, err := s.negotiate(conn)
+	if err != nil {
+		log.Printf("SOCKS5 authentication failed from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	cmd, target, err := readSocks5Request(conn)
+	if err != nil {
+		var replyErr *socks5Error
+		if errors.As(err, &replyErr) {
+			writeSocks5Reply(conn, replyErr.code, nil)
+		}
+		log.Printf("SOCKS5 request failed from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	release, reason, err := s.ps.admitUser(claims.UserID)
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+	if reason != "" {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		s.ps.logRequestReason(claims.UserID, socks5MethodName(cmd), target, http.StatusTooManyRequests, 0, 0, startTime, reason)
+		return
+	}
+	defer release()
+
+	settings, err := s.ps.loadPolicy(claims.UserID)
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+
+	clientIP := socks5ClientIP(conn)
+	if !settings.clientAllowed(clientIP) {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		s.ps.logRequestReason(claims.UserID, socks5MethodName(cmd), target, http.StatusForbidden, 0, 0, startTime, reasonClientNotAllowed)
+		log.Printf("Rejected SOCKS5 %s for user %s: client address %s not in allowlist", target, claims.Username, clientIP)
+		return
+	}
+	if !settings.allowedAt(startTime) {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		s.ps.logRequestReason(claims.UserID, socks5MethodName(cmd), target, http.StatusForbidden, 0, 0, startTime, reasonOutsideSchedule)
+		return
+	}
+
+	meter, exceeded := s.ps.quotas.admit(claims.UserID, settings.Quota)
+	if exceeded != nil {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		s.ps.logRequestReason(claims.UserID, socks5MethodName(cmd), target, http.StatusTooManyRequests, 0, 0, startTime, exceeded.reason())
+		return
+	}
+	defer meter.release()
+
+	// ctx ends with the session, so that terminating it or draining at
+	// shutdown also aborts a dial that is still in progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entry := s.ps.conns.register(claims, clientIP, socks5MethodName(cmd), target, func() {
+		cancel()
+		conn.Close()
+	})
+	defer s.ps.conns.unregister(entry)
+	if cmd == socks5CmdConnect {
+		host, port := splitTarget(target, 0)
+		entry.setAllowed(func(policy *userPolicy) bool { return isHostAllowed(policy, host, port) })
+	}
+	conn = entry.wrap(conn)
+
+	switch cmd {
+	case socks5CmdConnect:
+		s.handleConnect(ctx, conn, claims, settings, meter, target, startTime)
+	case socks5CmdUDPAssociate:
+		s.handleUDPAssociate(ctx, conn, claims, settings, meter, startTime)
+	default:
+		writeSocks5Reply(conn, socks5ReplyCommandUnsupported, nil)
+	}
+}
+
+// socks5ClientIP returns the client's IP address without the port, as the
+// HTTP proxy reports it.
+func socks5ClientIP(conn net.Conn) string {
+	clientIP := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	return clientIP
+}
+
+// negotiate performs method selection and RFC 1929 username/password
+// authentication. Only the username/password method is offered.
+func (s *SOCKS5Server) negotiate(conn net.Conn) (*utils.Claims, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	offered := false
+	for _, m := range methods {
+		if m == socks5MethodUserPass {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socks5Version, socks5MethodNoAccept})
+		return nil, fmt.Errorf("client does not support username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodUserPass}); err != nil {
+		return nil, err
+	}
+
+	authHeader := make([]byte, 2)
+	if _, err := io.ReadFull(conn, authHeader); err != nil {
+		return nil, err
+	}
+	if authHeader[0] != socks5AuthVersion {
+		return nil, fmt.Errorf("unsupported auth version %d", authHeader[0])
+	}
+	username := make([]byte, int(authHeader[1]))
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, err
+	}
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passLen); err != nil {
+		return nil, err
+	}
+	password := make([]byte, int(passLen[0]))
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, err
+	}
+
+	claims, err := s.ps.authenticateCredentials(string(username), string(password), socks5ClientIP(conn))
+	if err != nil {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *SOCKS5Server) handleConnect(ctx context.Context, conn net.Conn, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, target string, startTime time.Time) {
+	host, port := splitTarget(target, 0)
+	if !isHostAllowed(prefs, host, port) {
+		writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+		s.ps.logRequest(claims.UserID, socks5MethodConnect, target, http.StatusForbidden, 0, 0, startTime)
+		return
+	}
+
+	destConn, err := s.ps.dialTarget(ctx, prefs, target)
+	if err != nil {
+		if isEgressDenied(err) {
+			writeSocks5Reply(conn, socks5ReplyNotAllowed, nil)
+			s.ps.logRequestReason(claims.UserID, socks5MethodConnect, target, http.StatusForbidden, 0, 0, startTime, reasonPrivateDestination)
+			return
+		}
+		writeSocks5Reply(conn, dialErrorReply(err), nil)
+		s.ps.logRequest(claims.UserID, socks5MethodConnect, target, http.StatusServiceUnavailable, 0, 0, startTime)
+		return
+	}
+	defer destConn.Close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, destConn.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	traffic := s.ps.startLiveTraffic(claims.UserID, meter)
+	exceeded := s.ps.relay(ctx, conn, destConn, traffic, prefs, meter)
+	bytesSent, bytesReceived := traffic.finish()
+
+	status, reason := http.StatusOK, ""
+	if exceeded != nil {
+		status, reason = http.StatusTooManyRequests, exceeded.reason()
+	}
+	s.ps.logRequestReason(claims.UserID, socks5MethodConnect, target, status, bytesSent, bytesReceived, startTime, reason)
+}
+
+// handleUDPAssociate relays datagrams for the lifetime of the control
+// connection. Each datagram destination is checked against the user's
+// host policy; disallowed packets are silently dropped as RFC 1928 has no
+// per-datagram error channel. Datagrams count towards quotas and bandwidth
+// limits like tunnel traffic.
+func (s *SOCKS5Server) handleUDPAssociate(ctx context.Context, conn net.Conn, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, startTime time.Time) {
+	localTCP, _ := conn.LocalAddr().(*net.TCPAddr)
+	remoteTCP, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if localTCP == nil || remoteTCP == nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		return
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localTCP.IP})
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		s.ps.logRequest(claims.UserID, socks5MethodUDP, "", http.StatusServiceUnavailable, 0, 0, startTime)
+		return
+	}
+	defer relay.Close()
+
+	// Datagrams leave from one of the user's egress addresses for the whole
+	// association; those to the other address family cannot be sent.
+	var source *net.UDPAddr
+	if ip, _ := prefs.sourceAddr(""); ip != nil {
+		source = &net.UDPAddr{IP: ip}
+	}
+	upstream, err := net.ListenUDP("udp", source)
+	if err != nil {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, nil)
+		s.ps.logRequest(claims.UserID, socks5MethodUDP, "", http.StatusServiceUnavailable, 0, 0, startTime)
+		return
+	}
+	defer upstream.Close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	traffic := s.ps.startLiveTraffic(claims.UserID, meter)
+	var clientAddr atomic.Pointer[net.UDPAddr]
+	// contacted holds the destinations the client has sent to; only their
+	// replies are relayed back, so other hosts cannot inject datagrams.
+	var contacted sync.Map
+	var wg sync.WaitGroup
+	wg.Add(2)
+	done := make(chan struct{})
+
+	// client -> destination
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, socks5MaxUDPPacket)
+		for {
+			n, from, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !from.IP.Equal(remoteTCP.IP) {
+				continue
+			}
+			clientAddr.Store(from)
+
+			target, payload, err := parseSocks5UDPPacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			host, port := splitTarget(target, 0)
+			if !isHostAllowed(prefs, host, port) {
+				continue
+			}
+			// Chained users must not leak datagrams around their upstream.
+			if selectUpstreamPool(prefs, target) != "" {
+				continue
+			}
+			dest, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				continue
+			}
+			if !s.ps.egressAllowed(prefs, host, dest.IP, port) {
+				continue
+			}
+			contacted.Store(udpPeer(dest), struct{}{})
+			if err := prefs.bandwidth.waitUpload(ctx, len(payload)); err != nil {
+				return
+			}
+			if written, err := upstream.WriteToUDP(payload, dest); err == nil {
+				traffic.add(int64(written), 0)
+				meter.add(int64(written))
+			}
+		}
+	}()
+
+	// destination -> client
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, socks5MaxUDPPacket)
+		for {
+			n, from, err := upstream.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client := clientAddr.Load()
+			if client == nil {
+				continue
+			}
+			if _, ok := contacted.Load(udpPeer(from)); !ok {
+				continue
+			}
+			if err := prefs.bandwidth.waitDownload(ctx, n); err != nil {
+				return
+			}
+			packet := append(buildSocks5UDPHeader(from), buf[:n]...)
+			if _, err := relay.WriteToUDP(packet, client); err == nil {
+				traffic.add(0, int64(n))
+				meter.add(int64(n))
+			}
+		}
+	}()
+
+	// The association ends when the control connection closes.
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(done)
+	}()
+
+	stop := make(chan struct{})
+	var quotaErr atomic.Pointer[quotaExceededError]
+	go meter.watch(stop, func(exceeded *quotaExceededError) {
+		quotaErr.Store(exceeded)
+		conn.Close()
+	})
+
+	<-done
+	close(stop)
+
+	relay.Close()
+	upstream.Close()
+	wg.Wait()
+	sent, received := traffic.finish()
+
+	status, reason := http.StatusOK, ""
+	if exceeded := quotaErr.Load(); exceeded != nil {
+		status, reason = http.StatusTooManyRequests, exceeded.reason()
+	}
+	s.ps.logRequestReason(claims.UserID, socks5MethodUDP, relay.LocalAddr().String(), status, sent, received, startTime, reason)
+}
+
+// socks5MethodName is the request_logs method for a SOCKS command.
+func socks5MethodName(cmd byte) string {
+	if cmd == socks5CmdUDPAssociate {
+		return socks5MethodUDP
+	}
+	return socks5MethodConnect
+}
+
+type socks5Error struct {
+	code byte
+	msg  string
+}
+
+func (e *socks5Error) Error() string {
+	return e.msg
+}
+
+func readSocks5Request(r io.Reader) (byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	cmd := header[1]
+	if cmd != socks5CmdConnect && cmd != socks5CmdUDPAssociate {
+		if cmd == socks5CmdBind {
+			return 0, "", &socks5Error{code: socks5ReplyCommandUnsupported, msg: "BIND is not supported"}
+		}
+		return 0, "", &socks5Error{code: socks5ReplyCommandUnsupported, msg: fmt.Sprintf("unknown command %d", cmd)}
+	}
+
+	target, err := readSocks5Addr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return cmd, target, nil
+}
+
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, int(length[0]))
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", &socks5Error{code: socks5ReplyAddressUnsupported, msg: fmt.Sprintf("unsupported address type %d", atyp[0])}
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func encodeSocks5Addr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var buf []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{socks5AddrIPv4}, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		buf = append([]byte{socks5AddrIPv6}, ip16...)
+	} else {
+		buf = []byte{socks5AddrIPv4, 0, 0, 0, 0}
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+func writeSocks5Reply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socks5Version, code, 0x00}
+	reply = append(reply, encodeSocks5Addr(bound)...)
+	_, err := w.Write(reply)
+	return err
+}
+
+// parseSocks5UDPPacket splits a client datagram into its destination and
+// payload. Fragmented datagrams are rejected.
+func parseSocks5UDPPacket(packet []byte) (string, []byte, error) {
+	if len(packet) < 4 {
+		return "", nil, fmt.Errorf("short udp packet")
+	}
+	if packet[2] != 0x00 {
+		return "", nil, fmt.Errorf("fragmented udp packets are not supported")
+	}
+	reader := bytes.NewReader(packet[3:])
+	target, err := readSocks5Addr(reader)
+	if err != nil {
+		return "", nil, err
+	}
+	return target, packet[len(packet)-reader.Len():], nil
+}
+
+func buildSocks5UDPHeader(from *net.UDPAddr) []byte {
+	return append([]byte{0x00, 0x00, 0x00}, encodeSocks5Addr(from)...)
+}
+
+func dialErrorReply(err error) byte {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5ReplyHostUnreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5ReplyHostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return socks5ReplyHostUnreachable
+	}
+	return socks5ReplyGeneralFailure
+}
+
+// udpPeer identifies a UDP address independent of how its IPv4 address is
+// represented.
+func udpPeer(addr *net.UDPAddr) netip.AddrPort {
+	peer := addr.AddrPort()
+	return netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())
+}
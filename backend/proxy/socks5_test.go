@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReadSocks5Request(t *testing.T) {
+	tests := []struct {
+		raw    []byte
+		cmd    byte
+		target string
+		code   byte
+	}{
+		{[]byte{5, 1, 0, 1, 93, 184, 216, 34, 0x01, 0xbb}, socks5CmdConnect, "93.184.216.34:443", 0},
+		{[]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}, socks5CmdUDPAssociate, "0.0.0.0:0", 0},
+		{append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0, 80), socks5CmdConnect, "example.com:80", 0},
+		{append(append([]byte{5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 0x1f, 0x90), socks5CmdConnect, "[2001:db8::1]:8080", 0},
+		{[]byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, 0, "", socks5ReplyCommandUnsupported},
+		{[]byte{5, 9, 0, 1, 127, 0, 0, 1, 0, 80}, 0, "", socks5ReplyCommandUnsupported},
+		{[]byte{5, 1, 0, 2, 127, 0, 0, 1, 0, 80}, 0, "", socks5ReplyAddressUnsupported},
+	}
+	for _, tt := range tests {
+		cmd, target, err := readSocks5Request(bytes.NewReader(tt.raw))
+		if tt.code != 0 {
+			var serr *socks5Error
+			if !errors.As(err, &serr) || serr.code != tt.code {
+				t.Errorf("readSocks5Request(%v) error = %v, want socks5 reply code %d", tt.raw, err, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("readSocks5Request(%v) failed: %v", tt.raw, err)
+			continue
+		}
+		if cmd != tt.cmd || target != tt.target {
+			t.Errorf("readSocks5Request(%v) = %d, %q; want %d, %q", tt.raw, cmd, target, tt.cmd, tt.target)
+		}
+	}
+}
+
+func TestReadSocks5RequestMalformed(t *testing.T) {
+	for _, raw := range [][]byte{
+		{},
+		{5, 1},
+		{4, 1, 0, 1, 127, 0, 0, 1, 0, 80},
+		{5, 1, 0},
+		{5, 1, 0, 1, 127, 0, 0},
+		{5, 1, 0, 1, 127, 0, 0, 1, 0},
+		{5, 1, 0, 3},
+		{5, 1, 0, 3, 11, 'e', 'x'},
+		{5, 1, 0, 4, 0x20, 0x01},
+	} {
+		if _, target, err := readSocks5Request(bytes.NewReader(raw)); err == nil {
+			t.Errorf("readSocks5Request(%v) = %q, want an error", raw, target)
+		}
+	}
+}
+
+func TestParseSocks5UDPPacket(t *testing.T) {
+	tests := []struct {
+		packet  []byte
+		target  string
+		payload string
+		ok      bool
+	}{
+		{[]byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53, 'q'}, "8.8.8.8:53", "q", true},
+		{[]byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53}, "8.8.8.8:53", "", true},
+		{append(append([]byte{0, 0, 0, 3, 7}, "dns.foo"...), 0, 53, 'a', 'b'), "dns.foo:53", "ab", true},
+		{append(append([]byte{0, 0, 0, 4}, net.ParseIP("2001:db8::53")...), 0, 53, 'x'), "[2001:db8::53]:53", "x", true},
+		{[]byte{0, 0, 0}, "", "", false},
+		{[]byte{0, 0, 1, 1, 8, 8, 8, 8, 0, 53, 'q'}, "", "", false},
+		{[]byte{0, 0, 0, 1, 8, 8}, "", "", false},
+		{[]byte{0, 0, 0, 5, 8, 8, 8, 8, 0, 53}, "", "", false},
+	}
+	for _, tt := range tests {
+		target, payload, err := parseSocks5UDPPacket(tt.packet)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseSocks5UDPPacket(%v) error = %v, want ok %v", tt.packet, err, tt.ok)
+			continue
+		}
+		if target != tt.target || string(payload) != tt.payload {
+			t.Errorf("parseSocks5UDPPacket(%v) = %q, %q; want %q, %q", tt.packet, target, payload, tt.target, tt.payload)
+		}
+	}
+}
+
+func TestSocks5UDPHeaderRoundTrip(t *testing.T) {
+	for _, addr := range []string{"8.8.8.8:53", "[::ffff:10.0.0.1]:1234", "[2001:db8::1]:443"} {
+		from, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatalf("invalid test address %q: %v", addr, err)
+		}
+		packet := append(buildSocks5UDPHeader(from), "data"...)
+		target, payload, err := parseSocks5UDPPacket(packet)
+		if err != nil {
+			t.Errorf("parseSocks5UDPPacket(buildSocks5UDPHeader(%s)) failed: %v", addr, err)
+			continue
+		}
+		back, err := net.ResolveUDPAddr("udp", target)
+		if err != nil || udpPeer(back) != udpPeer(from) || string(payload) != "data" {
+			t.Errorf("round trip of %s = %q, %q; want the same address and payload", addr, target, payload)
+		}
+	}
+}
+
+func TestSocks5ClientIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 51000}, "192.0.2.7"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51000}, "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		if got := socks5ClientIP(addrConn{remote: tt.addr}); got != tt.want {
+			t.Errorf("socks5ClientIP(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// addrConn is a net.Conn that only reports its remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+
+	"proxy-server/database"
+)
+
+// parseSourceAddrs turns a user's egress addresses into IPs, skipping any
+// that no longer parse.
+func parseSourceAddrs(userID int, entries []string) []net.IP {
+	var addrs []net.IP
+	for _, entry := range entries {
+		ip := net.ParseIP(strings.TrimSpace(entry))
+		if ip == nil {
+			log.Printf("Ignoring invalid egress address for user %d: %q", userID, entry)
+			continue
+		}
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+// hasSourceAddrs reports whether the user's direct connections leave from
+// addresses of their own.
+func (p *userPolicy) hasSourceAddrs() bool {
+	return p != nil && len(p.sourceAddrs) > 0
+}
+
+// errNoSourceAddr is returned when none of a user's egress addresses can
+// reach the destination's address family. The connection fails rather than
+// leaving from the shared default address.
+var errNoSourceAddr = errors.New("no egress address of the destination's address family")
+
+// sourceAddr picks the local address a direct connection to host is made
+// from, or nil for the system default. When host is an IP literal only
+// addresses of the same family are considered; for host names the dialer
+// only tries resolved addresses of the chosen family.
+func (p *userPolicy) sourceAddr(host string) (net.IP, error) {
+	if !p.hasSourceAddrs() {
+		return nil, nil
+	}
+	candidates := p.sourceAddrs
+	if target := net.ParseIP(host); target != nil {
+		candidates = nil
+		for _, ip := range p.sourceAddrs {
+			if (ip.To4() != nil) == (target.To4() != nil) {
+				candidates = append(candidates, ip)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, errNoSourceAddr
+		}
+	}
+
+	switch p.EgressStrategy {
+	case database.EgressStrategyRandom:
+		return candidates[rand.Intn(len(candidates))], nil
+	case database.EgressStrategySticky:
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(host)))
+		return candidates[h.Sum32()%uint32(len(candidates))], nil
+	default:
+		return candidates[(p.rotation.Add(1)-1)%uint64(len(candidates))], nil
+	}
+}
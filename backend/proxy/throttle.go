@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+)
+
+const (
+	bandwidthRefreshInterval = 5 * time.Second
+	// maxThrottleChunk bounds a single reservation so rate changes and
+	// competing connections are picked up quickly.
+	maxThrottleChunk = 32 * 1024
+)
+
+// tokenBucket is a byte rate limiter that may run into debt: a reservation
+// always succeeds and returns how long the caller must wait, which keeps
+// concurrent connections of one user fair without a queue.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// setLimit changes the rate in bytes per second. A rate of zero disables
+// the bucket; a burst of zero defaults to one second at rate.
+func (b *tokenBucket) setLimit(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	b.configure(float64(rate), float64(burst))
+}
+
+func (b *tokenBucket) configure(rate, burst float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate == b.rate && burst == b.burst {
+		return
+	}
+	b.rate = rate
+	b.burst = burst
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	if b.last.IsZero() {
+		b.tokens = b.burst
+		b.last = time.Now()
+	}
+}
+
+// chunk returns the largest write that should be reserved at once.
+func (b *tokenBucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 || b.burst >= maxThrottleChunk {
+		return maxThrottleChunk
+	}
+	if b.burst < 1 {
+		return 1
+	}
+	return int(b.burst)
+}
+
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill()
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refill credits tokens accrued since the last call. b.mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes one token if available, for counting events rather than
+// bytes. A disabled bucket always allows.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+
+	b.refill()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund returns a token taken by allow for an event that did not happen.
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// userBandwidth holds the buckets shared by all connections of one user.
+type userBandwidth struct {
+	up   tokenBucket
+	down tokenBucket
+	// lastUsed is guarded by bandwidthManager.mu.
+	lastUsed time.Time
+}
+
+func (u *userBandwidth) set(limit models.BandwidthLimit) {
+	u.up.setLimit(limit.BandwidthUp, limit.BandwidthBurst)
+	u.down.setLimit(limit.BandwidthDown, limit.BandwidthBurst)
+}
+
+// upload throttles client to destination traffic written to w. Writes
+// fail once ctx, the connection's context, is done.
+func (u *userBandwidth) upload(ctx context.Context, w io.Writer) io.Writer {
+	if u == nil {
+		return w
+	}
+	return throttledWriter{ctx: ctx, w: w, bucket: &u.up}
+}
+
+// download throttles destination to client traffic written to w.
+func (u *userBandwidth) download(ctx context.Context, w io.Writer) io.Writer {
+	if u == nil {
+		return w
+	}
+	return throttledWriter{ctx: ctx, w: w, bucket: &u.down}
+}
+
+// uploadReader throttles a request body read on behalf of the client.
+func (u *userBandwidth) uploadReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	if u == nil {
+		return r
+	}
+	return &throttledReader{ReadCloser: r, ctx: ctx, bucket: &u.up}
+}
+
+// waitUpload blocks until n bytes of client to destination traffic fit
+// the upload rate. Unlike upload it reserves n whole, for datagrams that
+// cannot be split.
+func (u *userBandwidth) waitUpload(ctx context.Context, n int) error {
+	if u == nil {
+		return nil
+	}
+	return throttleWait(ctx, u.up.reserve(n))
+}
+
+// waitDownload is waitUpload for destination to client traffic.
+func (u *userBandwidth) waitDownload(ctx context.Context, n int) error {
+	if u == nil {
+		return nil
+	}
+	return throttleWait(ctx, u.down.reserve(n))
+}
+
+// throttleWait waits for d, or returns ctx's error as soon as the
+// connection is closed, terminated or drained at shutdown.
+func throttleWait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bandwidthManager keeps one userBandwidth per user and refreshes limits
+// periodically so edits apply to connections that are already open.
+type bandwidthManager struct {
+	db    *database.Database
+	mu    sync.Mutex
+	users map[int]*userBandwidth
+}
+
+func newBandwidthManager(db *database.Database) *bandwidthManager {
+	return &bandwidthManager{db: db, users: make(map[int]*userBandwidth)}
+}
+
+// forUser returns the user's shared buckets updated to limit.
+func (m *bandwidthManager) forUser(userID int, limit models.BandwidthLimit) *userBandwidth {
+	m.mu.Lock()
+	u, ok := m.users[userID]
+	if !ok {
+		u = &userBandwidth{}
+		m.users[userID] = u
+	}
+	u.lastUsed = time.Now()
+	m.mu.Unlock()
+
+	u.set(limit)
+	return u
+}
+
+// forget drops the buckets of a deleted user.
+func (m *bandwidthManager) forget(userID int) {
+	m.mu.Lock()
+	delete(m.users, userID)
+	m.mu.Unlock()
+}
+
+// sweep drops the buckets of users without open connections that have not
+// been handed out since cutoff. Connections of one user must keep sharing
+// the same buckets, so busy users are never swept.
+func (m *bandwidthManager) sweep(cutoff time.Time, busy map[int]struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, u := range m.users {
+		if _, ok := busy[userID]; !ok && u.lastUsed.Before(cutoff) {
+			delete(m.users, userID)
+		}
+	}
+}
+
+func (m *bandwidthManager) run(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *bandwidthManager) refresh() {
+	limits, err := m.db.GetBandwidthLimits()
+	if err != nil {
+		log.Printf("Failed to load bandwidth limits: %v", err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userID, u := range m.users {
+		u.set(limits[userID])
+	}
+}
+
+type throttledWriter struct {
+	ctx    context.Context
+	w      io.Writer
+	bucket *tokenBucket
+}
+
+func (tw throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if chunk := tw.bucket.chunk(); n > chunk {
+			n = chunk
+		}
+		if err := throttleWait(tw.ctx, tw.bucket.reserve(n)); err != nil {
+			return written, err
+		}
+		m, err := tw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if chunk := tr.bucket.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := throttleWait(tr.ctx, tr.bucket.reserve(n)); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
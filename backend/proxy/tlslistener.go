@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProxyTLSPort = "8443"
+	// certCheckInterval bounds how often the listener certificate files
+	// are checked for changes.
+	certCheckInterval = 10 * time.Second
+)
+
+// Client certificate fields a user can be identified by. The value is
+// matched against usernames.
+const (
+	clientIdentityCN    = "cn"
+	clientIdentityEmail = "email"
+	clientIdentityDNS   = "dns"
+)
+
+// proxyTLS serves the proxy over TLS on a port of its own, so credentials
+// are not sent in clear, and optionally accepts client certificates in
+// place of a password. It is configured from PROXY_TLS_* environment
+// variables.
+type proxyTLS struct {
+	addr      string
+	certs     *certReloader
+	clientCAs *x509.CertPool
+	identity  string
+}
+
+// loadProxyTLS returns nil when PROXY_TLS_CERT and PROXY_TLS_KEY are unset.
+func loadProxyTLS() (*proxyTLS, error) {
+	certFile, keyFile := os.Getenv("PROXY_TLS_CERT"), os.Getenv("PROXY_TLS_KEY")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("PROXY_TLS_CERT and PROXY_TLS_KEY must be set together")
+	}
+
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+
+	port := os.Getenv("PROXY_TLS_PORT")
+	if port == "" {
+		port = defaultProxyTLSPort
+	}
+	t := &proxyTLS{addr: ":" + port, certs: certs}
+
+	if caFile := os.Getenv("PROXY_TLS_CLIENT_CA"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read PROXY_TLS_CLIENT_CA: %w", err)
+		}
+		t.clientCAs = x509.NewCertPool()
+		if !t.clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("PROXY_TLS_CLIENT_CA contains no certificates")
+		}
+
+		t.identity = strings.ToLower(strings.TrimSpace(os.Getenv("PROXY_TLS_CLIENT_IDENTITY")))
+		switch t.identity {
+		case "":
+			t.identity = clientIdentityCN
+		case clientIdentityCN, clientIdentityEmail, clientIdentityDNS:
+		default:
+			return nil, fmt.Errorf("unknown PROXY_TLS_CLIENT_IDENTITY %q (use cn, email or dns)", t.identity)
+		}
+	}
+	return t, nil
+}
+
+func (t *proxyTLS) config() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: t.certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		// CONNECT and upgrades need the connection to be hijackable.
+		NextProtos: []string{"http/1.1"},
+	}
+	if t.clientCAs != nil {
+		// Clients without a certificate can still log in with a password.
+		config.ClientCAs = t.clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// clientUsername returns the username a verified client certificate
+// identifies, taken from the configured certificate field.
+func (t *proxyTLS) clientUsername(cert *x509.Certificate) (string, error) {
+	var username string
+	switch t.identity {
+	case clientIdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			username = cert.EmailAddresses[0]
+		}
+	case clientIdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			username = cert.DNSNames[0]
+		}
+	default:
+		username = cert.Subject.CommonName
+	}
+	if username == "" {
+		return "", fmt.Errorf("client certificate has no %s", t.identity)
+	}
+	return username, nil
+}
+
+// certReloader serves the listener certificate and picks up replaced
+// files, e.g. after renewal, without a restart. A pair that fails to load
+// is logged and the previous certificate stays in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load proxy TLS certificate: %w", err)
+	}
+	c.cert = &pair
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("stat proxy TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checkedAt = time.Now()
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		log.Printf("Keeping current proxy TLS certificate: %v", err)
+		return c.cert, nil
+	}
+	if modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		log.Printf("Keeping current proxy TLS certificate: %v", err)
+		c.modTime = modTime
+		return c.cert, nil
+	}
+	log.Printf("Reloaded proxy TLS certificate from %s", c.certFile)
+	return c.cert, nil
+}
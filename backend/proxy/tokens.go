@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+	"proxy-server/utils"
+)
+
+// tokenTouchInterval bounds how often the last use of a proxy token is
+// written to the database.
+const tokenTouchInterval = time.Minute
+
+// tokenUsage records when and from where proxy tokens are used, including
+// logins served from the auth cache.
+type tokenUsage struct {
+	db *database.Database
+
+	mu      sync.Mutex
+	byKey   map[credentialKey]tokenUse
+	written map[int]time.Time
+	// touches tracks last-use writes still in flight.
+	touches sync.WaitGroup
+}
+
+// tokenUse ties cached credentials to the token they were checked against.
+type tokenUse struct {
+	tokenID int
+	userID  int
+	seen    time.Time
+}
+
+func newTokenUsage(db *database.Database) *tokenUsage {
+	return &tokenUsage{
+		db:      db,
+		byKey:   make(map[credentialKey]tokenUse),
+		written: make(map[int]time.Time),
+	}
+}
+
+func (u *tokenUsage) remember(key credentialKey, tokenID, userID int) {
+	u.mu.Lock()
+	u.byKey[key] = tokenUse{tokenID: tokenID, userID: userID, seen: time.Now()}
+	u.mu.Unlock()
+}
+
+func (u *tokenUsage) used(key credentialKey, clientIP string) {
+	now := time.Now()
+	u.mu.Lock()
+	use, ok := u.byKey[key]
+	if ok {
+		use.seen = now
+		u.byKey[key] = use
+	}
+	tokenID := use.tokenID
+	if !ok || now.Sub(u.written[tokenID]) < tokenTouchInterval {
+		u.mu.Unlock()
+		return
+	}
+	u.written[tokenID] = now
+	u.touches.Add(1)
+	u.mu.Unlock()
+
+	go func() {
+		defer u.touches.Done()
+		if err := u.db.TouchProxyToken(tokenID, clientIP, now); err != nil {
+			log.Printf("Failed to record use of proxy token %d: %v", tokenID, err)
+		}
+	}()
+}
+
+// forgetUser drops the tokens of a user, whose cached credentials were
+// just invalidated, e.g. because a token was revoked.
+func (u *tokenUsage) forgetUser(userID int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, use := range u.byKey {
+		if use.userID == userID {
+			delete(u.byKey, key)
+			delete(u.written, use.tokenID)
+		}
+	}
+}
+
+func (u *tokenUsage) forgetAll() {
+	u.mu.Lock()
+	u.byKey = make(map[credentialKey]tokenUse)
+	u.written = make(map[int]time.Time)
+	u.mu.Unlock()
+}
+
+// run sweeps tokens until ctx is cancelled, then waits for last-use writes
+// still in flight.
+func (u *tokenUsage) run(ctx context.Context) {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.sweep()
+		case <-ctx.Done():
+			u.touches.Wait()
+			return
+		}
+	}
+}
+
+// sweep drops tokens whose credentials have left the auth cache; a later
+// login checks them against the database and remembers them again.
+func (u *tokenUsage) sweep() {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, use := range u.byKey {
+		if now.Sub(use.seen) > authCacheTTL {
+			delete(u.byKey, key)
+		}
+	}
+	for tokenID, at := range u.written {
+		if now.Sub(at) >= tokenTouchInterval {
+			delete(u.written, tokenID)
+		}
+	}
+}
+
+// authenticateToken logs in with a proxy token. With Basic auth username
+// must name the token's owner; Bearer tokens pass an empty username.
+func (ps *ProxyServer) authenticateToken(username, token, clientIP string) (*utils.Claims, error) {
+	key := credentialHash(username, token)
+	if claims, ok := ps.cache.lookupCredentials(key); ok {
+		ps.tokenUsage.used(key, clientIP)
+		return claims, nil
+	}
+	gen := ps.cache.generation()
+
+	stored, err := ps.db.GetProxyTokenByHash(utils.HashProxyToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("unknown proxy token")
+	}
+	if stored.ExpiresAt != nil && !time.Now().Before(*stored.ExpiresAt) {
+		return nil, fmt.Errorf("proxy token %d expired", stored.ID)
+	}
+
+	user, err := ps.db.GetUserByID(stored.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err := checkProxyUser(user); err != nil {
+		return nil, err
+	}
+	if username != "" && !strings.EqualFold(username, user.Username) {
+		return nil, fmt.Errorf("proxy token does not belong to %s", username)
+	}
+
+	claims := &utils.Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		IsAdmin:  user.IsAdmin,
+	}
+	ps.cache.storeCredentialsUntil(gen, key, claims, stored.ExpiresAt)
+	ps.tokenUsage.remember(key, stored.ID, user.ID)
+	ps.tokenUsage.used(key, clientIP)
+	return claims, nil
+}
+
+// checkProxyUser rejects accounts that may not use the proxy.
+func checkProxyUser(user *models.User) error {
+	if !user.IsActive {
+		return fmt.Errorf("user is inactive")
+	}
+	if user.IsAdmin {
+		return fmt.Errorf("admin accounts cannot use proxy")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// transportMaxIdleConns bounds idle upstream connections per transport.
+const transportMaxIdleConns = 1024
+
+// transportConfig is the part of runtimeSettings the forwarding transports
+// are built from. Transports are replaced when it changes.
+type transportConfig struct {
+	dialTimeout         time.Duration
+	tlsHandshakeTimeout time.Duration
+	idleConnTimeout     time.Duration
+	responseTimeout     time.Duration
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	http2               bool
+	blockPrivate        bool
+}
+
+func transportConfigFrom(settings *runtimeSettings) transportConfig {
+	return transportConfig{
+		dialTimeout:         settings.TransportDialTimeout,
+		tlsHandshakeTimeout: settings.TransportTLSTimeout,
+		idleConnTimeout:     settings.TransportIdleTimeout,
+		responseTimeout:     settings.Timeout,
+		maxIdleConnsPerHost: settings.TransportMaxIdlePerHost,
+		maxConnsPerHost:     settings.TransportMaxConnsPerHost,
+		http2:               settings.TransportHTTP2,
+		blockPrivate:        settings.BlockPrivateDestinations,
+	}
+}
+
+// transportKey separates pooled connections that must not be shared.
+// Requests routed through the same upstream pool share a transport; users
+// with egress exceptions or egress addresses get their own, so connections
+// to destinations only they may reach, or from addresses dedicated to
+// them, are never reused for anyone else.
+type transportKey struct {
+	pool   string
+	userID int
+}
+
+type policyContextKey struct{}
+
+// transportPool owns the long-lived transports plain HTTP requests are
+// forwarded with, keeping upstream connections alive between requests.
+type transportPool struct {
+	ps *ProxyServer
+
+	mu         sync.Mutex
+	config     transportConfig
+	transports map[transportKey]*http.Transport
+}
+
+func newTransportPool(ps *ProxyServer) *transportPool {
+	return &transportPool{ps: ps, transports: make(map[transportKey]*http.Transport)}
+}
+
+// roundTrip forwards req for the user owning prefs. Redirects are returned
+// to the client rather than followed, so their targets go through the
+// access checks like any other request.
+func (p *transportPool) roundTrip(req *http.Request, userID int, prefs *userPolicy) (*http.Response, error) {
+	defaultPort := "80"
+	if req.URL.Scheme == "https" {
+		defaultPort = "443"
+	}
+	key := transportKey{pool: selectUpstreamPool(prefs, hostWithPort(req.URL.Host, defaultPort))}
+	if prefs != nil && (len(prefs.EgressExceptions) > 0 || prefs.hasSourceAddrs()) {
+		key.userID = userID
+	}
+	ctx := context.WithValue(req.Context(), policyContextKey{}, prefs)
+	return p.get(key).RoundTrip(req.WithContext(ctx))
+}
+
+func (p *transportPool) get(key transportKey) *http.Transport {
+	config := transportConfigFrom(p.ps.settings.get())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if config != p.config {
+		for _, t := range p.transports {
+			t.CloseIdleConnections()
+		}
+		p.transports = make(map[transportKey]*http.Transport)
+		p.config = config
+	}
+	if t, ok := p.transports[key]; ok {
+		return t
+	}
+	t := p.newTransport(key.pool, config)
+	p.transports[key] = t
+	return t
+}
+
+func (p *transportPool) newTransport(pool string, config transportConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			prefs, _ := ctx.Value(policyContextKey{}).(*userPolicy)
+			ctx, cancel := context.WithTimeout(ctx, config.dialTimeout)
+			defer cancel()
+			return p.ps.dialRoute(ctx, prefs, pool, addr)
+		},
+		ForceAttemptHTTP2:     config.http2,
+		TLSHandshakeTimeout:   config.tlsHandshakeTimeout,
+		IdleConnTimeout:       config.idleConnTimeout,
+		ResponseHeaderTimeout: config.responseTimeout,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          transportMaxIdleConns,
+		MaxIdleConnsPerHost:   config.maxIdleConnsPerHost,
+		MaxConnsPerHost:       config.maxConnsPerHost,
+		// Responses are relayed as the origin sent them.
+		DisableCompression: true,
+	}
+}
+
+// forgetUser closes the idle connections of a user's own transports after
+// their settings changed.
+func (p *transportPool) forgetUser(userID int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, t := range p.transports {
+		if key.userID == userID {
+			t.CloseIdleConnections()
+			delete(p.transports, key)
+		}
+	}
+}
+
+func (p *transportPool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.transports {
+		t.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"proxy-server/utils"
+)
+
+// hopHeaders are connection specific and are not forwarded, stored or
+// replayed (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol a message asks to switch to, or "" if
+// it is not an upgrade.
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// prepareOutboundHeader strips hop-by-hop headers from a request about to
+// be forwarded. The headers needed to upgrade the connection and to accept
+// trailers are carried over to the next hop.
+func prepareOutboundHeader(h http.Header) (upgrade string) {
+	upgrade = upgradeType(h)
+	trailers := false
+	for _, value := range h.Values("Te") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	removeHopHeaders(h)
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	return upgrade
+}
+
+// relayUpgrade completes a 101 Switching Protocols response: it writes the
+// response head to client and then copies bytes between client and the
+// upstream connection until either side closes. Both directions count
+// toward the user's quota and bandwidth limits, and traffic is recorded
+// while the connection is open.
+func (ps *ProxyServer) relayUpgrade(ctx context.Context, client net.Conn, resp *http.Response, claims *utils.Claims, prefs *userPolicy, meter *quotaMeter, method, requestURL string, requestSize int64, startTime time.Time) {
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		fmt.Fprint(client, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		ps.logRequest(claims.UserID, method, requestURL, http.StatusBadGateway, requestSize, 0, startTime)
+		return
+	}
+	defer backend.Close()
+
+	protocol := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+
+	client.SetDeadline(time.Time{})
+	head := &countingWriter{w: meteredWriter{w: prefs.bandwidth.download(ctx, client), meter: meter}}
+	fmt.Fprintf(head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(head)
+	if _, err := io.WriteString(head, "\r\n"); err != nil {
+		ps.logRequest(claims.UserID, method, requestURL, resp.StatusCode, requestSize, head.n, startTime)
+		ps.recordTraffic(claims.UserID, meter, requestSize, head.n)
+		return
+	}
+
+	traffic := ps.startLiveTraffic(claims.UserID, meter)
+	traffic.add(requestSize, head.n)
+	exceeded := ps.relay(ctx, client, backend, traffic, prefs, meter)
+	bytesSent, bytesReceived := traffic.finish()
+
+	status, reason := resp.StatusCode, ""
+	if exceeded != nil {
+		status, reason = http.StatusTooManyRequests, exceeded.reason()
+	}
+	ps.logRequestReason(claims.UserID, method, requestURL, status, bytesSent, bytesReceived, startTime, reason)
+}
@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy-server/database"
+	"proxy-server/models"
+	"proxy-server/utils"
+)
+
+const (
+	upstreamTypeHTTP   = "http"
+	upstreamTypeSOCKS5 = "socks5"
+
+	upstreamPoolDirect = "direct"
+
+	upstreamRefreshInterval = 30 * time.Second
+	upstreamDialTimeout     = 10 * time.Second
+	upstreamCheckTimeout    = 5 * time.Second
+)
+
+type upstreamEntry struct {
+	proxy    models.UpstreamProxy
+	password string
+	healthy  atomic.Bool
+}
+
+// upstreamManager keeps the active upstream proxies grouped by pool,
+// periodically reloading them from the database and probing their health.
+type upstreamManager struct {
+	db *database.Database
+
+	mu    sync.RWMutex
+	pools map[string][]*upstreamEntry
+}
+
+func newUpstreamManager(db *database.Database) *upstreamManager {
+	return &upstreamManager{
+		db:    db,
+		pools: make(map[string][]*upstreamEntry),
+	}
+}
+
+func (m *upstreamManager) run(ctx context.Context) {
+	m.refresh()
+	ticker := time.NewTicker(upstreamRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *upstreamManager) refresh() {
+	upstreams, err := m.db.GetUpstreamProxies()
+	if err != nil {
+		log.Printf("Failed to load upstream proxies: %v", err)
+		return
+	}
+
+	pools := make(map[string][]*upstreamEntry)
+	for _, upstream := range upstreams {
+		if !upstream.IsActive {
+			continue
+		}
+		entry := &upstreamEntry{proxy: upstream}
+		if upstream.Password != "" {
+			password, err := utils.DecryptSecret(upstream.Password)
+			if err != nil {
+				log.Printf("Failed to decrypt password for upstream %s: %v", upstream.Name, err)
+				continue
+			}
+			entry.password = password
+		}
+		entry.healthy.Store(upstream.Healthy)
+		pools[upstream.Pool] = append(pools[upstream.Pool], entry)
+	}
+
+	var wg sync.WaitGroup
+	for _, members := range pools {
+		for _, entry := range members {
+			wg.Add(1)
+			go func(entry *upstreamEntry) {
+				defer wg.Done()
+				m.probe(entry)
+			}(entry)
+		}
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	m.pools = pools
+	m.mu.Unlock()
+}
+
+// probe checks that the upstream accepts TCP connections and records the
+// result so the admin API can show it.
+func (m *upstreamManager) probe(entry *upstreamEntry) {
+	conn, err := net.DialTimeout("tcp", entry.proxy.Address, upstreamCheckTimeout)
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	} else {
+		conn.Close()
+	}
+	entry.healthy.Store(err == nil)
+	if dbErr := m.db.UpdateUpstreamHealth(entry.proxy.ID, err == nil, lastError); dbErr != nil {
+		log.Printf("Failed to record upstream health: %v", dbErr)
+	}
+}
+
+// recordHealth updates the upstream state after a real dial, persisting
+// only transitions so busy pools do not write on every request.
+func (m *upstreamManager) recordHealth(entry *upstreamEntry, err error) {
+	healthy := err == nil
+	if entry.healthy.Swap(healthy) == healthy {
+		return
+	}
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("Upstream %s marked unhealthy: %v", entry.proxy.Name, err)
+	} else {
+		log.Printf("Upstream %s is healthy again", entry.proxy.Name)
+	}
+	if dbErr := m.db.UpdateUpstreamHealth(entry.proxy.ID, healthy, lastError); dbErr != nil {
+		log.Printf("Failed to record upstream health: %v", dbErr)
+	}
+}
+
+// candidates returns the pool members with healthy upstreams first, each
+// group kept in priority order.
+func (m *upstreamManager) candidates(pool string) []*upstreamEntry {
+	m.mu.RLock()
+	members := m.pools[pool]
+	m.mu.RUnlock()
+
+	ordered := make([]*upstreamEntry, 0, len(members))
+	for _, entry := range members {
+		if entry.healthy.Load() {
+			ordered = append(ordered, entry)
+		}
+	}
+	for _, entry := range members {
+		if !entry.healthy.Load() {
+			ordered = append(ordered, entry)
+		}
+	}
+	return ordered
+}
+
+// dial opens a connection to addr through the named pool, failing over to
+// the next member whenever an upstream cannot be reached.
+func (m *upstreamManager) dial(ctx context.Context, pool, addr string) (net.Conn, error) {
+	candidates := m.candidates(pool)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no upstream proxies available in pool %q", pool)
+	}
+
+	var lastErr error
+	for _, entry := range candidates {
+		conn, err := dialViaUpstream(ctx, entry, addr)
+		if err == nil {
+			m.recordHealth(entry, nil)
+			return conn, nil
+		}
+		lastErr = err
+		if isUpstreamFailure(err) {
+			m.recordHealth(entry, err)
+		} else {
+			// The upstream answered but refused the target; trying the next
+			// member would only repeat the same refusal.
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("all upstreams in pool %q failed: %w", pool, lastErr)
+}
+
+// upstreamRejectError is returned when the upstream itself is reachable but
+// declines to connect to the requested target.
+type upstreamRejectError struct {
+	msg string
+}
+
+func (e *upstreamRejectError) Error() string {
+	return e.msg
+}
+
+func isUpstreamFailure(err error) bool {
+	_, rejected := err.(*upstreamRejectError)
+	return !rejected
+}
+
+func dialViaUpstream(ctx context.Context, entry *upstreamEntry, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", entry.proxy.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(upstreamDialTimeout))
+	}
+
+	var tunnel net.Conn
+	switch entry.proxy.Type {
+	case upstreamTypeSOCKS5:
+		tunnel, err = socks5ClientConnect(conn, entry.proxy.Username, entry.password, addr)
+	default:
+		tunnel, err = httpConnectTunnel(conn, entry.proxy.Username, entry.password, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// httpConnectTunnel issues a CONNECT request over conn. Plain HTTP traffic
+// is tunneled the same way so every upstream type behaves identically.
+func httpConnectTunnel(conn net.Conn, username, password, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if username != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotFound, http.StatusBadGateway:
+		// These are about the target; any other status, such as a 407 for
+		// bad credentials or a 503, means the upstream itself is unusable.
+		return nil, &upstreamRejectError{msg: fmt.Sprintf("upstream CONNECT to %s failed: %s", addr, resp.Status)}
+	default:
+		return nil, fmt.Errorf("upstream CONNECT to %s failed: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// socks5ClientConnect performs a SOCKS5 CONNECT handshake over conn, using
+// username/password authentication when credentials are configured.
+func socks5ClientConnect(conn net.Conn, username, password, addr string) (net.Conn, error) {
+	method := byte(0x00)
+	if username != "" {
+		method = socks5MethodUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 0x01, method}); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return nil, fmt.Errorf("upstream socks5 rejected authentication method")
+	}
+
+	if method == socks5MethodUserPass {
+		if len(username) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("upstream socks5 credentials too long")
+		}
+		auth := []byte{socks5AuthVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, fmt.Errorf("upstream socks5 authentication failed")
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("hostname too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	switch header[1] {
+	case socks5ReplySucceeded:
+	case socks5ReplyNotAllowed, socks5ReplyNetworkUnreachable, socks5ReplyHostUnreachable, socks5ReplyConnectionRefused:
+		return nil, &upstreamRejectError{msg: fmt.Sprintf("upstream socks5 CONNECT to %s failed with code %d", addr, header[1])}
+	default:
+		return nil, fmt.Errorf("upstream socks5 CONNECT to %s failed with code %d", addr, header[1])
+	}
+	if _, err := readSocks5Addr(conn); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// selectUpstreamPool picks the pool for addr: the first matching
+// destination rule wins, otherwise the user's default pool applies. An
+// empty result means a direct connection.
+func selectUpstreamPool(policy *userPolicy, addr string) string {
+	if policy == nil || policy.UserProxySettings == nil {
+		return ""
+	}
+	host, port := splitTarget(addr, 0)
+	pool := policy.UpstreamPool
+	for _, route := range policy.upstreamRules {
+		if route.matcher.Match(host, port) {
+			pool = route.pool
+			break
+		}
+	}
+	if strings.EqualFold(pool, upstreamPoolDirect) {
+		return ""
+	}
+	return pool
+}
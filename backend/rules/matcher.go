@@ -0,0 +1,262 @@
+package rules
+
+import (
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Matcher is a compiled set of rules. Host lookups are map based; only
+// CIDR and regex rules are evaluated linearly.
+type Matcher struct {
+	exact      map[string][]int
+	subdomains map[string][]int
+	domains    map[string][]int
+	ips        map[string][]int
+	cidrs      []*Rule
+	regexes    []*Rule
+	paths      []*Rule
+}
+
+// Compile parses entries into a Matcher. Invalid entries are skipped and
+// reported in the returned error slice so that one bad row cannot disable a
+// whole list.
+func Compile(entries []string) (*Matcher, []error) {
+	m := &Matcher{
+		exact:      make(map[string][]int),
+		subdomains: make(map[string][]int),
+		domains:    make(map[string][]int),
+		ips:        make(map[string][]int),
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		rule, err := Parse(entry)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.Add(rule)
+	}
+	return m, errs
+}
+
+func (m *Matcher) Add(rule *Rule) {
+	if rule.Path != "" {
+		m.paths = append(m.paths, rule)
+		return
+	}
+	switch rule.Kind {
+	case KindExact:
+		m.exact[rule.Host] = append(m.exact[rule.Host], rule.Port)
+	case KindSubdomains:
+		m.subdomains[rule.Host] = append(m.subdomains[rule.Host], rule.Port)
+	case KindDomain:
+		m.domains[rule.Host] = append(m.domains[rule.Host], rule.Port)
+	case KindIP:
+		m.ips[rule.Host] = append(m.ips[rule.Host], rule.Port)
+	case KindCIDR:
+		m.cidrs = append(m.cidrs, rule)
+	case KindRegex:
+		m.regexes = append(m.regexes, rule)
+	}
+}
+
+// Empty reports whether the matcher holds no rules.
+func (m *Matcher) Empty() bool {
+	return m == nil || len(m.exact)+len(m.subdomains)+len(m.domains)+len(m.ips)+len(m.cidrs)+len(m.regexes)+len(m.paths) == 0
+}
+
+// Match reports whether host (without port) on port matches any rule. A
+// port of zero only matches rules without a port qualifier.
+func (m *Matcher) Match(host string, port int) bool {
+	if m == nil {
+		return false
+	}
+	host = normalizeHost(host)
+	if host == "" {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if portMatches(m.ips[ip.String()], port) {
+			return true
+		}
+		for _, rule := range m.cidrs {
+			if rule.IPNet.Contains(ip) && (rule.Port == 0 || rule.Port == port) {
+				return true
+			}
+		}
+	} else {
+		if portMatches(m.exact[host], port) || portMatches(m.domains[host], port) {
+			return true
+		}
+		for suffix := parentDomain(host); suffix != ""; suffix = parentDomain(suffix) {
+			if portMatches(m.subdomains[suffix], port) || portMatches(m.domains[suffix], port) {
+				return true
+			}
+		}
+	}
+
+	for _, rule := range m.regexes {
+		if rule.Regex.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchURL reports whether a request for rawPath, as escaped in the request
+// line, on host and port matches any rule. Host rules match every path;
+// path rules never match a path CleanPath rejects.
+func (m *Matcher) MatchURL(host string, port int, rawPath string) bool {
+	if m.Match(host, port) {
+		return true
+	}
+	if m == nil || len(m.paths) == 0 {
+		return false
+	}
+	cleaned, ok := CleanPath(rawPath)
+	if !ok {
+		return false
+	}
+	host = normalizeHost(host)
+	for _, rule := range m.paths {
+		if rule.matchesHost(host, port) && pathMatches(rule.Path, cleaned) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanPath decodes an escaped URL path and resolves its "." and ".."
+// segments, keeping a trailing slash, so that rules see the resource the
+// server will serve rather than one of its spellings. It reports false for
+// paths that cannot be decoded or that climb above the root.
+func CleanPath(rawPath string) (string, bool) {
+	decoded, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(decoded, "/") {
+		decoded = "/" + decoded
+	}
+
+	depth := 0
+	for _, segment := range strings.Split(decoded, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return "", false
+			}
+		default:
+			depth++
+		}
+	}
+
+	cleaned := path.Clean(decoded)
+	if strings.HasSuffix(decoded, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+// MatchAnyPath reports whether some request to host and port could match,
+// counting path rules for the host. It is used to admit a tunnel whose
+// requests are checked individually once decrypted.
+func (m *Matcher) MatchAnyPath(host string, port int) bool {
+	if m.Match(host, port) {
+		return true
+	}
+	if m == nil {
+		return false
+	}
+	host = normalizeHost(host)
+	for _, rule := range m.paths {
+		if rule.matchesHost(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost checks the host and port of a path rule.
+func (r *Rule) matchesHost(host string, port int) bool {
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	switch r.Kind {
+	case KindExact:
+		return host == r.Host
+	case KindDomain:
+		return host == r.Host || strings.HasSuffix(host, "."+r.Host)
+	case KindSubdomains:
+		return strings.HasSuffix(host, "."+r.Host)
+	case KindIP:
+		ip := net.ParseIP(host)
+		return ip != nil && ip.String() == r.Host
+	}
+	return false
+}
+
+func pathMatches(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+func parentDomain(host string) string {
+	idx := strings.IndexByte(host, '.')
+	if idx < 0 {
+		return ""
+	}
+	return host[idx+1:]
+}
+
+func portMatches(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == 0 || p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Set combines matchers, matching where any of them does. Shared host
+// lists are added to a user's own entries this way instead of being
+// copied into a matcher per user.
+type Set []*Matcher
+
+func (s Set) Match(host string, port int) bool {
+	for _, m := range s {
+		if m.Match(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Set) MatchURL(host string, port int, path string) bool {
+	for _, m := range s {
+		if m.MatchURL(host, port, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Set) MatchAnyPath(host string, port int) bool {
+	for _, m := range s {
+		if m.MatchAnyPath(host, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package rules
+
+import "testing"
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{"", "/", true},
+		{"/", "/", true},
+		{"/a/b", "/a/b", true},
+		{"a/b", "/a/b", true},
+		{"//a//b", "/a/b", true},
+		{"/a/./b/", "/a/b/", true},
+		{"/a/b/..", "/a", true},
+		{"/a/../b", "/b", true},
+		{"/a/b/../../c/", "/c/", true},
+		{"/a%2Fb", "/a/b", true},
+		{"/%61dmin", "/admin", true},
+		{"/a%2F..%2Fb", "/b", true},
+		{"/..", "", false},
+		{"/../a", "", false},
+		{"/a/../../b", "", false},
+		{"/%2e%2e/a", "", false},
+		{"/%2E%2E%2Fa", "", false},
+		{"/a%2F..%2F..%2Fb", "", false},
+		{"/%zz", "", false},
+		{"/a%", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := CleanPath(tt.raw)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CleanPath(%q) = %q, %v; want %q, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	m, errs := Compile([]string{
+		"example.com",
+		"*.sub.org",
+		".dom.net",
+		"port.io:8080",
+		"192.168.1.1",
+		"10.0.0.0/8:22",
+		"[2001:db8::1]:443",
+		"2001:db8:1::/48",
+		`re:^ads\d+\.`,
+		"site.io/admin",
+		"not an entry",
+	})
+	if len(errs) != 1 {
+		t.Fatalf("Compile reported %d errors, want 1: %v", len(errs), errs)
+	}
+
+	tests := []struct {
+		host string
+		port int
+		want bool
+	}{
+		{"example.com", 80, true},
+		{"EXAMPLE.com.", 80, true},
+		{"www.example.com", 80, false},
+		{"a.sub.org", 443, true},
+		{"a.b.sub.org", 443, true},
+		{"sub.org", 443, false},
+		{"dom.net", 80, true},
+		{"x.y.dom.net", 80, true},
+		{"otherdom.net", 80, false},
+		{"port.io", 8080, true},
+		{"port.io", 80, false},
+		{"port.io", 0, false},
+		{"192.168.1.1", 0, true},
+		{"192.168.1.2", 0, false},
+		{"10.1.2.3", 22, true},
+		{"10.1.2.3", 80, false},
+		{"[2001:db8::1]", 443, true},
+		{"2001:db8::1", 443, true},
+		{"2001:db8::1", 80, false},
+		{"2001:db8:1::5", 1, true},
+		{"2001:db8:2::5", 1, false},
+		{"ads12.example.org", 80, true},
+		{"myads12.example.org", 80, false},
+		{"site.io", 80, false},
+		{"", 80, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.host, tt.port); got != tt.want {
+			t.Errorf("Match(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestMatcherURL(t *testing.T) {
+	m, errs := Compile([]string{"site.io/admin", "*.api.io:8443/v1/", "example.com"})
+	if len(errs) != 0 {
+		t.Fatalf("Compile failed: %v", errs)
+	}
+
+	tests := []struct {
+		host    string
+		port    int
+		rawPath string
+		want    bool
+	}{
+		{"site.io", 80, "/admin", true},
+		{"site.io", 80, "/admin/users", true},
+		{"site.io", 80, "/administrator", false},
+		{"site.io", 80, "/Admin", false},
+		{"site.io", 80, "/", false},
+		{"site.io", 80, "/x/../admin", true},
+		{"site.io", 80, "/%61dmin", true},
+		{"site.io", 80, "/x%2F..%2Fadmin", true},
+		{"site.io", 80, "/../admin", false},
+		{"site.io", 80, "/%2e%2e/admin", false},
+		{"www.site.io", 80, "/admin", false},
+		{"a.api.io", 8443, "/v1/users", true},
+		{"a.api.io", 8443, "/v1", false},
+		{"a.api.io", 443, "/v1/users", false},
+		{"example.com", 80, "/anything", true},
+	}
+	for _, tt := range tests {
+		if got := m.MatchURL(tt.host, tt.port, tt.rawPath); got != tt.want {
+			t.Errorf("MatchURL(%q, %d, %q) = %v, want %v", tt.host, tt.port, tt.rawPath, got, tt.want)
+		}
+	}
+
+	if !m.MatchAnyPath("site.io", 443) {
+		t.Errorf("MatchAnyPath(site.io) = false, want true for a host with path rules")
+	}
+	if m.MatchAnyPath("other.io", 443) {
+		t.Errorf("MatchAnyPath(other.io) = true, want false")
+	}
+}
@@ -0,0 +1,254 @@
+// Package rules implements the host rule language used by proxy
+// whitelists, blacklists and upstream routing rules.
+//
+// Supported entries:
+//
+//	example.com          exact host
+//	*.example.com        any subdomain of example.com (not the apex)
+//	.example.com         example.com and any of its subdomains
+//	10.1.2.3             exact IPv4/IPv6 address
+//	10.0.0.0/8           CIDR range (IPv4 or IPv6)
+//	re:^ads?\d+\.        regular expression matched against the host
+//
+// Any non-regex entry may carry a port qualifier (example.com:443,
+// *.example.com:8080, 10.0.0.0/8:22). IPv6 addresses and ranges must be
+// bracketed when a port is given ([2001:db8::/32]:443).
+//
+// Host and IP entries may also carry a path (example.com/admin,
+// *.example.com:8443/api/). A path matches itself and anything below it;
+// it is case sensitive. Entry and request paths are both compared in the
+// form CleanPath gives them. Path entries only apply where the full URL is
+// known, i.e. plain HTTP requests and intercepted HTTPS; a tunnel to the
+// host alone matches neither way.
+package rules
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const RegexPrefix = "re:"
+
+type Kind int
+
+const (
+	KindExact Kind = iota
+	KindSubdomains
+	KindDomain
+	KindIP
+	KindCIDR
+	KindRegex
+)
+
+// Rule is a parsed list entry.
+type Rule struct {
+	Kind  Kind
+	Host  string
+	Port  int
+	Path  string
+	IPNet *net.IPNet
+	Regex *regexp.Regexp
+}
+
+// Parse validates entry and returns its parsed form. Hosts are lowercased.
+func Parse(entry string) (*Rule, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil, fmt.Errorf("entry is empty")
+	}
+
+	if strings.HasPrefix(strings.ToLower(entry), RegexPrefix) {
+		pattern := entry[len(RegexPrefix):]
+		if pattern == "" {
+			return nil, fmt.Errorf("regex is empty")
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		return &Rule{Kind: KindRegex, Host: pattern, Regex: re}, nil
+	}
+
+	if strings.Contains(entry, "://") {
+		return nil, fmt.Errorf("entries must not include a scheme")
+	}
+	var path string
+	if idx := strings.IndexByte(entry, '/'); idx >= 0 && !looksLikeCIDR(strings.ToLower(entry)) {
+		entry, path = entry[:idx], entry[idx:]
+		cleaned, ok := CleanPath(path)
+		if !ok {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		// Checked once decoded so that the canonical form parses again.
+		if strings.ContainsAny(cleaned, "?#") {
+			return nil, fmt.Errorf("paths must not include a query or fragment")
+		}
+		if path = cleaned; path == "/" {
+			path = ""
+		}
+	}
+	entry = strings.ToLower(entry)
+	if strings.ContainsAny(entry, "?#") {
+		return nil, fmt.Errorf("entries must be hosts or host paths, not URLs")
+	}
+
+	host, port, err := splitPort(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", host)
+		}
+		return &Rule{Kind: KindCIDR, Host: ipNet.String(), Port: port, IPNet: ipNet}, nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &Rule{Kind: KindIP, Host: ip.String(), Port: port, Path: path}, nil
+	}
+
+	kind := KindExact
+	switch {
+	case strings.HasPrefix(host, "*."):
+		kind = KindSubdomains
+		host = host[2:]
+	case strings.HasPrefix(host, "."):
+		kind = KindDomain
+		host = host[1:]
+	}
+
+	if err := validateHostname(host); err != nil {
+		return nil, err
+	}
+	return &Rule{Kind: kind, Host: host, Port: port, Path: path}, nil
+}
+
+// String returns the canonical form of the rule.
+func (r *Rule) String() string {
+	if r.Kind == KindRegex {
+		return RegexPrefix + r.Host
+	}
+
+	host := r.Host
+	switch r.Kind {
+	case KindSubdomains:
+		host = "*." + host
+	case KindDomain:
+		host = "." + host
+	}
+	if r.Port == 0 {
+		return host + r.Path
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host + ":" + strconv.Itoa(r.Port) + r.Path
+}
+
+// Normalize parses entry and returns its canonical form.
+func Normalize(entry string) (string, error) {
+	rule, err := Parse(entry)
+	if err != nil {
+		return "", err
+	}
+	return rule.String(), nil
+}
+
+func splitPort(entry string) (string, int, error) {
+	if strings.HasPrefix(entry, "[") {
+		end := strings.Index(entry, "]")
+		if end < 0 {
+			return "", 0, fmt.Errorf("missing closing bracket")
+		}
+		host := entry[1:end]
+		rest := entry[end+1:]
+		if rest == "" {
+			return host, 0, nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", 0, fmt.Errorf("unexpected text after bracketed address")
+		}
+		port, err := parsePort(rest[1:])
+		return host, port, err
+	}
+
+	// Bare IPv6 addresses and ranges contain several colons and no port.
+	if strings.Count(entry, ":") > 1 {
+		return entry, 0, nil
+	}
+	if idx := strings.LastIndex(entry, ":"); idx >= 0 {
+		port, err := parsePort(entry[idx+1:])
+		return entry[:idx], port, err
+	}
+	return entry, 0, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", value)
+	}
+	return port, nil
+}
+
+func looksLikeCIDR(entry string) bool {
+	host, _, err := splitPort(entry)
+	if err != nil {
+		return false
+	}
+	_, _, err = net.ParseCIDR(host)
+	return err == nil
+}
+
+func validateHostname(host string) error {
+	if host == "" {
+		return fmt.Errorf("host is empty")
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("host is too long")
+	}
+	if strings.Contains(host, "*") {
+		return fmt.Errorf("wildcards are only allowed as a leading \"*.\"")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid character %q in host %q", c, host)
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateLegacy converts an entry written for the old substring matcher
+// into the rule language. Dotted domains become ".domain" (domain plus
+// subdomains), IPs and CIDRs are kept, and anything else is preserved as a
+// regex reproducing the previous substring match.
+func MigrateLegacy(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "" {
+		return ""
+	}
+	if rule, err := Parse(entry); err == nil && rule.Path == "" {
+		switch rule.Kind {
+		case KindExact:
+			if strings.Contains(rule.Host, ".") {
+				rule.Kind = KindDomain
+			} else {
+				return RegexPrefix + regexp.QuoteMeta(entry)
+			}
+		case KindRegex:
+			return RegexPrefix + regexp.QuoteMeta(entry)
+		}
+		return rule.String()
+	}
+	return RegexPrefix + regexp.QuoteMeta(entry)
+}
@@ -0,0 +1,130 @@
+package rules
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		entry string
+		kind  Kind
+		port  int
+		path  string
+		want  string
+	}{
+		{"example.com", KindExact, 0, "", "example.com"},
+		{"  Example.COM  ", KindExact, 0, "", "example.com"},
+		{"example.com.", KindExact, 0, "", "example.com."},
+		{"*.example.com", KindSubdomains, 0, "", "*.example.com"},
+		{".example.com", KindDomain, 0, "", ".example.com"},
+		{"example.com:443", KindExact, 443, "", "example.com:443"},
+		{"*.example.com:8080", KindSubdomains, 8080, "", "*.example.com:8080"},
+		{"10.1.2.3", KindIP, 0, "", "10.1.2.3"},
+		{"10.1.2.3:22", KindIP, 22, "", "10.1.2.3:22"},
+		{"10.0.0.0/8", KindCIDR, 0, "", "10.0.0.0/8"},
+		{"10.1.2.3/8", KindCIDR, 0, "", "10.0.0.0/8"},
+		{"10.0.0.0/8:22", KindCIDR, 22, "", "10.0.0.0/8:22"},
+		{"2001:DB8::1", KindIP, 0, "", "2001:db8::1"},
+		{"[2001:db8::1]", KindIP, 0, "", "2001:db8::1"},
+		{"[2001:db8::1]:443", KindIP, 443, "", "[2001:db8::1]:443"},
+		{"2001:db8::/32", KindCIDR, 0, "", "2001:db8::/32"},
+		{"[2001:db8::/32]:443", KindCIDR, 443, "", "[2001:db8::/32]:443"},
+		{"[2001:db8::1]:443/admin", KindIP, 443, "/admin", "[2001:db8::1]:443/admin"},
+		{`re:^ads?\d+\.`, KindRegex, 0, "", `re:^ads?\d+\.`},
+		{`RE:tracker`, KindRegex, 0, "", `re:tracker`},
+		{"example.com/admin", KindExact, 0, "/admin", "example.com/admin"},
+		{"Example.com/Admin", KindExact, 0, "/Admin", "example.com/Admin"},
+		{"*.example.com:8443/api/", KindSubdomains, 8443, "/api/", "*.example.com:8443/api/"},
+		{"example.com/", KindExact, 0, "", "example.com"},
+		{"example.com/a/./b/../c", KindExact, 0, "/a/c", "example.com/a/c"},
+		{"example.com/a%2Fb", KindExact, 0, "/a/b", "example.com/a/b"},
+		{"example.com/%61dmin", KindExact, 0, "/admin", "example.com/admin"},
+	}
+	for _, tt := range tests {
+		rule, err := Parse(tt.entry)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.entry, err)
+			continue
+		}
+		if rule.Kind != tt.kind || rule.Port != tt.port || rule.Path != tt.path {
+			t.Errorf("Parse(%q) = kind %d port %d path %q, want kind %d port %d path %q",
+				tt.entry, rule.Kind, rule.Port, rule.Path, tt.kind, tt.port, tt.path)
+		}
+		if got := rule.String(); got != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.entry, got, tt.want)
+		}
+		// The canonical form parses back to itself.
+		if again, err := Normalize(tt.want); err != nil || again != tt.want {
+			t.Errorf("Normalize(%q) = %q, %v; want it unchanged", tt.want, again, err)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, entry := range []string{
+		"",
+		"   ",
+		"re:",
+		"re:(",
+		"http://example.com",
+		"example.com:0",
+		"example.com:65536",
+		"example.com:http",
+		"[2001:db8::1",
+		"[2001:db8::1]443",
+		"[2001:db8::1]:0",
+		"foo*.example.com",
+		"*example.com",
+		"exa mple.com",
+		"example..com",
+		"example.com?x=1",
+		"example.com#top",
+		"example.com/a?b",
+		"example.com/%3Fb",
+		"example.com/..",
+		"example.com/../admin",
+		"example.com/a/../../admin",
+		"example.com/%2E%2E/admin",
+		"example.com/a%2F..%2F..%2Fadmin",
+		"example.com/%zz",
+		"[10.0.0.0/33]",
+	} {
+		if rule, err := Parse(entry); err == nil {
+			t.Errorf("Parse(%q) = %q, want an error", entry, rule.String())
+		}
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{"example.com", ".example.com"},
+		{" Example.COM ", ".example.com"},
+		{"example.com:8080", ".example.com:8080"},
+		{"*.example.com", "*.example.com"},
+		{".example.com", ".example.com"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"localhost", `re:localhost`},
+		{"ads", `re:ads`},
+		{"example.com/path", `re:example\.com/path`},
+		{"re:x", `re:re:x`},
+		{"a+b", `re:a\+b`},
+	}
+	for _, tt := range tests {
+		got := MigrateLegacy(tt.entry)
+		if got != tt.want {
+			t.Errorf("MigrateLegacy(%q) = %q, want %q", tt.entry, got, tt.want)
+			continue
+		}
+		if got == "" {
+			continue
+		}
+		if _, err := Parse(got); err != nil {
+			t.Errorf("MigrateLegacy(%q) = %q, which does not parse: %v", tt.entry, got, err)
+		}
+	}
+}
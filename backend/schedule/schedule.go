@@ -0,0 +1,290 @@
+// Package schedule implements the access schedules that limit when a user
+// may use the proxy.
+//
+// A schedule has a time zone, a list of windows and a list of holidays.
+// Windows are written as an optional set of weekdays followed by a time
+// range:
+//
+//	mon-fri 09:00-18:00   weekdays during office hours
+//	sat,sun 10:00-14:00   weekend mornings
+//	fri-mon 22:00-06:00   from 22:00 on Friday to Monday until 06:00 the next day
+//	08:00-20:00           every day
+//
+// A range whose end is not after its start runs past midnight into the
+// next day; 24:00 ends a window at midnight. Holidays are dates
+// (2026-12-25) on which no window applies. A schedule without windows
+// allows access at any time.
+package schedule
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// The runtime image ships without a zoneinfo database.
+	_ "time/tzdata"
+
+	"proxy-server/models"
+)
+
+// DefaultTimeZone is used when a schedule names none.
+const DefaultTimeZone = "UTC"
+
+const (
+	minutesPerDay = 24 * 60
+	dateLayout    = "2006-01-02"
+)
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is a compiled access schedule.
+type Schedule struct {
+	location *time.Location
+	windows  []window
+	holidays map[string]struct{}
+}
+
+type window struct {
+	days  [7]bool
+	start int // minutes after midnight
+	end   int // minutes after midnight, up to minutesPerDay
+}
+
+func (w window) crossesMidnight() bool {
+	return w.end <= w.start
+}
+
+// Compile parses s. It returns nil for a schedule without windows.
+func Compile(s models.Schedule) (*Schedule, error) {
+	if len(s.Windows) == 0 {
+		return nil, nil
+	}
+
+	zone := strings.TrimSpace(s.TimeZone)
+	if zone == "" {
+		zone = DefaultTimeZone
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", zone)
+	}
+
+	compiled := &Schedule{location: location, holidays: make(map[string]struct{})}
+	for _, entry := range s.Windows {
+		w, err := parseWindow(entry)
+		if err != nil {
+			return nil, err
+		}
+		compiled.windows = append(compiled.windows, w)
+	}
+	for _, entry := range s.Holidays {
+		date, err := time.Parse(dateLayout, strings.TrimSpace(entry))
+		if err != nil {
+			return nil, fmt.Errorf("invalid holiday %q (use YYYY-MM-DD)", strings.TrimSpace(entry))
+		}
+		compiled.holidays[date.Format(dateLayout)] = struct{}{}
+	}
+	return compiled, nil
+}
+
+// Normalize validates s and returns it in canonical form: the time zone
+// set, windows rewritten as "mon-fri 09:00-18:00" and holidays sorted
+// without duplicates. A schedule without windows normalizes to the zero
+// value.
+func Normalize(s models.Schedule) (models.Schedule, error) {
+	var windows []string
+	for _, entry := range s.Windows {
+		if strings.TrimSpace(entry) != "" {
+			windows = append(windows, entry)
+		}
+	}
+	s.Windows = windows
+
+	compiled, err := Compile(s)
+	if err != nil || compiled == nil {
+		return models.Schedule{Windows: []string{}, Holidays: []string{}}, err
+	}
+
+	normalized := models.Schedule{
+		TimeZone: compiled.location.String(),
+		Windows:  make([]string, 0, len(compiled.windows)),
+		Holidays: make([]string, 0, len(compiled.holidays)),
+	}
+	for _, w := range compiled.windows {
+		normalized.Windows = append(normalized.Windows, w.String())
+	}
+	for date := range compiled.holidays {
+		normalized.Holidays = append(normalized.Holidays, date)
+	}
+	sort.Strings(normalized.Holidays)
+	return normalized, nil
+}
+
+// Allows reports whether access is permitted at t. A nil schedule always
+// allows access.
+func (s *Schedule) Allows(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	local := t.In(s.location)
+	if _, holiday := s.holidays[local.Format(dateLayout)]; holiday {
+		return false
+	}
+
+	day := int(local.Weekday())
+	previous := (day + 6) % 7
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range s.windows {
+		if !w.crossesMidnight() {
+			if w.days[day] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		if (w.days[day] && minute >= w.start) || (w.days[previous] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseWindow(entry string) (window, error) {
+	fields := strings.Fields(strings.ToLower(entry))
+	var w window
+	var timeRange string
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+		timeRange = fields[0]
+	case 2:
+		if err := parseDays(fields[0], &w.days); err != nil {
+			return window{}, fmt.Errorf("invalid window %q: %v", strings.TrimSpace(entry), err)
+		}
+		timeRange = fields[1]
+	default:
+		return window{}, fmt.Errorf("invalid window %q (use e.g. \"mon-fri 09:00-18:00\")", strings.TrimSpace(entry))
+	}
+
+	start, end, ok := strings.Cut(timeRange, "-")
+	if !ok {
+		return window{}, fmt.Errorf("invalid window %q: time range must be HH:MM-HH:MM", strings.TrimSpace(entry))
+	}
+	var err error
+	if w.start, err = parseClock(start, false); err != nil {
+		return window{}, fmt.Errorf("invalid window %q: %v", strings.TrimSpace(entry), err)
+	}
+	if w.end, err = parseClock(end, true); err != nil {
+		return window{}, fmt.Errorf("invalid window %q: %v", strings.TrimSpace(entry), err)
+	}
+	if w.start == w.end {
+		return window{}, fmt.Errorf("invalid window %q: empty time range", strings.TrimSpace(entry))
+	}
+	return w, nil
+}
+
+// parseDays reads comma-separated weekdays and weekday ranges. Ranges may
+// wrap around the week (fri-mon).
+func parseDays(value string, days *[7]bool) error {
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := parseWeekday(from)
+		if err != nil {
+			return err
+		}
+		last := first
+		if isRange {
+			if last, err = parseWeekday(to); err != nil {
+				return err
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseWeekday accepts short (mon) and full (monday) weekday names.
+func parseWeekday(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	for i, name := range weekdayNames {
+		if value == name || value == strings.ToLower(time.Weekday(i).String()) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", value)
+}
+
+// parseClock reads HH:MM as minutes after midnight. 24:00 is only accepted
+// as the end of a range.
+func parseClock(value string, isEnd bool) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(value), ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || errH != nil || errM != nil || len(minutes) != 2 || h < 0 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	total := h*60 + m
+	if total > minutesPerDay || (total == minutesPerDay && !isEnd) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return total, nil
+}
+
+// String formats w in the canonical window syntax.
+func (w window) String() string {
+	times := fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+	days := formatDays(w.days)
+	if days == "" {
+		return times
+	}
+	return days + " " + times
+}
+
+// formatDays writes days as ranges starting from Monday, or "" for every
+// day.
+func formatDays(days [7]bool) string {
+	count := 0
+	for _, on := range days {
+		if on {
+			count++
+		}
+	}
+	if count == 7 {
+		return ""
+	}
+
+	// Start after a day that is off so that ranges wrapping the week,
+	// like fri-mon, are kept in one piece.
+	begin := 1
+	for days[(begin+6)%7] {
+		begin = (begin + 1) % 7
+	}
+	var parts []string
+	for i := 0; i < 7; {
+		day := (begin + i) % 7
+		if !days[day] {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < 7 && days[(begin+j+1)%7] {
+			j++
+		}
+		last := (begin + j) % 7
+		switch {
+		case j == i:
+			parts = append(parts, weekdayNames[day])
+		default:
+			parts = append(parts, weekdayNames[day]+"-"+weekdayNames[last])
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,148 @@
+package schedule
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"proxy-server/models"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in   models.Schedule
+		want models.Schedule
+	}{
+		{
+			models.Schedule{},
+			models.Schedule{Windows: []string{}, Holidays: []string{}},
+		},
+		{
+			models.Schedule{TimeZone: "Europe/Berlin", Windows: []string{" ", ""}, Holidays: []string{"2026-12-25"}},
+			models.Schedule{Windows: []string{}, Holidays: []string{}},
+		},
+		{
+			models.Schedule{Windows: []string{"08:00-20:00"}},
+			models.Schedule{TimeZone: "UTC", Windows: []string{"08:00-20:00"}, Holidays: []string{}},
+		},
+		{
+			models.Schedule{
+				TimeZone: " Europe/Berlin ",
+				Windows:  []string{"Mon-Fri 9:00-18:00", "saturday,sunday 10:00-14:00", "fri-mon 22:00-06:00"},
+				Holidays: []string{"2026-12-26", " 2026-12-25", "2026-12-26"},
+			},
+			models.Schedule{
+				TimeZone: "Europe/Berlin",
+				Windows:  []string{"mon-fri 09:00-18:00", "sat-sun 10:00-14:00", "fri-mon 22:00-06:00"},
+				Holidays: []string{"2026-12-25", "2026-12-26"},
+			},
+		},
+		{
+			models.Schedule{Windows: []string{"mon,wed-fri 00:00-24:00", "sun,tue 12:30-13:00", "mon-sun 07:00-08:00"}},
+			models.Schedule{
+				TimeZone: "UTC",
+				Windows:  []string{"mon,wed-fri 00:00-24:00", "tue,sun 12:30-13:00", "07:00-08:00"},
+				Holidays: []string{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Normalize(tt.in)
+		if err != nil {
+			t.Errorf("Normalize(%+v) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Normalize(%+v) = %+v, want %+v", tt.in, got, tt.want)
+			continue
+		}
+		// The canonical form normalizes to itself.
+		if again, err := Normalize(got); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("Normalize(%+v) = %+v, %v; want it unchanged", got, again, err)
+		}
+	}
+}
+
+func TestCompileRejects(t *testing.T) {
+	for _, s := range []models.Schedule{
+		{TimeZone: "Mars/Olympus", Windows: []string{"08:00-20:00"}},
+		{Windows: []string{"mon-fri"}},
+		{Windows: []string{"mon-fri 09:00"}},
+		{Windows: []string{"mon fri 09:00-18:00"}},
+		{Windows: []string{"funday 09:00-18:00"}},
+		{Windows: []string{"mon-xyz 09:00-18:00"}},
+		{Windows: []string{"mon, 09:00-18:00"}},
+		{Windows: []string{"09:00-09:00"}},
+		{Windows: []string{"24:00-06:00"}},
+		{Windows: []string{"09:00-24:01"}},
+		{Windows: []string{"25:00-26:00"}},
+		{Windows: []string{"09:60-10:00"}},
+		{Windows: []string{"9:5-10:00"}},
+		{Windows: []string{"-1:00-10:00"}},
+		{Windows: []string{"aa:bb-10:00"}},
+		{Windows: []string{"08:00-20:00"}, Holidays: []string{"25.12.2026"}},
+		{Windows: []string{"08:00-20:00"}, Holidays: []string{"2026-02-30"}},
+	} {
+		if compiled, err := Compile(s); err == nil {
+			t.Errorf("Compile(%+v) = %+v, want an error", s, compiled)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("LoadLocation failed: %v", err)
+	}
+	s, err := Compile(models.Schedule{
+		TimeZone: "Europe/Berlin",
+		Windows:  []string{"mon-fri 09:00-18:00", "fri-sat 22:00-02:00", "sun 00:00-24:00"},
+		Holidays: []string{"2026-10-14"},
+	})
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	// 2026-10-12 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, minute, 0, 0, berlin)
+	}
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(0, 8, 59), false},
+		{at(0, 9, 0), true},
+		{at(0, 17, 59), true},
+		{at(0, 18, 0), false},
+		{at(1, 12, 0), true},
+		// Holiday.
+		{at(2, 12, 0), false},
+		{at(3, 12, 0), true},
+		{at(4, 21, 59), false},
+		{at(4, 22, 0), true},
+		// Past midnight after Friday and Saturday.
+		{at(5, 1, 59), true},
+		{at(5, 2, 0), false},
+		{at(5, 12, 0), false},
+		{at(5, 23, 0), true},
+		{at(6, 1, 0), true},
+		{at(6, 23, 59), true},
+		// Thursday's window does not cross midnight into Friday.
+		{at(4, 1, 0), false},
+		// The same instant in UTC is judged by the schedule's time zone.
+		{at(0, 9, 30).UTC(), true},
+		{time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 12, 6, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := s.Allows(tt.t); got != tt.want {
+			t.Errorf("Allows(%s) = %v, want %v", tt.t.Format(time.RFC1123), got, tt.want)
+		}
+	}
+
+	var none *Schedule
+	if !none.Allows(at(0, 3, 0)) {
+		t.Errorf("a nil schedule refused access")
+	}
+}
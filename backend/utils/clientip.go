@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// LoadTrustedProxies parses the environment variable name, the
+// comma-separated IPs or CIDR ranges of proxies or load balancers whose
+// X-Forwarded-For header is believed.
+func LoadTrustedProxies(name string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, entry := range strings.Split(os.Getenv(name), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		network, err := ParseIPNet(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// ParseIPNet accepts a CIDR range or a single IP, which is treated as a
+// range of one address.
+func ParseIPNet(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address range %q", entry)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address a request comes from. When the direct peer
+// is one of trusted, X-Forwarded-For is read from the right, skipping
+// further trusted hops, so clients cannot spoof it by sending their own.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil || !ContainsIP(trusted, peerIP) {
+		return peer
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		peer = ip.String()
+		if !ContainsIP(trusted, ip) {
+			break
+		}
+	}
+	return peer
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"image/png"
 	"io"
@@ -27,6 +28,12 @@ const (
 	defaultTotpPeriod  = 30
 	totpValidationSkew = 1
 	qrImageSize        = 256
+
+	// ProxyTokenPrefix marks proxy API tokens so they can be told apart from
+	// passwords and JWTs.
+	ProxyTokenPrefix   = "pzt_"
+	proxyTokenBytes    = 32
+	proxyTokenShownLen = 8
 )
 
 func getEncryptionKey() ([]byte, error) {
@@ -187,3 +194,25 @@ func GenerateBackupCodes(count int) ([]string, error) {
 	}
 	return codes, nil
 }
+
+// GenerateProxyToken returns a new proxy API token together with the
+// leading characters kept in clear so admins can recognise it later.
+func GenerateProxyToken() (token, hint string, err error) {
+	buf := make([]byte, proxyTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = ProxyTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return token, token[:len(ProxyTokenPrefix)+proxyTokenShownLen], nil
+}
+
+// HashProxyToken is the form proxy tokens are stored and looked up in.
+// Tokens are random, so a fast hash is sufficient.
+func HashProxyToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsProxyToken(value string) bool {
+	return strings.HasPrefix(value, ProxyTokenPrefix)
+}
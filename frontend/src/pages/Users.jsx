@@ -18,7 +18,7 @@ function Users() {
     comment: '',
     is_admin: false,
     is_active: true,
-    proxy_type: 'default',
+    proxy_type: '',
   });
   const [whitelistText, setWhitelistText] = useState('');
   const [blacklistText, setBlacklistText] = useState('');
@@ -75,7 +75,7 @@ function Users() {
       comment: details.comment || '',
       is_admin: details.is_admin,
       is_active: details.is_active,
-      proxy_type: details.proxy_type || 'default',
+      proxy_type: details.proxy_type ?? '',
     });
     setWhitelistText((details.whitelist || []).join('\n'));
     setBlacklistText((details.blacklist || []).join('\n'));
@@ -91,7 +91,7 @@ function Users() {
       comment: '',
       is_admin: false,
       is_active: true,
-      proxy_type: 'default',
+      proxy_type: '',
     });
     setWhitelistText('');
     setBlacklistText('');
@@ -138,7 +138,8 @@ function Users() {
       return;
     }
 
-    const proxyType = formData.proxy_type || 'default';
+    // An empty proxy type is sent as null: the user inherits it from their groups.
+    const proxyType = formData.proxy_type || null;
     const parseList = (text) =>
       text
         .split('\n')
@@ -311,7 +312,7 @@ function Users() {
                     <span className="badge">User</span>
                   )}
                 </td>
-                <td>{user.proxy_type || 'default'}</td>
+                <td>{user.proxy_type ?? 'inherited'}</td>
                 <td>
                   {user.is_active ? (
                     <span className="badge badge-success">Active</span>
@@ -439,6 +440,7 @@ function Users() {
                   className="input"
                   disabled={formData.is_admin}
                 >
+                  <option value="">Inherit from groups</option>
                   <option value="default">Default</option>
                   <option value="whitelist">White List</option>
                   <option value="blacklist">Black List</option>
@@ -9,9 +9,28 @@ CREATE TABLE IF NOT EXISTS users (
     comment TEXT,
     is_admin BOOLEAN DEFAULT FALSE,
     is_active BOOLEAN DEFAULT TRUE,
-    proxy_type VARCHAR(20) DEFAULT 'default',
+    -- NULL proxy_type, quotas and schedule are inherited from the user's groups
+    proxy_type VARCHAR(20),
     twofa_secret TEXT,
     twofa_enabled BOOLEAN DEFAULT FALSE,
+    upstream_pool VARCHAR(255) DEFAULT '',
+    quota_daily_bytes BIGINT,
+    quota_monthly_bytes BIGINT,
+    quota_daily_requests BIGINT,
+    quota_monthly_requests BIGINT,
+    bandwidth_up BIGINT NOT NULL DEFAULT 0,
+    bandwidth_down BIGINT NOT NULL DEFAULT 0,
+    bandwidth_burst BIGINT NOT NULL DEFAULT 0,
+    max_connections INTEGER NOT NULL DEFAULT 0,
+    requests_per_second INTEGER NOT NULL DEFAULT 0,
+    requests_per_minute INTEGER NOT NULL DEFAULT 0,
+    mitm_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    http_cache BOOLEAN NOT NULL DEFAULT TRUE,
+    egress_addresses TEXT[] NOT NULL DEFAULT '{}',
+    egress_strategy VARCHAR(20) NOT NULL DEFAULT 'round_robin',
+    schedule_time_zone VARCHAR(64),
+    schedule_windows TEXT[],
+    schedule_holidays TEXT[],
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -46,6 +65,8 @@ CREATE TABLE IF NOT EXISTS request_logs (
     bytes_sent BIGINT,
     bytes_received BIGINT,
     duration_ms INTEGER,
+    reason TEXT,
+    cache_status TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -62,7 +83,22 @@ INSERT INTO proxy_settings (key, value, description) VALUES
     ('timeout_seconds', '30', 'Connection timeout in seconds'),
     ('enable_logging', 'true', 'Enable request logging'),
     ('allow_http', 'true', 'Allow HTTP connections'),
-    ('allow_https', 'true', 'Allow HTTPS connections')
+    ('allow_https', 'true', 'Allow HTTPS connections'),
+    ('block_private_destinations', 'true', 'Block proxying to private, loopback and reserved addresses'),
+    ('mitm_enabled', 'false', 'Allow TLS interception for users and destinations that opt in'),
+    ('mitm_bypass', '', 'Comma-separated hosts never intercepted (e.g. certificate-pinned services)'),
+    ('http_cache_enabled', 'false', 'Cache plain HTTP responses shared between users'),
+    ('http_cache_max_mb', '1024', 'Maximum size of the HTTP response cache on disk in MB'),
+    ('transport_dial_timeout_seconds', '10', 'Timeout for connecting to destinations of plain HTTP requests'),
+    ('transport_tls_timeout_seconds', '10', 'TLS handshake timeout for forwarded https:// requests'),
+    ('transport_idle_timeout_seconds', '90', 'How long idle upstream connections are kept for reuse'),
+    ('transport_max_idle_per_host', '16', 'Idle upstream connections kept per destination'),
+    ('transport_max_conns_per_host', '0', 'Maximum upstream connections per destination (0 = unlimited)'),
+    ('transport_http2', 'true', 'Use HTTP/2 to destinations that support it'),
+    ('auth_max_failures', '10', 'Failed logins per source IP within the window before a temporary ban (0 = never ban)'),
+    ('auth_failure_window_seconds', '900', 'Window in which failed logins are counted'),
+    ('auth_ban_minutes', '30', 'How long a banned username or source IP is refused'),
+    ('auth_delay_after', '3', 'Failed logins after which failures are answered with growing delays (0 = no delay)')
 ON CONFLICT (key) DO NOTHING;
 
 -- Function to update updated_at timestamp
@@ -86,6 +122,7 @@ CREATE TABLE IF NOT EXISTS user_proxy_whitelist (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
     value TEXT NOT NULL,
+    rule_version INTEGER NOT NULL DEFAULT 2,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(user_id, value)
 );
@@ -94,6 +131,7 @@ CREATE TABLE IF NOT EXISTS user_proxy_blacklist (
     id SERIAL PRIMARY KEY,
     user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
     value TEXT NOT NULL,
+    rule_version INTEGER NOT NULL DEFAULT 2,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     UNIQUE(user_id, value)
 );
@@ -129,3 +167,194 @@ CREATE TABLE IF NOT EXISTS twofa_logs (
 
 CREATE INDEX IF NOT EXISTS idx_twofa_logs_user ON twofa_logs(user_id, created_at);
 CREATE INDEX IF NOT EXISTS idx_twofa_logs_ip ON twofa_logs(ip_address, created_at);
+
+-- Upstream proxies used for chaining
+CREATE TABLE IF NOT EXISTS upstream_proxies (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    type VARCHAR(10) NOT NULL DEFAULT 'http',
+    address TEXT NOT NULL,
+    username TEXT,
+    password TEXT,
+    pool VARCHAR(255) NOT NULL,
+    priority INTEGER DEFAULT 0,
+    is_active BOOLEAN DEFAULT TRUE,
+    healthy BOOLEAN DEFAULT TRUE,
+    last_checked_at TIMESTAMP NULL,
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS upstream_rules (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    pattern TEXT NOT NULL,
+    pool VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_upstream_proxies_pool ON upstream_proxies(pool);
+CREATE INDEX IF NOT EXISTS idx_upstream_rules_user ON upstream_rules(user_id);
+
+-- Per-user exceptions to the private destination guard
+CREATE TABLE IF NOT EXISTS user_egress_exceptions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, value)
+);
+
+-- Destinations whose HTTPS traffic is intercepted for a user
+CREATE TABLE IF NOT EXISTS user_mitm_hosts (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, value)
+);
+
+-- Named proxy credentials users can log in with instead of their password
+CREATE TABLE IF NOT EXISTS proxy_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,
+    hint VARCHAR(32) NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_proxy_tokens_user ON proxy_tokens(user_id);
+
+-- Source IPs and usernames blocked after too many failed logins
+CREATE TABLE IF NOT EXISTS auth_bans (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL,
+    value TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    failures INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    UNIQUE(kind, value)
+);
+
+-- Client addresses (IPs or CIDR ranges) a user may connect to the proxy from
+CREATE TABLE IF NOT EXISTS user_client_allowlist (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, value)
+);
+
+-- Groups sharing a proxy policy among their members
+CREATE TABLE IF NOT EXISTS user_groups (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    priority INTEGER NOT NULL DEFAULT 0,
+    proxy_type VARCHAR(20) NOT NULL DEFAULT 'default',
+    quota_daily_bytes BIGINT NOT NULL DEFAULT 0,
+    quota_monthly_bytes BIGINT NOT NULL DEFAULT 0,
+    quota_daily_requests BIGINT NOT NULL DEFAULT 0,
+    quota_monthly_requests BIGINT NOT NULL DEFAULT 0,
+    schedule_time_zone VARCHAR(64) NOT NULL DEFAULT '',
+    schedule_windows TEXT[] NOT NULL DEFAULT '{}',
+    schedule_holidays TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS user_group_members (
+    group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_group_members_user ON user_group_members(user_id);
+
+-- Whitelist and blacklist entries of groups
+CREATE TABLE IF NOT EXISTS group_proxy_whitelist (
+    id SERIAL PRIMARY KEY,
+    group_id INTEGER REFERENCES user_groups(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(group_id, value)
+);
+
+CREATE TABLE IF NOT EXISTS group_proxy_blacklist (
+    id SERIAL PRIMARY KEY,
+    group_id INTEGER REFERENCES user_groups(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(group_id, value)
+);
+
+-- Group whitelist and blacklist entries that do not apply to a member
+CREATE TABLE IF NOT EXISTS user_whitelist_exclusions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, value)
+);
+
+CREATE TABLE IF NOT EXISTS user_blacklist_exclusions (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    value TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, value)
+);
+
+-- Named host lists shared by users and groups
+CREATE TABLE IF NOT EXISTS host_lists (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) UNIQUE NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    source TEXT NOT NULL DEFAULT '',
+    format VARCHAR(20) NOT NULL DEFAULT 'auto',
+    refresh_minutes INTEGER NOT NULL DEFAULT 0,
+    revision INTEGER NOT NULL DEFAULT 0,
+    entry_count INTEGER NOT NULL DEFAULT 0,
+    skipped_count INTEGER NOT NULL DEFAULT 0,
+    checksum VARCHAR(64) NOT NULL DEFAULT '',
+    last_refreshed_at TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS host_list_entries (
+    list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+    value TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_host_list_entries_list ON host_list_entries(list_id);
+
+-- Host lists referenced by users and groups; kind is whitelist or blacklist
+CREATE TABLE IF NOT EXISTS user_host_lists (
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    PRIMARY KEY (user_id, kind, list_id)
+);
+
+CREATE TABLE IF NOT EXISTS group_host_lists (
+    group_id INTEGER NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE,
+    list_id INTEGER NOT NULL REFERENCES host_lists(id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL,
+    PRIMARY KEY (group_id, kind, list_id)
+);
+
+-- Certificate authority used to sign intercepted connections
+CREATE TABLE IF NOT EXISTS mitm_ca (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    cert_pem TEXT NOT NULL,
+    key_encrypted TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);